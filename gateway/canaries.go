@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/mmlt/apigw/ingress"
+	"github.com/mmlt/apigw/mw"
+	"net/http"
+)
+
+// Canaries is a http.HandlerFunc that shows the canaries (GET) and changes the weight of a canary (POST with a
+// {"pool": "default", "weight": 20} body).
+// A weight that is changed is kept on reload unless the config of the canary changes.
+// The response contains the effective and configured weight of each canary.
+func (gw *Gateway) Canaries(w http.ResponseWriter, r *http.Request) {
+	gw.mu.Lock()
+	in := gw.in
+	gw.mu.Unlock()
+	if in == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "gateway is not running"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Pool   string `json:"pool"`
+			Weight *int   `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": "body must be {\"pool\": name, \"weight\": 0-100}"})
+			return
+		}
+		if req.Pool == "" {
+			req.Pool = ingress.DefaultPool
+		}
+		var canary *mw.Canary
+		for _, cn := range in.Canaries() {
+			if cn.Status().Pool == req.Pool {
+				canary = cn
+			}
+		}
+		if canary == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"status": "pool has no canary"})
+			return
+		}
+		if err := canary.SetWeight(*req.Weight); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"status": err.Error()})
+			return
+		}
+		glog.Infof("canary of pool %s: weight set to %d", req.Pool, *req.Weight)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ss := []mw.CanaryStatus{}
+	for _, cn := range in.Canaries() {
+		ss = append(ss, cn.Status())
+	}
+	writeJSON(w, http.StatusOK, ss)
+}
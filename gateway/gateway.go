@@ -32,6 +32,30 @@ type (
 		// Oauth2Idp defines how to connect to the OAuth2 IDP.
 		Oauth2Idp struct {
 			TokeninfoURL string `yaml:"tokeninfoUrl"`
+			// Introspection enables RFC 7662 token introspection, it takes precedence over TokeninfoURL.
+			Introspection struct {
+				URL              string `yaml:"url"`
+				ClientID         string `yaml:"clientId"`
+				ClientSecretFile string `yaml:"clientSecretFile"`
+			} `yaml:"introspection"`
+			// Cache of tokeninfo and introspection responses.
+			Cache struct {
+				// Freshness is how long a response is used before the IDP is asked again (default 10s).
+				Freshness time.Duration `yaml:"freshness"`
+				// NegativeTTL is how long rejected tokens are cached (default 5s, negative disables).
+				NegativeTTL time.Duration `yaml:"negativeTTL"`
+				// MaxEntries is the maximum number of cached tokens (default 10000).
+				MaxEntries int `yaml:"maxEntries"`
+				// GCInterval is the time between removals of expired entries (default 1m).
+				GCInterval time.Duration `yaml:"gcInterval"`
+			} `yaml:"cache"`
+			// JWT enables local validation of JWT access tokens, it takes precedence over TokeninfoURL.
+			JWT struct {
+				JWKSURL         string        `yaml:"jwksUrl"`
+				Issuer          string        `yaml:"issuer"`
+				Audience        string        `yaml:"audience"`
+				RefreshInterval time.Duration `yaml:"refreshInterval"`
+			} `yaml:"jwt"`
 		} `yaml:"oauth2idp"`
 	}
 
@@ -41,14 +65,23 @@ type (
 		ctx context.Context
 		// Cancel the operation of this apigw.
 		cancel context.CancelFunc
+		// Mu serializes Run, Reload and Shutdown.
+		mu sync.Mutex
 		// Config of the gateway.
 		cfg *Config
 		// Ingress handles incoming API traffic.
 		in *ingress.Ingress
-		// Tokeninfo client gets scopes based on access token.
-		tic *mw.TokeninfoClient
 		// Swagger client gets an openapi definition.
 		openapiClient *openapi.Client
+		// OpenapiCancel stops polling of openapiClient.
+		openapiCancel context.CancelFunc
+
+		// M guards the fields below, they are read on each request.
+		m sync.RWMutex
+		// Index is the most recently read OpenAPI definition.
+		index *path.Index
+		// Idp gets scopes based on access token.
+		idp *idpClient
 	}
 )
 
@@ -64,81 +97,126 @@ func NewWithConfig(c *Config) *Gateway {
 
 // Run an Gateway.
 func (gw *Gateway) Run() error {
-	// Check if tokeninfo is reachable.
-	err := pingURL(gw.cfg.Oauth2Idp.TokeninfoURL)
+	gw.mu.Lock()
+	cfg := gw.cfg
+
+	// Reject the config like Reload does.
+	err := cfg.validate()
+	if err != nil {
+		gw.mu.Unlock()
+		return err
+	}
+
+	// Check if the IDP is reachable.
+	idp, err := newTokeninfo(gw.ctx, cfg)
 	if err != nil {
+		gw.mu.Unlock()
 		return err
 	}
-	glog.Infof("ping idp at %s successful.", gw.cfg.Oauth2Idp.TokeninfoURL)
+	gw.m.Lock()
+	gw.idp = idp
+	gw.m.Unlock()
 
 	// Get Swagger definition via HTTP
-	var index *path.Index
-	var m sync.RWMutex
-	gw.openapiClient = openapi.NewClient(gw.ctx, gw.cfg.Openapi.URL)
-	go gw.openapiClient.Poll(time.Minute, func(idx *path.Index) {
-		glog.Info("switch to new OpenAPI definition")
-		m.Lock()
-		index = idx
-		m.Unlock()
-	})
+	gw.pollOpenapi(cfg.Openapi.URL)
+
+	/*	TODO consider merging BasicTokeninfo into TokeninfoClient
+		gw.in = ingress.NewWithConfig(
+			&gw.cfg.Ingress,
+			scopesFn,
+			mw.BasicTokeninfo(gw.cfg.Oauth2Idp.TokeninfoURL))*/
+
+	gw.in = ingress.NewWithConfig(
+		&cfg.Ingress,
+		gw.findOperation,
+		gw.tokeninfo,
+		gw.findMethods)
+	in := gw.in
+	gw.mu.Unlock()
+
+	return in.Run()
+}
 
-	// scopesFn looks-up scopes in the index.
-	// Note that:
-	// - the index may be swapped anytime (when a new swagger.json is read and parsed successfully)
-	// - the lookup may fail because no OpenAPI definition read (yet)
-	scopesFn := func(method string, url *url.URL) ([]string, error) {
-		m.RLock()
-		idx := index
-		m.RUnlock()
-		if idx == nil {
-			return []string{}, fmt.Errorf("No OpenAPI definition read (yet).") //TODO use error const
+// Reload applies cfg to a running Gateway.
+// The new config is validated first, when it's invalid an error is returned and the gateway continues with the
+// current config.
+// Changes in bind addresses and TLS settings require a restart.
+func (gw *Gateway) Reload(cfg *Config) error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if gw.in == nil {
+		return fmt.Errorf("gateway is not running")
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+
+	old := gw.cfg
+	if cfg.Management.Bind != old.Management.Bind {
+		glog.Warning("config: management bind changes require a restart.")
+	}
+
+	// The tokeninfo client (and its cache) is only replaced when the IDP config or the introspection client secret
+	// changes.
+	tokeninfoChanged := cfg.Oauth2Idp != old.Oauth2Idp
+	if !tokeninfoChanged && cfg.Oauth2Idp.Introspection.URL != "" {
+		secret, err := clientSecret(cfg)
+		if err != nil {
+			return err
 		}
-		ss, err := idx.FindScopes(method, url.Path)
+		tokeninfoChanged = secret != gw.idp.secret
+	}
+	var idp *idpClient
+	if tokeninfoChanged {
+		idp, err = newTokeninfo(gw.ctx, cfg)
 		if err != nil {
-			// any error while looking for method/path is a 404
-			err = echo.NewHTTPError(http.StatusNotFound, err.Error())
+			return err
 		}
-		return ss, err
 	}
 
-	allowMethodsFn := func(path string) ([]string, error) {
-		m.RLock()
-		idx := index
-		m.RUnlock()
-		if idx == nil {
-			return []string{}, fmt.Errorf("No OpenAPI definition read (yet).") //TODO use error const
-		}
-		ss, err := idx.FindMethods(path)
-		if err != nil {
-			// any error while looking for path is a 404
-			err = echo.NewHTTPError(http.StatusNotFound, err.Error())
+	// Swap the middleware chain, this is the last step that can fail.
+	err = gw.in.Reload(&cfg.Ingress)
+	if err != nil {
+		if idp != nil {
+			idp.stop()
 		}
-		return ss, err
+		return err
 	}
 
-	/*	TODO consider merging BasicTokeninfo into TokeninfoClient
-		gw.in = ingress.NewWithConfig(
-			&gw.cfg.Ingress,
-			scopesFn,
-			mw.BasicTokeninfo(gw.cfg.Oauth2Idp.TokeninfoURL))*/
+	if tokeninfoChanged {
+		gw.m.Lock()
+		current := gw.idp
+		gw.idp = idp
+		gw.m.Unlock()
+		current.stop()
+	}
 
-	gw.tic = mw.NewTokeninfoClient(gw.cfg.Oauth2Idp.TokeninfoURL)
-	gw.in = ingress.NewWithConfig(
-		&gw.cfg.Ingress,
-		scopesFn,
-		gw.tic.Call,
-		allowMethodsFn)
+	if cfg.Openapi.URL != old.Openapi.URL {
+		// The current index stays in use until the new url delivers a definition.
+		gw.pollOpenapi(cfg.Openapi.URL)
+	}
 
-	gw.tic.EnableGC(true)
-	return gw.in.Run()
+	gw.cfg = cfg
+	glog.Info("config reloaded")
+
+	return nil
 }
 
 // Shutdown stops server the gracefully.
 func (gw *Gateway) Shutdown(ctx context.Context) error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
 	gw.cancel()
+	if gw.in == nil {
+		return nil
+	}
 	// TODO remove gw.openapiClient.Shutdown(ctx)
-	gw.tic.EnableGC(false)
-	return gw.in.Echo.Shutdown(ctx)
+	gw.idp.stop()
+	return gw.in.Shutdown(ctx)
 }
 
 // ShutdownWithTimeout attempts to stop server the gracefully but waits no more then the specified time for connections to close.
@@ -148,9 +226,99 @@ func (gw *Gateway) ShutdownWithTimeout(to time.Duration) error {
 	return gw.Shutdown(ctx)
 }
 
+// PollOpenapi starts polling url for OpenAPI definitions, an already running poll is stopped.
+// Prerequisite: gw.mu is locked.
+func (gw *Gateway) pollOpenapi(url string) {
+	if gw.openapiCancel != nil {
+		gw.openapiCancel()
+	}
+	ctx, cancel := context.WithCancel(gw.ctx)
+	gw.openapiCancel = cancel
+	gw.openapiClient = openapi.NewClient(ctx, url)
+	go gw.openapiClient.Poll(time.Minute, func(idx *path.Index) {
+		glog.Info("switch to new OpenAPI definition")
+		gw.m.Lock()
+		gw.index = idx
+		gw.m.Unlock()
+	})
+}
+
+// FindOperation looks-up an operation in the index.
+// Note that:
+// - the index may be swapped anytime (when a new swagger.json is read and parsed successfully)
+// - the lookup may fail because no OpenAPI definition read (yet)
+func (gw *Gateway) findOperation(method string, url *url.URL) (*path.Operation, error) {
+	gw.m.RLock()
+	idx := gw.index
+	gw.m.RUnlock()
+	if idx == nil {
+		return nil, fmt.Errorf("No OpenAPI definition read (yet).") //TODO use error const
+	}
+	op, err := idx.FindOperation(method, url.Path)
+	if err != nil {
+		// any error while looking for method/path is a 404
+		err = echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return op, err
+}
+
+// FindMethods looks-up the allowed methods for a path in the index.
+func (gw *Gateway) findMethods(path string) ([]string, error) {
+	gw.m.RLock()
+	idx := gw.index
+	gw.m.RUnlock()
+	if idx == nil {
+		return []string{}, fmt.Errorf("No OpenAPI definition read (yet).") //TODO use error const
+	}
+	ss, err := idx.FindMethods(path)
+	if err != nil {
+		// any error while looking for path is a 404
+		err = echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return ss, err
+}
+
+// Tokeninfo calls the current tokeninfo function.
+func (gw *Gateway) tokeninfo(token string) (*mw.TokeninfoResponse, error) {
+	gw.m.RLock()
+	idp := gw.idp
+	gw.m.RUnlock()
+	return idp.tokeninfo(token)
+}
+
+// Validate checks the parts of the config that are not validated when they are applied.
+func (c *Config) validate() error {
+	if c.Openapi.URL == "" {
+		return fmt.Errorf("config: openapi url is not set")
+	}
+	idp := c.Oauth2Idp
+	if idp.TokeninfoURL == "" && idp.Introspection.URL == "" && idp.JWT.JWKSURL == "" {
+		return fmt.Errorf("config: oauth2idp tokeninfoUrl, introspection.url or jwt.jwksUrl is not set")
+	}
+	if idp.Introspection.URL != "" && (idp.Introspection.ClientID == "" || idp.Introspection.ClientSecretFile == "") {
+		return fmt.Errorf("config: oauth2idp introspection requires clientId and clientSecretFile")
+	}
+	if idp.Cache.MaxEntries < 0 {
+		return fmt.Errorf("config: oauth2idp cache maxEntries must not be negative")
+	}
+	if idp.Cache.GCInterval < 0 {
+		return fmt.Errorf("config: oauth2idp cache gcInterval must not be negative")
+	}
+	if idp.JWT.RefreshInterval < 0 {
+		return fmt.Errorf("config: oauth2idp jwt refreshInterval must not be negative")
+	}
+	return nil
+}
+
 // PingURL returns nil if an url is reachable and an error otherwise.
 func pingURL(url string) error {
-	resp, err := http.Get(url)
+	return pingURLWithTimeout(url, 0)
+}
+
+// PingURLWithTimeout is pingURL that fails when url doesn't respond within timeout (0 means no timeout).
+func pingURLWithTimeout(url string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
 	if err != nil {
 		return err
 	}
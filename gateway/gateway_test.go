@@ -0,0 +1,205 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"github.com/mmlt/apigw/ingress"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReload shows that a reload only replaces the tokeninfo client when the IDP config or client secret changes and
+// that an invalid config is rejected.
+func TestReload(t *testing.T) {
+	var mu sync.Mutex
+	secret := "s3cret"
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		id, s, ok := r.BasicAuth()
+		if !ok || id != "apigw" || s != secret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"active": false}`)
+	}))
+	defer idp.Close()
+	setSecret := func(s string) {
+		mu.Lock()
+		secret = s
+		mu.Unlock()
+	}
+
+	secretFile := writeTempFile(t, "s3cret\n")
+	defer os.Remove(secretFile)
+
+	gw := NewWithConfig(newTestConfig(idp.URL, secretFile))
+	stop := runGateway(t, gw)
+	defer stop()
+	current := func() *idpClient {
+		gw.m.RLock()
+		defer gw.m.RUnlock()
+		return gw.idp
+	}
+	first := current()
+
+	var tests = []struct {
+		prepare func() *Config
+		wantErr bool
+		changed bool
+		info    string
+	}{
+		{
+			prepare: func() *Config { return newTestConfig(idp.URL, secretFile) },
+			info:    "unchanged config keeps tokeninfo client",
+		},
+		{
+			prepare: func() *Config {
+				cfg := newTestConfig(idp.URL, secretFile)
+				cfg.Openapi.URL = ""
+				return cfg
+			},
+			wantErr: true,
+			info:    "invalid config",
+		},
+		{
+			prepare: func() *Config {
+				cfg := newTestConfig(idp.URL, secretFile)
+				cfg.Ingress.Middleware.Proxy.Targets = nil
+				return cfg
+			},
+			wantErr: true,
+			info:    "invalid ingress config",
+		},
+		{
+			prepare: func() *Config {
+				assert.NoError(t, ioutil.WriteFile(secretFile, []byte("wrong"), 0600))
+				return newTestConfig(idp.URL, secretFile)
+			},
+			wantErr: true,
+			info:    "secret not accepted by idp",
+		},
+		{
+			prepare: func() *Config {
+				assert.NoError(t, ioutil.WriteFile(secretFile, []byte("n3w"), 0600))
+				setSecret("n3w")
+				return newTestConfig(idp.URL, secretFile)
+			},
+			changed: true,
+			info:    "changed secret replaces tokeninfo client",
+		},
+		{
+			prepare: func() *Config {
+				cfg := newTestConfig(idp.URL, secretFile)
+				cfg.Oauth2Idp.Cache.Freshness = time.Minute
+				return cfg
+			},
+			changed: true,
+			info:    "changed idp config replaces tokeninfo client",
+		},
+	}
+	for _, tst := range tests {
+		before := current()
+		err := gw.Reload(tst.prepare())
+		if tst.wantErr {
+			assert.Error(t, err, tst.info)
+		} else {
+			assert.NoError(t, err, tst.info)
+		}
+		assert.Equal(t, tst.changed, current() != before, tst.info)
+	}
+	assert.True(t, first != current())
+}
+
+// TestRunInvalidConfig shows that an invalid config is rejected at startup.
+func TestRunInvalidConfig(t *testing.T) {
+	cfg := newTestConfig("http://127.0.0.1:1", "not-used")
+	cfg.Oauth2Idp.Introspection.ClientID = ""
+	err := NewWithConfig(cfg).Run()
+	assert.Error(t, err)
+}
+
+// TestValidate shows that invalid configs are rejected.
+func TestValidate(t *testing.T) {
+	var tests = []struct {
+		modify  func(cfg *Config)
+		wantErr bool
+		info    string
+	}{
+		{modify: func(cfg *Config) {}, info: "valid"},
+		{modify: func(cfg *Config) { cfg.Openapi.URL = "" }, wantErr: true, info: "openapi url"},
+		{modify: func(cfg *Config) { cfg.Oauth2Idp.Introspection.URL = "" }, wantErr: true, info: "no idp"},
+		{modify: func(cfg *Config) { cfg.Oauth2Idp.Introspection.ClientID = "" }, wantErr: true, info: "introspection client id"},
+		{modify: func(cfg *Config) { cfg.Oauth2Idp.Cache.MaxEntries = -1 }, wantErr: true, info: "negative maxEntries"},
+		{modify: func(cfg *Config) { cfg.Oauth2Idp.Cache.GCInterval = -time.Second }, wantErr: true, info: "negative gcInterval"},
+		{modify: func(cfg *Config) { cfg.Oauth2Idp.JWT.RefreshInterval = -time.Second }, wantErr: true, info: "negative refreshInterval"},
+	}
+	for _, tst := range tests {
+		cfg := newTestConfig("http://127.0.0.1:1", "not-used")
+		tst.modify(cfg)
+		err := cfg.validate()
+		if tst.wantErr {
+			assert.Error(t, err, tst.info)
+		} else {
+			assert.NoError(t, err, tst.info)
+		}
+	}
+}
+
+// NewTestConfig returns a config with an introspection IDP at url.
+func newTestConfig(url, secretFile string) *Config {
+	cfg := &Config{}
+	cfg.Ingress.Bind = "127.0.0.1:0"
+	cfg.Ingress.ErrorResponse = "{{.Status}}"
+	cfg.Ingress.Middleware.Proxy.Targets = []ingress.TargetConfig{{URL: "http://127.0.0.1:1"}}
+	cfg.Openapi.URL = "http://127.0.0.1:1/swagger.json"
+	cfg.Oauth2Idp.Introspection.URL = url
+	cfg.Oauth2Idp.Introspection.ClientID = "apigw"
+	cfg.Oauth2Idp.Introspection.ClientSecretFile = secretFile
+	return cfg
+}
+
+// RunGateway runs gw until the returned function is called.
+func runGateway(t *testing.T, gw *Gateway) func() {
+	done := make(chan error)
+	go func() {
+		done <- gw.Run()
+	}()
+	for {
+		gw.mu.Lock()
+		running := gw.in != nil
+		gw.mu.Unlock()
+		if running {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatal(err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return func() {
+		gw.Shutdown(context.Background())
+		<-done
+	}
+}
+
+// WriteTempFile writes content to a temporary file and returns its name.
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "apigw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
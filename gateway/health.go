@@ -0,0 +1,214 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mmlt/apigw/ingress"
+	"github.com/mmlt/apigw/mw"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Health and readiness endpoints for the management port.
+
+	/healthz tells if the process is alive.
+	/readyz tells if the gateway is able to handle API traffic, it's not ready when:
+	- no OpenAPI definition has been read (yet)
+	- the OAuth2 IDP is unreachable (it's pinged in the background every idpCheckInterval)
+	- all upstream targets of the default pool (or all targets) are down
+*/
+
+type (
+	// Readiness is the response body of /readyz.
+	Readiness struct {
+		// Status is "ok" when all checks are ok, "fail" otherwise.
+		Status string `json:"status"`
+		// Checks by name.
+		Checks map[string]Check `json:"checks"`
+	}
+
+	// Check is the result of a readiness check.
+	Check struct {
+		// Status is "ok" or "fail".
+		Status string `json:"status"`
+		// Message tells why a check failed (or has a remark about a successful check).
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// Check status values.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// CheckTimeout is the max time a readiness check may take.
+// Keep it below the timeout of the Kubernetes probe (default 1s).
+var checkTimeout = 500 * time.Millisecond
+
+// Healthz is a http.HandlerFunc that reports the process is alive.
+func (gw *Gateway) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+// Readyz is a http.HandlerFunc that reports if the gateway is ready to handle API traffic.
+// The response status is 200 when ready and 503 otherwise.
+func (gw *Gateway) Readyz(w http.ResponseWriter, r *http.Request) {
+	rd := gw.Ready()
+	status := http.StatusOK
+	if rd.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rd)
+}
+
+// Ready runs the readiness checks.
+func (gw *Gateway) Ready() *Readiness {
+	gw.mu.Lock()
+	in := gw.in
+	gw.mu.Unlock()
+	gw.m.RLock()
+	idp := gw.idp
+	gw.m.RUnlock()
+
+	checks := map[string]func() Check{
+		"openapi": func() Check {
+			gw.m.RLock()
+			idx := gw.index
+			gw.m.RUnlock()
+			if idx == nil {
+				return Check{Status: StatusFail, Message: "no OpenAPI definition read (yet)"}
+			}
+			return Check{Status: StatusOK}
+		},
+		"idp": func() Check {
+			if idp == nil {
+				return Check{Status: StatusFail, Message: "gateway is not running"}
+			}
+			// the IDP is pinged in the background, see idpClient.
+			err := idp.status()
+			if err != nil {
+				return Check{Status: StatusFail, Message: err.Error()}
+			}
+			return Check{Status: StatusOK}
+		},
+		"targets": func() Check {
+			if in == nil {
+				return Check{Status: StatusFail, Message: "gateway is not running"}
+			}
+			return checkTargets(in.Targets())
+		},
+	}
+
+	// Run checks in parallel.
+	rd := &Readiness{Status: StatusOK, Checks: make(map[string]Check, len(checks))}
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn func() Check) {
+			defer wg.Done()
+			c := fn()
+			m.Lock()
+			rd.Checks[name] = c
+			if c.Status != StatusOK {
+				rd.Status = StatusFail
+			}
+			m.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+
+	return rd
+}
+
+// CheckTargets fails when all targets of the default pool or all targets are down, other pools with targets down
+// are reported in the message.
+// Targets with active health checks or that are ejected by outlier detection are down according to their health,
+// other targets are down when they don't accept a TCP connection. Targets are dialed in parallel so the check takes
+// no longer than checkTimeout.
+func checkTargets(targets []*mw.ProxyTarget) Check {
+	now := time.Now()
+	up := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		switch {
+		case t.Ejected(now):
+		case t.HealthCheck != nil:
+			up[i] = t.Healthy()
+		default:
+			wg.Add(1)
+			go func(i int, u *url.URL) {
+				defer wg.Done()
+				conn, err := net.DialTimeout("tcp", hostPort(u), checkTimeout)
+				if err != nil {
+					return
+				}
+				conn.Close()
+				up[i] = true
+			}(i, t.URL)
+		}
+	}
+	wg.Wait()
+
+	// Group by pool.
+	var pools []string
+	total := map[string]int{}
+	down := map[string][]string{}
+	for i, t := range targets {
+		if total[t.Pool] == 0 {
+			pools = append(pools, t.Pool)
+		}
+		total[t.Pool]++
+		if !up[i] {
+			down[t.Pool] = append(down[t.Pool], t.URL.String())
+		}
+	}
+
+	status := StatusOK
+	var msgs []string
+	alive := false
+	for _, p := range pools {
+		switch n := len(down[p]); {
+		case n == total[p]:
+			// a canary pool that is down doesn't prevent the default pool from handling traffic.
+			if p == ingress.DefaultPool {
+				status = StatusFail
+			}
+			msgs = append(msgs, fmt.Sprintf("pool %s: all targets down: %s", p, strings.Join(down[p], ", ")))
+		case n > 0:
+			msgs = append(msgs, fmt.Sprintf("pool %s: %d of %d targets down: %s", p, n, total[p], strings.Join(down[p], ", ")))
+			alive = true
+		default:
+			alive = true
+		}
+	}
+	if !alive && len(targets) > 0 {
+		status = StatusFail
+	}
+	return Check{Status: status, Message: strings.Join(msgs, "; ")}
+}
+
+// HostPort returns the host:port of an url, the port defaults to the scheme default.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// WriteJSON writes v as a json response with status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"github.com/mmlt/apigw/mw"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestCheckTargets shows that readiness fails when all targets of the default pool or all targets are down and that
+// the health of health checked and ejected targets is used.
+func TestCheckTargets(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	target := func(pool, u string) *mw.ProxyTarget {
+		pu, _ := url.Parse(u)
+		return &mw.ProxyTarget{Pool: pool, URL: pu}
+	}
+	// an unhealthy target that accepts connections.
+	unhealthy := target("accounts", failing.URL)
+	unhealthy.HealthCheck = &mw.HealthCheckConfig{UnhealthyThreshold: 1}
+	assert.False(t, unhealthy.CheckHealth())
+	// an ejected target that accepts connections.
+	ejected := target("accounts", up.URL)
+	mw.NewOutlierDetector(mw.OutlierConfig{ConsecutiveErrors: 1, MaxEjectionPercent: 100}).Failure(ejected)
+
+	var tests = []struct {
+		targets []*mw.ProxyTarget
+		want    string
+		info    string
+	}{
+		{targets: []*mw.ProxyTarget{target("default", up.URL)}, want: StatusOK, info: "up"},
+		{targets: []*mw.ProxyTarget{target("default", up.URL), target("default", closed.URL)}, want: StatusOK, info: "one down"},
+		{targets: []*mw.ProxyTarget{target("default", closed.URL)}, want: StatusFail, info: "all down"},
+		{targets: []*mw.ProxyTarget{target("default", up.URL), unhealthy}, want: StatusOK, info: "pool unhealthy"},
+		{targets: []*mw.ProxyTarget{target("default", up.URL), ejected}, want: StatusOK, info: "pool ejected"},
+		{targets: []*mw.ProxyTarget{target("default", up.URL), target("accounts", closed.URL)}, want: StatusOK, info: "pool down"},
+		{targets: []*mw.ProxyTarget{target("default", closed.URL), target("accounts", up.URL)}, want: StatusFail, info: "default pool down"},
+		{targets: []*mw.ProxyTarget{target("accounts", closed.URL), unhealthy}, want: StatusFail, info: "all targets down"},
+		{targets: []*mw.ProxyTarget{target("default", up.URL), ejected, target("accounts", up.URL)}, want: StatusOK, info: "pool partially ejected"},
+	}
+	for _, tst := range tests {
+		c := checkTargets(tst.targets)
+		assert.Equal(t, tst.want, c.Status, "%s: %s", tst.info, c.Message)
+	}
+
+	// a pool that is down is reported while the gateway stays ready.
+	c := checkTargets([]*mw.ProxyTarget{target("default", up.URL), target("accounts", closed.URL)})
+	assert.Equal(t, StatusOK, c.Status)
+	assert.Equal(t, "pool accounts: all targets down: "+closed.URL, c.Message)
+}
@@ -0,0 +1,197 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/mmlt/apigw/mw"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdpClient gets tokeninfo from the IDP and monitors its reachability.
+type idpClient struct {
+	// tokeninfo gets a TokeninfoResponse for an access token.
+	tokeninfo mw.TokeninfoFunc
+	// ping returns nil if the IDP is reachable within timeout.
+	ping func(timeout time.Duration) error
+	// stop releases the resources of tokeninfo and stops monitoring.
+	stop func()
+	// secret is the introspection client secret (introspection only).
+	secret string
+
+	// mutex guards err.
+	mutex sync.Mutex
+	// err is the result of the most recent ping.
+	err error
+}
+
+// IdpCheckInterval is the time between pings of the IDP.
+var idpCheckInterval = 10 * time.Second
+
+// NewTokeninfo returns a client for the IDP in cfg.
+// An error is returned when the IDP isn't reachable.
+// The IDP is pinged in the background until the client is stopped so readiness checks don't have to call the IDP.
+func newTokeninfo(ctx context.Context, cfg *Config) (*idpClient, error) {
+	idp := cfg.Oauth2Idp
+	c := &idpClient{}
+	ctx, cancel := context.WithCancel(ctx)
+
+	switch {
+	case idp.JWT.JWKSURL != "":
+		j := mw.NewJWTTokeninfo(mw.JWTConfig{
+			JWKSURL:         idp.JWT.JWKSURL,
+			Issuer:          idp.JWT.Issuer,
+			Audience:        idp.JWT.Audience,
+			RefreshInterval: idp.JWT.RefreshInterval,
+		})
+		err := j.Refresh()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		glog.Infof("read jwks from %s successful.", idp.JWT.JWKSURL)
+		go j.Run(ctx)
+		c.tokeninfo = j.Call
+		c.ping = func(timeout time.Duration) error {
+			return pingJWKS(idp.JWT.JWKSURL, timeout)
+		}
+		c.stop = cancel
+
+	case idp.Introspection.URL != "":
+		secret, err := clientSecret(cfg)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		err = pingIntrospection(idp.Introspection.URL, idp.Introspection.ClientID, secret, 0)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		glog.Infof("ping idp at %s successful.", idp.Introspection.URL)
+		tic := mw.NewTokeninfoClientWithConfig(mw.TokeninfoClientConfig{
+			URL:           idp.Introspection.URL,
+			Introspection: true,
+			ClientID:      idp.Introspection.ClientID,
+			ClientSecret:  secret,
+			Freshness:     idp.Cache.Freshness,
+			NegativeTTL:   idp.Cache.NegativeTTL,
+			MaxEntries:    idp.Cache.MaxEntries,
+			GCInterval:    idp.Cache.GCInterval,
+		})
+		tic.EnableGC(true)
+		c.tokeninfo = tic.Call
+		c.ping = func(timeout time.Duration) error {
+			return pingIntrospection(idp.Introspection.URL, idp.Introspection.ClientID, secret, timeout)
+		}
+		c.stop = func() { cancel(); tic.EnableGC(false) }
+		c.secret = secret
+
+	default:
+		err := pingURL(idp.TokeninfoURL)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		glog.Infof("ping idp at %s successful.", idp.TokeninfoURL)
+		tic := mw.NewTokeninfoClientWithConfig(mw.TokeninfoClientConfig{
+			URL:         idp.TokeninfoURL,
+			Freshness:   idp.Cache.Freshness,
+			NegativeTTL: idp.Cache.NegativeTTL,
+			MaxEntries:  idp.Cache.MaxEntries,
+			GCInterval:  idp.Cache.GCInterval,
+		})
+		tic.EnableGC(true)
+		c.tokeninfo = tic.Call
+		c.ping = func(timeout time.Duration) error {
+			return pingURLWithTimeout(idp.TokeninfoURL, timeout)
+		}
+		c.stop = func() { cancel(); tic.EnableGC(false) }
+	}
+
+	go c.monitor(ctx, idpCheckInterval)
+	return c, nil
+}
+
+// Monitor pings the IDP every interval until ctx is done.
+func (c *idpClient) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.ping(checkTimeout)
+		if err != nil {
+			glog.Warningf("ping idp: %v", err)
+		}
+		c.mutex.Lock()
+		c.err = err
+		c.mutex.Unlock()
+	}
+}
+
+// Status returns the result of the most recent ping of the IDP.
+func (c *idpClient) status() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// PingJWKS returns nil if the JWKS endpoint at url responds within timeout and an error otherwise.
+func pingJWKS(url string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s failed with %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// PingIntrospection returns nil if the introspection endpoint at url accepts the client credentials and an error
+// otherwise.
+// A dummy token is introspected, the IDP is expected to respond with 200 (and "active": false).
+func pingIntrospection(u, clientID, clientSecret string, timeout time.Duration) error {
+	form := url.Values{"token": {"ping"}}
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s failed with %d", u, resp.StatusCode)
+	}
+	return nil
+}
+
+// ClientSecret reads the introspection client secret from file.
+func clientSecret(cfg *Config) (string, error) {
+	b, err := ioutil.ReadFile(cfg.Oauth2Idp.Introspection.ClientSecretFile)
+	if err != nil {
+		return "", fmt.Errorf("config: oauth2idp introspection clientSecretFile: %v", err)
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("config: oauth2idp introspection clientSecretFile %s is empty", cfg.Oauth2Idp.Introspection.ClientSecretFile)
+	}
+	return secret, nil
+}
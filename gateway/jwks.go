@@ -0,0 +1,15 @@
+package gateway
+
+import "net/http"
+
+// JWKS is a http.HandlerFunc that publishes the public keys that verify the tokens signed by the gateway.
+func (gw *Gateway) JWKS(w http.ResponseWriter, r *http.Request) {
+	gw.mu.Lock()
+	in := gw.in
+	gw.mu.Unlock()
+	if in == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "gateway is not running"})
+		return
+	}
+	writeJSON(w, http.StatusOK, in.JWKS())
+}
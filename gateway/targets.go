@@ -0,0 +1,22 @@
+package gateway
+
+import (
+	"github.com/mmlt/apigw/mw"
+	"net/http"
+)
+
+// Targets is a http.HandlerFunc that shows the health of the upstream targets.
+func (gw *Gateway) Targets(w http.ResponseWriter, r *http.Request) {
+	gw.mu.Lock()
+	in := gw.in
+	gw.mu.Unlock()
+	if in == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "gateway is not running"})
+		return
+	}
+	var ss []mw.TargetStatus
+	for _, t := range in.Targets() {
+		ss = append(ss, t.Status())
+	}
+	writeJSON(w, http.StatusOK, ss)
+}
@@ -2,15 +2,28 @@
 package ingress
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/labstack/echo/v4"
 	"github.com/mmlt/apigw/mw"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"text/template"
+	"time"
 )
 
+// DefaultPool is the name of the pool of Proxy.Targets.
+const DefaultPool = "default"
+
+// StoreReloadInterval is the default interval at which the API key store, htpasswd and TLS files are checked for
+// changes.
+var storeReloadInterval = 10 * time.Second
+
 type (
 	// Config defines the configuration for an Ingress.
 	// TODO Config.Middleware.Path struct matches PathConfig struct except the former has yaml struct tags. Consider removing
@@ -19,12 +32,7 @@ type (
 		// Bind port.
 		Bind string `yaml:"bind"`
 		// TLS
-		TLS struct {
-			// Key is path of key.pem file.
-			Key string `yaml:"key"`
-			// Key is path of cert.pem file.
-			Cert string `yaml:"cert"`
-		} `yaml:"tls"`
+		TLS TLSConfig `yaml:"tls"`
 		// Middleware
 		Middleware struct {
 			Path struct {
@@ -36,29 +44,251 @@ type (
 				AllowOrigins []string `yaml:"allowOrigins"`
 				AllowMethods []string `yaml:"allowMethods"`
 			} `yaml:"cors"`
+			// APIKey checks the keys of apiKey security schemes (when StoreFile is set).
+			APIKey struct {
+				// StoreFile is the path of the key store file with hashed keys.
+				StoreFile string `yaml:"storeFile"`
+				// ReloadInterval is how often the key store file is checked for changes (default 10s).
+				ReloadInterval time.Duration `yaml:"reloadInterval"`
+			} `yaml:"apiKey"`
+			// BasicAuth checks the credentials of basic security schemes (when HtpasswdFile is set).
+			BasicAuth struct {
+				// HtpasswdFile is the path of a htpasswd file with bcrypt hashed passwords.
+				HtpasswdFile string `yaml:"htpasswdFile"`
+				// ReloadInterval is how often the htpasswd file is checked for changes (default 10s).
+				ReloadInterval time.Duration `yaml:"reloadInterval"`
+				// Realm of the WWW-Authenticate challenge (default apigw).
+				Realm string `yaml:"realm"`
+			} `yaml:"basicAuth"`
+			// Identity headers forwarded to upstream (a header with an empty name isn't set).
+			// Incoming copies of these headers are always removed.
+			Identity struct {
+				// ClientIDHeader gets the OAuth2 ClientID, for example X-Client-Id.
+				ClientIDHeader string `yaml:"clientIdHeader"`
+				// ScopesHeader gets the space-delimited granted scopes, for example X-Scopes.
+				ScopesHeader string `yaml:"scopesHeader"`
+				// Fields maps header names to tokeninfo response fields.
+				Fields map[string]string `yaml:"fields"`
+			} `yaml:"identity"`
+			// InternalToken adds a JWT signed by the gateway to upstream requests (when KeyFile is set).
+			InternalToken struct {
+				// KeyFile is the path of a PEM encoded RSA or EC private key.
+				KeyFile string `yaml:"keyFile"`
+				// Header gets the token (default X-Apigw-Token).
+				Header string `yaml:"header"`
+				// Replace the caller's token; the token is sent as 'Authorization: Bearer <token>'.
+				Replace bool `yaml:"replace"`
+				// TTL of a token (default 1m).
+				TTL time.Duration `yaml:"ttl"`
+				// Issuer is the 'iss' claim (default apigw).
+				Issuer string `yaml:"issuer"`
+				// Audience is the 'aud' claim (optional).
+				Audience string `yaml:"audience"`
+			} `yaml:"internalToken"`
 			// Reverse proxy
 			Proxy struct {
-				// Targets are the url(s) of upstream servers.
-				Targets []string `yaml:"targets"`
+				// Targets are the upstream servers.
+				Targets []TargetConfig `yaml:"targets"`
+				// Balancer is the load balancing technique; roundRobin (default), random, weightedRoundRobin,
+				// leastOutstanding, p2c or consistentHash.
+				Balancer string `yaml:"balancer"`
+				// HashKey is the request key of the consistentHash balancer; clientId (default), header:<name> or
+				// cookie:<name>.
+				HashKey string `yaml:"hashKey"`
+				// Pools are named groups of targets, each with its own balancer. Requests are sent to a pool by
+				// the x-apigw-upstream extension of an operation or by Routes, other requests go to Targets.
+				Pools map[string]PoolConfig `yaml:"pools"`
+				// Routes select the pool of a request, the first matching route wins.
+				Routes []RouteConfig `yaml:"routes"`
+				// Canaries send part of the traffic of a pool to a canary pool.
+				Canaries []CanaryConfig `yaml:"canaries"`
+				// SSEIdleTimeout closes a Server-Sent Events stream that receives no data from upstream (default 5m).
+				SSEIdleTimeout time.Duration `yaml:"sseIdleTimeout"`
+				// HealthCheck is the default health check of the targets (enabled when Path is set).
+				HealthCheck HealthCheckConfig `yaml:"healthCheck"`
+				// OutlierDetection ejects targets that fail live traffic (enabled when ConsecutiveErrors is set).
+				OutlierDetection struct {
+					// ConsecutiveErrors is the number of connection errors or 5xx responses in a row that eject a target.
+					ConsecutiveErrors int `yaml:"consecutiveErrors"`
+					// BaseEjectionTime is the duration of the first ejection, it doubles with each next ejection (default 30s).
+					BaseEjectionTime time.Duration `yaml:"baseEjectionTime"`
+					// MaxEjectionTime caps the ejection duration (default 5m).
+					MaxEjectionTime time.Duration `yaml:"maxEjectionTime"`
+					// MaxEjectionPercent is the max percentage of targets that are ejected at the same time (default 50).
+					MaxEjectionPercent int `yaml:"maxEjectionPercent"`
+				} `yaml:"outlierDetection"`
+				// Retry sends idempotent requests to another target after a connect error or one of StatusCodes
+				// (enabled when Attempts > 1).
+				Retry struct {
+					// Attempts is the max number of attempts of a request, including the first one.
+					Attempts int `yaml:"attempts"`
+					// StatusCodes are the upstream response status codes that are retried, for example 503.
+					StatusCodes []int `yaml:"statusCodes"`
+					// Header gets the attempt number in upstream requests (default X-Apigw-Attempt).
+					Header string `yaml:"header"`
+					// BudgetRatio is the max ratio of retries to requests over 10s (default 0.2).
+					BudgetRatio float64 `yaml:"budgetRatio"`
+					// MinRetriesPerSecond are allowed on top of the budget ratio (default 10).
+					MinRetriesPerSecond int `yaml:"minRetriesPerSecond"`
+				} `yaml:"retry"`
 			} `yaml:"proxy"`
 		} `yaml:"middleware"`
-		// Error response template (expanded with Status and Message parameters).
+		// Error response template (expanded with Status, Message and Error parameters).
+		// Error is the RFC 6750 error code (invalid_token, insufficient_scope) or empty.
 		ErrorResponse string `yaml:"errorResponse"`
 	}
 
+	// TargetConfig defines an upstream server.
+	// In yaml a target is an url or a map with url and tls.
+	TargetConfig struct {
+		// URL of the upstream server; http, https, ws or wss.
+		URL string `yaml:"url"`
+		// TLS settings for https and wss targets.
+		TLS UpstreamTLSConfig `yaml:"tls"`
+		// HealthCheck overrides the proxy health check settings that are set.
+		HealthCheck HealthCheckConfig `yaml:"healthCheck"`
+		// Weight is the relative share of requests for weighted balancers (default 1).
+		Weight int `yaml:"weight"`
+	}
+
+	// PoolConfig defines a named group of upstream servers.
+	PoolConfig struct {
+		// Targets are the upstream servers.
+		Targets []TargetConfig `yaml:"targets"`
+		// Balancer is the load balancing technique, see Proxy.Balancer.
+		Balancer string `yaml:"balancer"`
+		// HashKey is the request key of the consistentHash balancer, see Proxy.HashKey.
+		HashKey string `yaml:"hashKey"`
+	}
+
+	// RouteConfig sends requests that match all of its matchers to Pool.
+	RouteConfig struct {
+		// PathPrefix matches the request path (after path rewriting) and its sub paths.
+		PathPrefix string `yaml:"pathPrefix"`
+		// Tag matches operations with this OpenAPI tag.
+		Tag string `yaml:"tag"`
+		// OperationID matches the operation with this operationId.
+		OperationID string `yaml:"operationId"`
+		// Pool is the name of the pool.
+		Pool string `yaml:"pool"`
+	}
+
+	// CanaryConfig sends requests of Pool to Canary when they have Header, come from one of ClientIDs or when the
+	// client falls in the Weight percentage.
+	CanaryConfig struct {
+		// Pool is the pool that requests are taken from (default is the pool of Proxy.Targets).
+		Pool string `yaml:"pool"`
+		// Canary is the pool that requests are sent to.
+		Canary string `yaml:"canary"`
+		// Weight is the percentage (0-100) of clients that is sent to Canary.
+		// It can be changed at runtime with the /canaries management endpoint, a reload keeps that weight unless the
+		// pool, canary or weight of the config have changed.
+		Weight int `yaml:"weight"`
+		// Header sends requests with this header to Canary, for example X-Canary.
+		Header string `yaml:"header"`
+		// HeaderValue is the value Header must have, when empty any value matches.
+		HeaderValue string `yaml:"headerValue"`
+		// ClientIDs are always sent to Canary.
+		ClientIDs []string `yaml:"clientIds"`
+		// StickyKey keeps a client on the same pool; clientId (default), header:<name> or cookie:<name>.
+		StickyKey string `yaml:"stickyKey"`
+	}
+
+	// HealthCheckConfig defines the active health check of upstream targets.
+	HealthCheckConfig struct {
+		// Path that is probed with a GET request, relative to the target url.
+		Path string `yaml:"path"`
+		// Interval between probes (default 10s).
+		Interval time.Duration `yaml:"interval"`
+		// Timeout of a probe (default 2s).
+		Timeout time.Duration `yaml:"timeout"`
+		// HealthyThreshold is the number of consecutive successes that restore a target (default 2).
+		HealthyThreshold int `yaml:"healthyThreshold"`
+		// UnhealthyThreshold is the number of consecutive failures that take a target out of rotation (default 3).
+		UnhealthyThreshold int `yaml:"unhealthyThreshold"`
+	}
+
 	// Ingress holds the state for a reverse proxy with oauth2 authorization.
 	Ingress struct {
 		Port string
-		Echo *echo.Echo
-		// CertFile contains the path of the TLS cert file.
-		certFile string
-		// KeyFile contains the path of the TLS key file.
-		keyFile string
+		// Server serves the API traffic.
+		server *http.Server
+		// Current holds the *chain that handles requests.
+		// It's replaced as a whole when the config is reloaded.
+		current atomic.Value
+		// OperationFn, tokeninfoFn and allowMethodsFn are used to (re)build the middleware chain.
+		operationFn    mw.OperationFunc
+		tokeninfoFn    mw.TokeninfoFunc
+		allowMethodsFn mw.AllowMethodsFunc
+		// TLS contains the TLS config the server is started with.
+		tls TLSConfig
+		// Certs are the server certificates (nil without TLS).
+		certs *certStore
+		// Ctx ends the background tasks of the ingress.
+		ctx    context.Context
+		cancel context.CancelFunc
+	}
+
+	// Chain is a middleware chain and the upstream targets it proxies to.
+	chain struct {
+		echo    *echo.Echo
+		targets []*mw.ProxyTarget
+		// canaries split traffic between target pools.
+		canaries []*mw.Canary
+		// keys that verify internal tokens, the first one is used for signing.
+		keys []*mw.SigningKey
+		// stop ends the background tasks of the chain (like key store reloading).
+		stop context.CancelFunc
 	}
 )
 
 // NewWithConfig creates an Ingress instance.
-func NewWithConfig(cfg *Config, scopesFn mw.ScopesFunc, tokeninfoFn mw.TokeninfoFunc, allowMethodsFn mw.AllowMethodsFunc) *Ingress {
+func NewWithConfig(cfg *Config, operationFn mw.OperationFunc, tokeninfoFn mw.TokeninfoFunc, allowMethodsFn mw.AllowMethodsFunc) *Ingress {
+	in := &Ingress{
+		Port:           cfg.Bind,
+		operationFn:    operationFn,
+		tokeninfoFn:    tokeninfoFn,
+		allowMethodsFn: allowMethodsFn,
+		tls:            cfg.TLS,
+	}
+
+	ch, err := in.newChain(cfg)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	in.current.Store(ch)
+	tlsConfig, certs, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	in.certs = certs
+	in.server = &http.Server{Addr: cfg.Bind, Handler: in, TLSConfig: tlsConfig}
+	in.ctx, in.cancel = context.WithCancel(context.Background())
+
+	return in
+}
+
+// Reload replaces the middleware chain with one that is built from cfg.
+// When cfg is invalid an error is returned and the current chain stays in place.
+// Changes to Bind and TLS are not applied until restart.
+func (in *Ingress) Reload(cfg *Config) error {
+	if cfg.Bind != in.Port || !reflect.DeepEqual(cfg.TLS, in.tls) {
+		glog.Warning("config: ingress bind and tls changes require a restart.")
+	}
+
+	ch, err := in.newChain(cfg)
+	if err != nil {
+		return err
+	}
+	old := in.current.Load().(*chain)
+	in.current.Store(ch)
+	old.stop()
+
+	return nil
+}
+
+// NewChain returns the middleware chain defined by cfg.
+func (in *Ingress) newChain(cfg *Config) (*chain, error) {
 	e := echo.New()
 	e.HideBanner = true
 
@@ -70,7 +300,7 @@ func NewWithConfig(cfg *Config, scopesFn mw.ScopesFunc, tokeninfoFn mw.Tokeninfo
 	var err error
 	e.HTTPErrorHandler, err = customHTTPErrorHandler(cfg.ErrorResponse)
 	if err != nil {
-		glog.Fatal(err)
+		return nil, fmt.Errorf("config: errorResponse: %v", err)
 	}
 
 	e.Use(mw.Logger())
@@ -83,42 +313,402 @@ func NewWithConfig(cfg *Config, scopesFn mw.ScopesFunc, tokeninfoFn mw.Tokeninfo
 
 	// CORS headers
 	e.Use(mw.CORSWithConfig(mw.CORSConfig{
-		AllowOrigins: cfg.Middleware.Cors.AllowOrigins,
-		AllowMethodsFn: allowMethodsFn,
+		AllowOrigins:   cfg.Middleware.Cors.AllowOrigins,
+		AllowMethodsFn: in.allowMethodsFn,
+	}))
+
+	// Map client certificates to ClientID and enforce them for operations that require one.
+	switch cfg.TLS.ClientID {
+	case "", "cn", "subject", "dns", "uri", "email":
+	default:
+		return nil, fmt.Errorf("config: tls: clientId %q must be one of cn, subject, dns, uri or email", cfg.TLS.ClientID)
+	}
+	e.Use(mw.ClientCertWithConfig(mw.ClientCertConfig{
+		Operation: in.operationFn,
+		ClientID:  cfg.TLS.ClientID,
 	}))
 
+	// Check API keys
+	var store *mw.APIKeyStore
+	if ak := cfg.Middleware.APIKey; ak.StoreFile != "" {
+		store, err = mw.NewAPIKeyStore(ak.StoreFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: apiKey: %v", err)
+		}
+		e.Use(mw.APIKeyWithConfig(mw.APIKeyConfig{
+			Operation: in.operationFn,
+			Store:     store,
+		}))
+	}
+
+	// Check basic credentials
+	var htpasswd *mw.HtpasswdStore
+	if ba := cfg.Middleware.BasicAuth; ba.HtpasswdFile != "" {
+		htpasswd, err = mw.NewHtpasswdStore(ba.HtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: basicAuth: %v", err)
+		}
+		e.Use(mw.BasicAuthWithConfig(mw.BasicAuthConfig{
+			Operation: in.operationFn,
+			Store:     htpasswd,
+			Realm:     ba.Realm,
+		}))
+	}
+
 	// Setup OAuth2 authorization
 	e.Use(mw.OAuth2WithConfig(mw.OAuth2Config{
-		RequiredScopes: scopesFn,
-		Tokeninfo:      tokeninfoFn,
+		Operation: in.operationFn,
+		Tokeninfo: in.tokeninfoFn,
 	}))
 
-	// Setup reverse proxy with load balancer.
+	// Forward verified identity
+	e.Use(mw.IdentityWithConfig(mw.IdentityConfig{
+		ClientIDHeader: cfg.Middleware.Identity.ClientIDHeader,
+		ScopesHeader:   cfg.Middleware.Identity.ScopesHeader,
+		Fields:         cfg.Middleware.Identity.Fields,
+	}))
+
+	// Add gateway signed token
+	var keys []*mw.SigningKey
+	if it := cfg.Middleware.InternalToken; it.KeyFile != "" {
+		key, err := mw.LoadSigningKey(it.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: internalToken: %v", err)
+		}
+		keys = append(keys, key)
+		// Keep publishing the previous key so tokens that are in-flight during a key change can be verified.
+		if cur, ok := in.current.Load().(*chain); ok && len(cur.keys) > 0 && cur.keys[0].Kid != key.Kid {
+			keys = append(keys, cur.keys[0])
+		}
+		e.Use(mw.InternalTokenWithConfig(mw.InternalTokenConfig{
+			Key:      key,
+			Header:   it.Header,
+			Replace:  it.Replace,
+			TTL:      it.TTL,
+			Issuer:   it.Issuer,
+			Audience: it.Audience,
+		}))
+	}
+
+	// Setup reverse proxy with a load balancer per target pool.
+	if len(cfg.Middleware.Proxy.Targets) == 0 {
+		return nil, fmt.Errorf("config: proxy requires at least one target")
+	}
+	proxy := cfg.Middleware.Proxy
+	targets, err := in.newTargets(DefaultPool, proxy.Targets, proxy.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	balancer, err := newBalancer(proxy.Balancer, proxy.HashKey, targets)
+	if err != nil {
+		return nil, fmt.Errorf("config: proxy: %v", err)
+	}
+	pools := map[string]mw.ProxyBalancer{DefaultPool: balancer}
+	groups := [][]*mw.ProxyTarget{targets}
+	// sorted for a predictable order of targets.
+	var names []string
+	for name := range proxy.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pc := proxy.Pools[name]
+		if name == DefaultPool {
+			return nil, fmt.Errorf("config: proxy: pool name %q is reserved for the proxy targets", name)
+		}
+		if len(pc.Targets) == 0 {
+			return nil, fmt.Errorf("config: proxy: pool %q requires at least one target", name)
+		}
+		ts, err := in.newTargets(name, pc.Targets, proxy.HealthCheck)
+		if err != nil {
+			return nil, err
+		}
+		pools[name], err = newBalancer(pc.Balancer, pc.HashKey, ts)
+		if err != nil {
+			return nil, fmt.Errorf("config: proxy: pool %q: %v", name, err)
+		}
+		groups = append(groups, ts)
+		targets = append(targets, ts...)
+	}
+	var routes []mw.PoolRoute
+	for i, r := range proxy.Routes {
+		if pools[r.Pool] == nil {
+			return nil, fmt.Errorf("config: proxy: route %d: pool %q doesn't exist", i, r.Pool)
+		}
+		if r.PathPrefix == "" && r.Tag == "" && r.OperationID == "" {
+			return nil, fmt.Errorf("config: proxy: route %d: requires pathPrefix, tag or operationId", i)
+		}
+		routes = append(routes, mw.PoolRoute{PathPrefix: r.PathPrefix, Tag: r.Tag, OperationID: r.OperationID, Pool: r.Pool})
+	}
+	var canaries []*mw.Canary
+	seen := map[string]bool{}
+	for i, cc := range proxy.Canaries {
+		if cc.Pool == "" {
+			cc.Pool = DefaultPool
+		}
+		if pools[cc.Pool] == nil || pools[cc.Canary] == nil {
+			return nil, fmt.Errorf("config: proxy: canary %d: pools %q and %q must exist", i, cc.Pool, cc.Canary)
+		}
+		if seen[cc.Pool] {
+			return nil, fmt.Errorf("config: proxy: canary %d: pool %q has more than one canary", i, cc.Pool)
+		}
+		seen[cc.Pool] = true
+		key, err := newHashKey(cc.StickyKey)
+		if err != nil {
+			return nil, fmt.Errorf("config: proxy: canary %d: stickyKey %v", i, err)
+		}
+		canary, err := mw.NewCanary(mw.CanaryConfig{
+			Pool:        cc.Pool,
+			Canary:      cc.Canary,
+			Weight:      cc.Weight,
+			Header:      cc.Header,
+			HeaderValue: cc.HeaderValue,
+			ClientIDs:   cc.ClientIDs,
+			StickyKey:   key,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("config: proxy: canary %d: %v", i, err)
+		}
+		// Keep a weight that is set at runtime unless the canary config has changed.
+		if cur, ok := in.current.Load().(*chain); ok {
+			for _, cn := range cur.canaries {
+				if cn.Status().Pool != cc.Pool || cn.Weight() == cn.Status().ConfiguredWeight {
+					continue
+				}
+				if canary.CopyWeight(cn) {
+					glog.Infof("config: proxy: canary of pool %s: keeping weight %d that is set at runtime", cc.Pool, canary.Weight())
+				} else {
+					glog.Warningf("config: proxy: canary of pool %s: weight %d that is set at runtime is replaced by the config weight %d", cc.Pool, cn.Weight(), canary.Weight())
+				}
+			}
+		}
+		canaries = append(canaries, canary)
+	}
+
+	proxyConfig := mw.DefaultProxyConfig
+	if d := proxy.SSEIdleTimeout; d > 0 {
+		proxyConfig.SSEIdleTimeout = d
+	}
+	proxyConfig.Balancer = balancer
+	if len(pools) > 1 {
+		proxyConfig.Balancer = mw.NewPoolBalancer(mw.PoolBalancerConfig{
+			Pools:     pools,
+			Default:   DefaultPool,
+			Routes:    routes,
+			Operation: in.operationFn,
+			Canaries:  canaries,
+		})
+	}
+	if od := proxy.OutlierDetection; od.ConsecutiveErrors > 0 {
+		proxyConfig.OutlierDetector = mw.NewOutlierDetector(mw.OutlierConfig{
+			ConsecutiveErrors:  od.ConsecutiveErrors,
+			BaseEjectionTime:   od.BaseEjectionTime,
+			MaxEjectionTime:    od.MaxEjectionTime,
+			MaxEjectionPercent: od.MaxEjectionPercent,
+		}, groups...)
+	}
+	if rt := proxy.Retry; rt.Attempts > 1 {
+		for _, code := range rt.StatusCodes {
+			if code < 500 || code > 599 {
+				return nil, fmt.Errorf("config: proxy: retry: status code %d must be a 5xx code", code)
+			}
+		}
+		proxyConfig.Retry = mw.NewRetryPolicy(mw.RetryConfig{
+			Attempts:            rt.Attempts,
+			StatusCodes:         rt.StatusCodes,
+			Header:              rt.Header,
+			BudgetRatio:         rt.BudgetRatio,
+			MinRetriesPerSecond: rt.MinRetriesPerSecond,
+		})
+	}
+	e.Use(mw.ProxyWithConfig(proxyConfig))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, t := range targets {
+		go t.RunHealthCheck(ctx)
+	}
+	if store != nil {
+		go store.Run(ctx, reloadInterval(cfg.Middleware.APIKey.ReloadInterval))
+	}
+	if htpasswd != nil {
+		go htpasswd.Run(ctx, reloadInterval(cfg.Middleware.BasicAuth.ReloadInterval))
+	}
+
+	return &chain{echo: e, targets: targets, canaries: canaries, keys: keys, stop: cancel}, nil
+}
+
+// UnmarshalYAML reads a target from an url string or a map.
+func (t *TargetConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*t = TargetConfig{URL: s}
+		return nil
+	}
+	type plain TargetConfig
+	return unmarshal((*plain)(t))
+}
+
+// NewTargets returns the targets of a pool.
+func (in *Ingress) newTargets(pool string, tcs []TargetConfig, healthCheck HealthCheckConfig) ([]*mw.ProxyTarget, error) {
 	targets := []*mw.ProxyTarget{}
-	for _, t := range cfg.Middleware.Proxy.Targets {
-		u, err := url.Parse(t)
+	for _, t := range tcs {
+		u, err := url.Parse(t.URL)
 		if err != nil {
-			glog.Fatal(err)
+			return nil, fmt.Errorf("config: proxy target: %v", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("config: proxy target %q must be an absolute url", t.URL)
+		}
+		if t.Weight < 0 {
+			return nil, fmt.Errorf("config: proxy target %q: weight must not be negative", t.URL)
 		}
-		targets = append(targets, &mw.ProxyTarget{URL: u})
+		target := &mw.ProxyTarget{URL: u, Pool: pool, Weight: t.Weight}
+		if t.TLS != (UpstreamTLSConfig{}) {
+			if u.Scheme != "https" && u.Scheme != "wss" {
+				return nil, fmt.Errorf("config: proxy target %q: tls requires a https or wss url", t.URL)
+			}
+			target.TLS, err = newUpstreamTLSConfig(t.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("config: proxy target %q: %v", t.URL, err)
+			}
+			if t.TLS.InsecureSkipVerify {
+				glog.Warningf("config: proxy target %q: certificate verification is disabled.", t.URL)
+			}
+			target.Transport = mw.NewProxyTransport(target.TLS)
+		}
+		if hc := t.HealthCheck.merge(healthCheck); hc.Path != "" {
+			target.HealthCheck = &mw.HealthCheckConfig{
+				Path:               hc.Path,
+				Interval:           hc.Interval,
+				Timeout:            hc.Timeout,
+				HealthyThreshold:   hc.HealthyThreshold,
+				UnhealthyThreshold: hc.UnhealthyThreshold,
+			}
+		}
+		// Keep the health of a target that is in the current chain.
+		if cur, ok := in.current.Load().(*chain); ok {
+			for _, ct := range cur.targets {
+				if ct.Pool == pool && ct.URL.String() == target.URL.String() {
+					target.CopyHealth(ct)
+				}
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// NewBalancer returns the load balancer with name for targets.
+func newBalancer(name, hashKey string, targets []*mw.ProxyTarget) (mw.ProxyBalancer, error) {
+	if hashKey != "" && name != "consistentHash" {
+		return nil, fmt.Errorf("hashKey requires the consistentHash balancer")
+	}
+	switch name {
+	case "", "roundRobin":
+		return mw.NewRoundRobinBalancer(targets), nil
+	case "random":
+		return mw.NewRandomBalancer(targets), nil
+	case "weightedRoundRobin":
+		return mw.NewWeightedRoundRobinBalancer(targets), nil
+	case "leastOutstanding":
+		return mw.NewLeastOutstandingBalancer(targets), nil
+	case "p2c":
+		return mw.NewP2CBalancer(targets), nil
+	case "consistentHash":
+		key, err := newHashKey(hashKey)
+		if err != nil {
+			return nil, fmt.Errorf("hashKey %v", err)
+		}
+		return mw.NewConsistentHashBalancer(targets, key), nil
+	default:
+		return nil, fmt.Errorf("balancer %q must be one of roundRobin, random, weightedRoundRobin, leastOutstanding, p2c or consistentHash", name)
 	}
-	lb := mw.NewRoundRobinBalancer(targets)
-	e.Use(mw.Proxy(lb))
+}
 
-	return &Ingress{Port: cfg.Bind, Echo: e, certFile: cfg.TLS.Cert, keyFile: cfg.TLS.Key}
+// NewHashKey returns the HashKeyFunc for a clientId (default), header:<name> or cookie:<name> key.
+func newHashKey(key string) (mw.HashKeyFunc, error) {
+	switch {
+	case key == "" || key == "clientId":
+		return mw.HashByClientID(), nil
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		return mw.HashByHeader(strings.TrimPrefix(key, "header:")), nil
+	case strings.HasPrefix(key, "cookie:") && len(key) > len("cookie:"):
+		return mw.HashByCookie(strings.TrimPrefix(key, "cookie:")), nil
+	default:
+		return nil, fmt.Errorf("%q must be clientId, header:<name> or cookie:<name>", key)
+	}
+}
+
+// Merge returns c with the fields that aren't set taken from defaults.
+func (c HealthCheckConfig) merge(defaults HealthCheckConfig) HealthCheckConfig {
+	if c.Path == "" {
+		c.Path = defaults.Path
+	}
+	if c.Interval == 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.HealthyThreshold == 0 {
+		c.HealthyThreshold = defaults.HealthyThreshold
+	}
+	if c.UnhealthyThreshold == 0 {
+		c.UnhealthyThreshold = defaults.UnhealthyThreshold
+	}
+	return c
+}
+
+// ReloadInterval returns d or, when d isn't set, the default store reload interval.
+func reloadInterval(d time.Duration) time.Duration {
+	if d <= 0 {
+		return storeReloadInterval
+	}
+	return d
+}
+
+// ServeHTTP passes a request to the current middleware chain.
+func (in *Ingress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	in.current.Load().(*chain).echo.ServeHTTP(w, r)
+}
+
+// Targets returns the upstream targets of the current middleware chain.
+func (in *Ingress) Targets() []*mw.ProxyTarget {
+	return in.current.Load().(*chain).targets
+}
+
+// Canaries returns the canaries of the current middleware chain.
+func (in *Ingress) Canaries() []*mw.Canary {
+	return in.current.Load().(*chain).canaries
+}
+
+// JWKS returns the public keys that verify internal tokens.
+func (in *Ingress) JWKS() *mw.JWKSet {
+	return mw.NewJWKSet(in.current.Load().(*chain).keys...)
 }
 
 // Run the ingress.
 func (in *Ingress) Run() error {
-	if in.certFile == "" {
-		return in.Echo.Start(in.Port)
+	if in.certs == nil {
+		return in.server.ListenAndServe()
 	} else {
-		return in.Echo.StartTLS(in.Port, in.certFile, in.keyFile)
+		// pick up renewed certificates.
+		go in.certs.run(in.ctx, reloadInterval(in.tls.ReloadInterval))
+		// certificates are provided by TLSConfig.GetCertificate
+		return in.server.ListenAndServeTLS("", "")
 	}
 }
 
+// Shutdown stops the ingress gracefully.
+func (in *Ingress) Shutdown(ctx context.Context) error {
+	err := in.server.Shutdown(ctx)
+	in.cancel()
+	in.current.Load().(*chain).stop()
+	return err
+}
+
 // CustomHTTPErrorHandler returns a func of type echo.HTTPErrorHandler that writes error messages to the HTTP response stream.
-// Messages are generated with a golang template and Status and Message parameters.
+// Messages are generated with a golang template and Status, Message and Error parameters.
 func customHTTPErrorHandler(tmpl string) (echo.HTTPErrorHandler, error) {
 	t, err := template.New("error").Parse(tmpl)
 	if err != nil {
@@ -129,9 +719,11 @@ func customHTTPErrorHandler(tmpl string) (echo.HTTPErrorHandler, error) {
 		e := struct {
 			Status  int
 			Message string
+			Error   string `json:",omitempty"`
 		}{
 			Status:  http.StatusInternalServerError,
 			Message: in.Error(),
+			Error:   mw.ErrorCode(in),
 		}
 		if he, ok := in.(*echo.HTTPError); ok {
 			e.Status = he.Code
@@ -1,12 +1,25 @@
 package ingress
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/mw"
+	"github.com/mmlt/apigw/path"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestCustomHTTPErrorHandler(t *testing.T) {
@@ -20,6 +33,8 @@ func TestCustomHTTPErrorHandler(t *testing.T) {
 		{echo.NewHTTPError(401, "Not allowed"), "{{.Status}} {{.Message}}", 401, "401 Not allowed"},
 		{echo.NewHTTPError(404, "Not found"), "", 404, ""},
 		{echo.NewHTTPError(404, "Not found"), "{{.ThisNameIsNotDefined}}", 404, "{\"Status\":404,\"Message\":\"Not found\"}\n"},
+		{mw.ErrInsufficientScope, "{{.Status}} {{.Error}}", 403, "403 insufficient_scope"},
+		{mw.ErrTokenInvalid, "{{.ThisNameIsNotDefined}}", 401, "{\"Status\":401,\"Message\":\"Not allowed\",\"Error\":\"invalid_token\"}\n"},
 	}
 
 	e := echo.New()
@@ -39,3 +54,377 @@ func TestCustomHTTPErrorHandler(t *testing.T) {
 		}
 	}
 }
+
+// TestReload shows that a valid config replaces the middleware chain and an invalid config is rejected.
+func TestReload(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+	}
+	first := upstream("first")
+	defer first.Close()
+	second := upstream("second")
+	defer second.Close()
+
+	newConfig := func(targets ...string) *Config {
+		cfg := &Config{ErrorResponse: "{{.Status}}"}
+		for _, t := range targets {
+			cfg.Middleware.Proxy.Targets = append(cfg.Middleware.Proxy.Targets, TargetConfig{URL: t})
+		}
+		return cfg
+	}
+	operationFn := func(method string, url *url.URL) (*path.Operation, error) {
+		return &path.Operation{}, nil
+	}
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	get := func(in *Ingress) string {
+		w := httptest.NewRecorder()
+		in.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo", nil))
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	in := NewWithConfig(newConfig(first.URL), operationFn, tokeninfoFn, nil)
+	assert.Equal(t, "first", get(in))
+
+	var tests = []struct {
+		cfg     *Config
+		wantErr bool
+		want    string
+	}{
+		{newConfig(), true, "first"},
+		{newConfig("not-an-url"), true, "first"},
+		{&Config{ErrorResponse: "{{.Status"}, true, "first"},
+		{newConfig(second.URL), false, "second"},
+	}
+	for i, tst := range tests {
+		err := in.Reload(tst.cfg)
+		assert.Equal(t, tst.wantErr, err != nil, "%d) error %v", i, err)
+		assert.Equal(t, tst.want, get(in), "%d) response", i)
+	}
+}
+
+// TestJWKS shows that the key that signs internal tokens is published and that the previous key remains published
+// after a key change.
+func TestJWKS(t *testing.T) {
+	keyFile := func() string {
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		f, err := ioutil.TempFile("", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		f.Close()
+		return f.Name()
+	}
+	key1 := keyFile()
+	defer os.Remove(key1)
+	key2 := keyFile()
+	defer os.Remove(key2)
+
+	newConfig := func(keyFile string) *Config {
+		cfg := &Config{ErrorResponse: "{{.Status}}"}
+		cfg.Middleware.Proxy.Targets = []TargetConfig{{URL: "http://localhost"}}
+		cfg.Middleware.InternalToken.KeyFile = keyFile
+		return cfg
+	}
+	kids := func(in *Ingress) []string {
+		var ss []string
+		for _, k := range in.JWKS().Keys {
+			ss = append(ss, k["kid"])
+		}
+		return ss
+	}
+
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	in := NewWithConfig(newConfig(""), nil, tokeninfoFn, nil)
+	assert.Empty(t, kids(in), "no key")
+
+	assert.NoError(t, in.Reload(newConfig(key1)))
+	k1 := kids(in)
+	assert.Len(t, k1, 1, "key1")
+
+	assert.NoError(t, in.Reload(newConfig(key1)))
+	assert.Equal(t, k1, kids(in), "same key")
+
+	assert.NoError(t, in.Reload(newConfig(key2)))
+	k2 := kids(in)
+	if assert.Len(t, k2, 2, "key2 and key1") {
+		assert.Equal(t, k1[0], k2[1])
+	}
+
+	assert.Error(t, in.Reload(newConfig("/does/not/exist")))
+}
+
+// TestAPIKeyStoreChange shows that API keys are checked and that a change of the key store file is picked up.
+func TestAPIKeyStoreChange(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Client-Id"))
+	}))
+	defer upstream.Close()
+
+	store := func(key, clientID string) []byte {
+		h := sha256.Sum256([]byte(key))
+		return []byte(fmt.Sprintf("keys:\n- hash: %x\n  clientId: %s\n  operations: [\"*\"]\n", h, clientID))
+	}
+	f, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	assert.NoError(t, ioutil.WriteFile(f.Name(), store("key1", "app1"), 0600))
+
+	cfg := &Config{ErrorResponse: "{{.Status}}"}
+	cfg.Middleware.Proxy.Targets = []TargetConfig{{URL: upstream.URL}}
+	cfg.Middleware.Identity.ClientIDHeader = "X-Client-Id"
+	cfg.Middleware.APIKey.StoreFile = f.Name()
+	cfg.Middleware.APIKey.ReloadInterval = 10 * time.Millisecond
+	operationFn := func(method string, url *url.URL) (*path.Operation, error) {
+		key := path.Scheme{Name: "api_key", Type: path.SchemeTypeAPIKey, In: "header", Param: "X-Api-Key"}
+		return &path.Operation{Security: path.Requirements{{Schemes: []path.Scheme{key}}}}, nil
+	}
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	in := NewWithConfig(cfg, operationFn, tokeninfoFn, nil)
+	defer in.Shutdown(context.Background())
+
+	get := func(key string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/foo", nil)
+		r.Header.Set("X-Api-Key", key)
+		in.ServeHTTP(w, r)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	assert.Equal(t, "app1", get("key1"))
+	assert.Equal(t, "401", get("key2"))
+
+	assert.NoError(t, ioutil.WriteFile(f.Name(), store("key2", "app2"), 0600))
+	var got string
+	for i := 0; i < 100 && got != "app2"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		got = get("key2")
+	}
+	assert.Equal(t, "app2", got)
+	assert.Equal(t, "401", get("key1"))
+}
+
+// TestHealthCheck shows that an unhealthy target is taken out of rotation and that its health survives a reload.
+func TestHealthCheck(t *testing.T) {
+	upstream := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				w.WriteHeader(status)
+				return
+			}
+			fmt.Fprint(w, name)
+		}))
+	}
+	good := upstream("good", http.StatusOK)
+	defer good.Close()
+	bad := upstream("bad", http.StatusInternalServerError)
+	defer bad.Close()
+
+	cfg := &Config{ErrorResponse: "{{.Status}}"}
+	cfg.Middleware.Proxy.HealthCheck = HealthCheckConfig{Path: "/health", Interval: time.Hour, UnhealthyThreshold: 1}
+	cfg.Middleware.Proxy.Targets = []TargetConfig{
+		{URL: good.URL},
+		{URL: bad.URL, HealthCheck: HealthCheckConfig{Interval: 10 * time.Millisecond}},
+	}
+	operationFn := func(method string, url *url.URL) (*path.Operation, error) {
+		return &path.Operation{}, nil
+	}
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	in := NewWithConfig(cfg, operationFn, tokeninfoFn, nil)
+	defer in.Shutdown(context.Background())
+
+	for i := 0; i < 100 && in.Targets()[1].Healthy(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "/health", in.Targets()[1].HealthCheck.Path, "target inherits path")
+	assert.Equal(t, 10*time.Millisecond, in.Targets()[1].HealthCheck.Interval, "target overrides interval")
+	assert.False(t, in.Targets()[1].Healthy(), "bad target")
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		in.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo", nil))
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		return string(body)
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "good", get(), "%d) response", i)
+	}
+
+	assert.NoError(t, in.Reload(cfg))
+	assert.True(t, in.Targets()[0].Healthy(), "good target after reload")
+	assert.False(t, in.Targets()[1].Healthy(), "bad target after reload")
+}
+
+func TestNewBalancer(t *testing.T) {
+	var tests = []struct {
+		name    string
+		hashKey string
+		wantErr bool
+	}{
+		{name: ""},
+		{name: "roundRobin"},
+		{name: "random"},
+		{name: "weightedRoundRobin"},
+		{name: "leastOutstanding"},
+		{name: "p2c"},
+		{name: "consistentHash"},
+		{name: "consistentHash", hashKey: "clientId"},
+		{name: "consistentHash", hashKey: "header:X-User"},
+		{name: "consistentHash", hashKey: "cookie:session"},
+		{name: "consistentHash", hashKey: "header:", wantErr: true},
+		{name: "consistentHash", hashKey: "query:user", wantErr: true},
+		{name: "roundRobin", hashKey: "clientId", wantErr: true},
+		{name: "leastConnections", wantErr: true},
+	}
+	for _, tst := range tests {
+		b, err := newBalancer(tst.name, tst.hashKey, nil)
+		assert.Equal(t, tst.wantErr, err != nil, "%s %s: %v", tst.name, tst.hashKey, err)
+		assert.Equal(t, tst.wantErr, b == nil, "%s %s", tst.name, tst.hashKey)
+	}
+}
+
+// TestPools shows that requests are routed to target pools and that invalid pools and routes are rejected.
+func TestPools(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+	}
+	monolith := upstream("monolith")
+	defer monolith.Close()
+	accounts := upstream("accounts")
+	defer accounts.Close()
+
+	newConfig := func(pool string, routes ...RouteConfig) *Config {
+		cfg := &Config{ErrorResponse: "{{.Status}}"}
+		cfg.Middleware.Proxy.Targets = []TargetConfig{{URL: monolith.URL}}
+		cfg.Middleware.Proxy.Pools = map[string]PoolConfig{pool: {Targets: []TargetConfig{{URL: accounts.URL}}}}
+		cfg.Middleware.Proxy.Routes = routes
+		return cfg
+	}
+	operationFn := func(method string, url *url.URL) (*path.Operation, error) {
+		switch url.Path {
+		case "/statements":
+			return &path.Operation{Tags: []string{"accounts"}}, nil
+		case "/legacy":
+			return &path.Operation{Upstream: "accounts"}, nil
+		}
+		return &path.Operation{}, nil
+	}
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	get := func(in *Ingress, p string) string {
+		w := httptest.NewRecorder()
+		in.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+p, nil))
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	in := NewWithConfig(newConfig("accounts", RouteConfig{PathPrefix: "/accounts", Pool: "accounts"}, RouteConfig{Tag: "accounts", Pool: "accounts"}), operationFn, tokeninfoFn, nil)
+	defer in.Shutdown(context.Background())
+	for p, want := range map[string]string{"/accounts/1": "accounts", "/statements": "accounts", "/legacy": "accounts", "/other": "monolith"} {
+		assert.Equal(t, want, get(in, p), p)
+	}
+	assert.Len(t, in.Targets(), 2)
+
+	var tests = []struct {
+		cfg  *Config
+		info string
+	}{
+		{cfg: newConfig("default"), info: "reserved name"},
+		{cfg: newConfig("accounts", RouteConfig{PathPrefix: "/accounts", Pool: "payments"}), info: "unknown pool"},
+		{cfg: newConfig("accounts", RouteConfig{Pool: "accounts"}), info: "route without matcher"},
+	}
+	for _, tst := range tests {
+		assert.Error(t, in.Reload(tst.cfg), tst.info)
+	}
+	cfg := newConfig("accounts")
+	cfg.Middleware.Proxy.Pools["accounts"] = PoolConfig{}
+	assert.Error(t, in.Reload(cfg), "pool without targets")
+}
+
+// TestCanaries shows that a canary sends traffic of a pool to a canary pool and that its weight can be changed.
+func TestCanaries(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+	}
+	stable := upstream("stable")
+	defer stable.Close()
+	canary := upstream("canary")
+	defer canary.Close()
+
+	newConfig := func(canaries ...CanaryConfig) *Config {
+		cfg := &Config{ErrorResponse: "{{.Status}}"}
+		cfg.Middleware.Proxy.Targets = []TargetConfig{{URL: stable.URL}}
+		cfg.Middleware.Proxy.Pools = map[string]PoolConfig{"canary": {Targets: []TargetConfig{{URL: canary.URL}}}}
+		cfg.Middleware.Proxy.Canaries = canaries
+		return cfg
+	}
+	operationFn := func(method string, url *url.URL) (*path.Operation, error) {
+		return &path.Operation{}, nil
+	}
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	get := func(in *Ingress, header string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/foo", nil)
+		if header != "" {
+			r.Header.Set("X-Canary", header)
+		}
+		in.ServeHTTP(w, r)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	in := NewWithConfig(newConfig(CanaryConfig{Canary: "canary", Header: "X-Canary"}), operationFn, tokeninfoFn, nil)
+	defer in.Shutdown(context.Background())
+	assert.Equal(t, "stable", get(in, ""), "weight 0")
+	assert.Equal(t, "canary", get(in, "1"), "header")
+	if assert.Len(t, in.Canaries(), 1) {
+		assert.Equal(t, mw.CanaryStatus{Pool: DefaultPool, Canary: "canary"}, in.Canaries()[0].Status())
+		assert.NoError(t, in.Canaries()[0].SetWeight(100))
+		assert.Equal(t, "canary", get(in, ""), "weight 100")
+	}
+
+	// A reload keeps the weight that is set at runtime until the canary config changes.
+	assert.NoError(t, in.Reload(newConfig(CanaryConfig{Canary: "canary", Header: "X-Canary"})))
+	if assert.Len(t, in.Canaries(), 1) {
+		assert.Equal(t, mw.CanaryStatus{Pool: DefaultPool, Canary: "canary", Weight: 100}, in.Canaries()[0].Status(), "unchanged config")
+	}
+	assert.NoError(t, in.Reload(newConfig(CanaryConfig{Canary: "canary", Weight: 10})))
+	if assert.Len(t, in.Canaries(), 1) {
+		assert.Equal(t, mw.CanaryStatus{Pool: DefaultPool, Canary: "canary", Weight: 10, ConfiguredWeight: 10}, in.Canaries()[0].Status(), "changed weight")
+	}
+
+	var tests = []struct {
+		cfg  *Config
+		info string
+	}{
+		{cfg: newConfig(CanaryConfig{Canary: "nonexistent"}), info: "unknown pool"},
+		{cfg: newConfig(CanaryConfig{Canary: "canary"}, CanaryConfig{Canary: "canary"}), info: "two canaries"},
+		{cfg: newConfig(CanaryConfig{Canary: "canary", Weight: 101}), info: "weight"},
+		{cfg: newConfig(CanaryConfig{Canary: "canary", StickyKey: "query:id"}), info: "sticky key"},
+	}
+	for _, tst := range tests {
+		assert.Error(t, in.Reload(tst.cfg), tst.info)
+	}
+}
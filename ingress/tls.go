@@ -0,0 +1,298 @@
+package ingress
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// TLSConfig defines the server certificates, protocol versions, cipher suites and client certificate verification.
+	TLSConfig struct {
+		// Key is path of key.pem file.
+		Key string `yaml:"key"`
+		// Key is path of cert.pem file.
+		Cert string `yaml:"cert"`
+		// Certificates are additional cert/key pairs, a pair is selected when its certificate matches the server
+		// name (SNI) that is requested by the client. Cert/Key is the default.
+		Certificates []CertKeyPair `yaml:"certificates"`
+		// ReloadInterval is how often the cert and key files are checked for changes (default 10s).
+		ReloadInterval time.Duration `yaml:"reloadInterval"`
+		// MinVersion is the minimum TLS version; 1.0, 1.1, 1.2 (default) or 1.3.
+		MinVersion string `yaml:"minVersion"`
+		// CipherSuites are the names of the TLS 1.0-1.2 cipher suites that are allowed, for example
+		// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Default are the ECDHE suites with AEAD ciphers.
+		// TLS 1.3 cipher suites are not configurable.
+		CipherSuites []string `yaml:"cipherSuites"`
+		// ClientCA is the path of a PEM file with the CA certificates that verify client certificates.
+		ClientCA string `yaml:"clientCA"`
+		// ClientAuth is none (default), optional (verify a client certificate if given) or require.
+		ClientAuth string `yaml:"clientAuth"`
+		// ClientID is the client certificate field that becomes the ClientID; cn (default), subject, dns, uri or email.
+		ClientID string `yaml:"clientId"`
+	}
+
+	// CertKeyPair is the path of a cert.pem and key.pem file.
+	CertKeyPair struct {
+		Cert string `yaml:"cert"`
+		Key  string `yaml:"key"`
+	}
+
+	// UpstreamTLSConfig defines how the TLS connection with an upstream server is set up.
+	UpstreamTLSConfig struct {
+		// CA is the path of a PEM file with the CA certificates that verify the server (default system roots).
+		CA string `yaml:"ca"`
+		// Cert and Key are the paths of the client certificate and key for mutual TLS (optional).
+		Cert string `yaml:"cert"`
+		Key  string `yaml:"key"`
+		// ServerName overrides the host name that is sent (SNI) and verified.
+		ServerName string `yaml:"serverName"`
+		// InsecureSkipVerify disables verification of the server certificate, for testing only.
+		InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+	}
+
+	// CertStore holds the server certificates and reloads them when the files change.
+	certStore struct {
+		// pairs are the files, the first pair is the default certificate.
+		pairs []CertKeyPair
+		// mutex protects the fields below.
+		mutex sync.RWMutex
+		certs []*tls.Certificate
+		// checksum of the content of all files that are loaded.
+		checksum [sha256.Size]byte
+	}
+)
+
+var (
+	// TLSVersions maps config values to TLS versions.
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// CipherSuites maps names to TLS 1.0-1.2 cipher suites, suites with RC4 or 3DES are left out.
+	cipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+
+	// DefaultCipherSuites are the suites that are allowed when none are configured.
+	defaultCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	}
+)
+
+// NewTLSConfig returns the server TLS config and the certificates it serves or nil when TLS isn't configured.
+func newTLSConfig(cfg TLSConfig) (*tls.Config, *certStore, error) {
+	if cfg.Cert == "" && cfg.Key == "" {
+		if len(cfg.Certificates) > 0 || (cfg.ClientAuth != "" && cfg.ClientAuth != "none") {
+			return nil, nil, fmt.Errorf("config: tls: cert and key are required")
+		}
+		return nil, nil, nil
+	}
+
+	c := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CipherSuites:             defaultCipherSuites,
+		PreferServerCipherSuites: true,
+	}
+
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("config: tls: minVersion %q must be one of 1.0, 1.1, 1.2 or 1.3", cfg.MinVersion)
+		}
+		c.MinVersion = v
+	}
+
+	if len(cfg.CipherSuites) > 0 {
+		c.CipherSuites = nil
+		for _, n := range cfg.CipherSuites {
+			id, ok := cipherSuites[n]
+			if !ok {
+				return nil, nil, fmt.Errorf("config: tls: cipher suite %q is unknown or insecure", n)
+			}
+			c.CipherSuites = append(c.CipherSuites, id)
+		}
+	}
+
+	// Client certificates
+	switch cfg.ClientAuth {
+	case "", "none":
+		if cfg.ClientCA != "" {
+			glog.Warning("config: tls: clientCA is ignored because clientAuth is none.")
+		}
+	case "optional", "require":
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.ClientAuth == "require" {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		if cfg.ClientCA == "" {
+			return nil, nil, fmt.Errorf("config: tls: clientAuth requires clientCA")
+		}
+		b, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("config: tls: clientCA: %v", err)
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, nil, fmt.Errorf("config: tls: clientCA: no certificates in %s", cfg.ClientCA)
+		}
+	default:
+		return nil, nil, fmt.Errorf("config: tls: clientAuth %q must be one of none, optional or require", cfg.ClientAuth)
+	}
+
+	// Server certificates
+	pairs := append([]CertKeyPair{{Cert: cfg.Cert, Key: cfg.Key}}, cfg.Certificates...)
+	certs, err := newCertStore(pairs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("config: tls: %v", err)
+	}
+	c.GetCertificate = certs.getCertificate
+
+	return c, certs, nil
+}
+
+// NewUpstreamTLSConfig returns the client TLS config to connect to an upstream server.
+func newUpstreamTLSConfig(cfg UpstreamTLSConfig) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CA != "" {
+		b, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("tls: ca: %v", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("tls: ca: no certificates in %s", cfg.CA)
+		}
+	}
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// NewCertStore returns a store with the certificates read from pairs.
+func newCertStore(pairs []CertKeyPair) (*certStore, error) {
+	s := &certStore{pairs: pairs}
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run reloads the certificates periodically until ctx is done.
+func (s *certStore) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := s.reload()
+			if err != nil {
+				glog.Error("tls certificates reload: ", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reload reads the cert and key files and replaces the current certificates when the content has changed.
+// On error the current certificates remain in use.
+func (s *certStore) reload() error {
+	var all bytes.Buffer
+	type pem struct{ cert, key []byte }
+	pems := make([]pem, 0, len(s.pairs))
+	for _, p := range s.pairs {
+		cert, err := ioutil.ReadFile(p.Cert)
+		if err != nil {
+			return err
+		}
+		key, err := ioutil.ReadFile(p.Key)
+		if err != nil {
+			return err
+		}
+		all.Write(cert)
+		all.Write(key)
+		pems = append(pems, pem{cert: cert, key: key})
+	}
+	cs := sha256.Sum256(all.Bytes())
+	s.mutex.RLock()
+	same := cs == s.checksum && s.certs != nil
+	s.mutex.RUnlock()
+	if same {
+		return nil
+	}
+
+	certs := make([]*tls.Certificate, 0, len(pems))
+	for i, p := range pems {
+		// cert-manager writes cert and key separately, a mismatch is retried on the next reload.
+		c, err := tls.X509KeyPair(p.cert, p.key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.pairs[i].Cert, err)
+		}
+		c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.pairs[i].Cert, err)
+		}
+		certs = append(certs, &c)
+	}
+
+	s.mutex.Lock()
+	s.certs = certs
+	s.checksum = cs
+	s.mutex.Unlock()
+	glog.Infof("tls: loaded %d certificates", len(certs))
+
+	return nil
+}
+
+// GetCertificate returns the certificate that matches the requested server name or the default certificate.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if name := strings.TrimSuffix(strings.ToLower(hello.ServerName), "."); name != "" {
+		for _, c := range s.certs {
+			if c.Leaf.VerifyHostname(name) == nil {
+				return c, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
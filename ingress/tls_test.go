@@ -0,0 +1,331 @@
+package ingress
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/mmlt/apigw/mw"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestNewTLSConfig shows how the TLS config is checked.
+func TestNewTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.cleanup()
+	cert, key := ca.issue(t, &x509.Certificate{DNSNames: []string{"localhost"}})
+
+	var tests = []struct {
+		cfg     TLSConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{cfg: TLSConfig{}, wantNil: true},
+		{cfg: TLSConfig{Cert: cert, Key: key}},
+		{cfg: TLSConfig{Cert: cert, Key: key, MinVersion: "1.3"}},
+		{cfg: TLSConfig{Cert: cert, Key: key, MinVersion: "1.4"}, wantNil: true, wantErr: true},
+		{cfg: TLSConfig{Cert: cert, Key: key, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}},
+		{cfg: TLSConfig{Cert: cert, Key: key, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, wantNil: true, wantErr: true},
+		{cfg: TLSConfig{Cert: cert, Key: key, ClientAuth: "optional", ClientCA: ca.file}},
+		{cfg: TLSConfig{Cert: cert, Key: key, ClientAuth: "require", ClientCA: ca.file}},
+		{cfg: TLSConfig{Cert: cert, Key: key, ClientAuth: "always", ClientCA: ca.file}, wantNil: true, wantErr: true},
+		{cfg: TLSConfig{Cert: cert, Key: key, ClientAuth: "require"}, wantNil: true, wantErr: true},
+		{cfg: TLSConfig{Cert: cert, Key: key, ClientAuth: "require", ClientCA: "/does/not/exist"}, wantNil: true, wantErr: true},
+		{cfg: TLSConfig{ClientAuth: "require", ClientCA: ca.file}, wantNil: true, wantErr: true},
+		{cfg: TLSConfig{Cert: cert, Key: "/does/not/exist"}, wantNil: true, wantErr: true},
+		{cfg: TLSConfig{Cert: cert, Key: cert}, wantNil: true, wantErr: true},
+	}
+	for i, tst := range tests {
+		got, _, err := newTLSConfig(tst.cfg)
+		assert.Equal(t, tst.wantErr, err != nil, "%d) error %v", i, err)
+		assert.Equal(t, tst.wantNil, got == nil, "%d) config", i)
+	}
+}
+
+// TestTLS shows that certificates are selected by SNI, that the minimum version is enforced and that changed
+// certificate files are picked up.
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.cleanup()
+	defaultCert, defaultKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "default"}, DNSNames: []string{"localhost"}})
+	apiCert, apiKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "api"}, DNSNames: []string{"*.api.example.com"}})
+
+	tlsConfig, certs, err := newTLSConfig(TLSConfig{
+		Cert:         defaultCert,
+		Key:          defaultKey,
+		Certificates: []CertKeyPair{{Cert: apiCert, Key: apiKey}},
+		MinVersion:   "1.2",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ln := serveTLS(t, tlsConfig)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	// handshake returns the common name of the server certificate.
+	handshake := func(serverName string, maxVersion uint16) string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool, ServerName: serverName, MaxVersion: maxVersion})
+		if err != nil {
+			return "error"
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "default", handshake("localhost", 0))
+	assert.Equal(t, "api", handshake("v1.api.example.com", 0))
+	assert.Equal(t, "error", handshake("other.example.com", 0), "default cert doesn't match")
+	assert.Equal(t, "error", handshake("localhost", tls.VersionTLS11), "minimum version")
+
+	// rotate
+	renewedCert, renewedKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "renewed"}, DNSNames: []string{"localhost"}})
+	for _, f := range [][2]string{{renewedCert, defaultCert}, {renewedKey, defaultKey}} {
+		b, _ := ioutil.ReadFile(f[0])
+		assert.NoError(t, ioutil.WriteFile(f[1], b, 0600))
+	}
+	assert.NoError(t, certs.reload())
+	assert.Equal(t, "renewed", handshake("localhost", 0))
+
+	// a broken file doesn't replace the current certificates.
+	assert.NoError(t, ioutil.WriteFile(defaultKey, []byte("broken"), 0600))
+	assert.Error(t, certs.reload())
+	assert.Equal(t, "renewed", handshake("localhost", 0))
+}
+
+// TestClientCertificate shows that client certificates are verified against the CA bundle, that the certificate
+// maps to a ClientID and that an operation can require a certificate.
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.cleanup()
+	serverCert, serverKey := ca.issue(t, &x509.Certificate{DNSNames: []string{"localhost"}})
+	clientCert, clientKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "app1"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	clientPair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Client-Id"))
+	}))
+	defer upstream.Close()
+	cfg := &Config{ErrorResponse: "{{.Status}}"}
+	cfg.Middleware.Proxy.Targets = []TargetConfig{{URL: upstream.URL}}
+	cfg.Middleware.Identity.ClientIDHeader = "X-Client-Id"
+	cfg.TLS = TLSConfig{Cert: serverCert, Key: serverKey, ClientAuth: "optional", ClientCA: ca.file}
+	operationFn := func(method string, url *url.URL) (*path.Operation, error) {
+		return &path.Operation{ClientCert: url.Path == "/cert"}, nil
+	}
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	in := NewWithConfig(cfg, operationFn, tokeninfoFn, nil)
+	srv := httptest.NewUnstartedServer(in)
+	srv.Listener = tls.NewListener(srv.Listener, in.server.TLSConfig)
+	srv.Start()
+	defer srv.Close()
+
+	get := func(certs []tls.Certificate, p string) string {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, Certificates: certs, ServerName: "localhost"}}}
+		resp, err := client.Get("https://" + srv.Listener.Addr().String() + p)
+		if err != nil {
+			return err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	withCert := []tls.Certificate{clientPair}
+	assert.Equal(t, "app1", get(withCert, "/cert"))
+	assert.Equal(t, "app1", get(withCert, "/public"))
+	assert.Equal(t, "", get(nil, "/public"))
+	assert.Equal(t, "403", get(nil, "/cert"))
+}
+
+// TestUpstreamTLS shows that https targets are verified with the configured CA and server name and that a client
+// certificate is presented.
+func TestUpstreamTLS(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.cleanup()
+	serverCert, serverKey := ca.issue(t, &x509.Certificate{DNSNames: []string{"upstream.internal"}})
+	clientCert, clientKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "apigw"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	serverPair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	tokeninfoFn := func(token string) (*mw.TokeninfoResponse, error) {
+		return nil, errors.New("not used")
+	}
+	var tests = []struct {
+		tls  UpstreamTLSConfig
+		want string
+		info string
+	}{
+		{tls: UpstreamTLSConfig{CA: ca.file, Cert: clientCert, Key: clientKey, ServerName: "upstream.internal"}, want: "apigw", info: "mutual tls"},
+		{tls: UpstreamTLSConfig{Cert: clientCert, Key: clientKey, InsecureSkipVerify: true}, want: "apigw", info: "insecure"},
+		{tls: UpstreamTLSConfig{CA: ca.file, ServerName: "upstream.internal"}, want: "503", info: "no client certificate"},
+		{tls: UpstreamTLSConfig{CA: ca.file, Cert: clientCert, Key: clientKey}, want: "503", info: "server name mismatch"},
+	}
+	for _, tst := range tests {
+		cfg := &Config{ErrorResponse: "{{.Status}}"}
+		cfg.Middleware.Proxy.Targets = []TargetConfig{{URL: upstream.URL, TLS: tst.tls}}
+		in := NewWithConfig(cfg, nil, tokeninfoFn, nil)
+
+		w := httptest.NewRecorder()
+		in.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/foo", nil))
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		assert.Equal(t, tst.want, string(body), tst.info)
+	}
+
+	// Config errors
+	for _, tc := range []TargetConfig{
+		{URL: "http://upstream.internal", TLS: UpstreamTLSConfig{CA: ca.file}},
+		{URL: upstream.URL, TLS: UpstreamTLSConfig{CA: "/does/not/exist"}},
+		{URL: upstream.URL, TLS: UpstreamTLSConfig{Cert: clientCert}},
+	} {
+		cfg := &Config{ErrorResponse: "{{.Status}}"}
+		cfg.Middleware.Proxy.Targets = []TargetConfig{tc}
+		_, err := (&Ingress{tokeninfoFn: tokeninfoFn}).newChain(cfg)
+		assert.Error(t, err, "%v", tc)
+	}
+}
+
+// TestTargetConfigYAML shows that a target is an url or a map.
+func TestTargetConfigYAML(t *testing.T) {
+	var cfg Config
+	err := yaml.Unmarshal([]byte(`
+middleware:
+  proxy:
+    targets:
+    - http://a.internal
+    - url: https://b.internal
+      tls:
+        ca: /etc/apigw/ca.pem
+        serverName: b
+`), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetConfig{
+		{URL: "http://a.internal"},
+		{URL: "https://b.internal", TLS: UpstreamTLSConfig{CA: "/etc/apigw/ca.pem", ServerName: "b"}},
+	}, cfg.Middleware.Proxy.Targets)
+}
+
+// TestCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	pool *x509.CertPool
+	// file is the PEM encoded CA certificate.
+	file string
+	// files to remove on cleanup.
+	files  []string
+	serial int64
+}
+
+// NewTestCA returns a CA with a self-signed certificate.
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{serial: 1}
+	ca.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.cert, _ = x509.ParseCertificate(der)
+	ca.pool = x509.NewCertPool()
+	ca.pool.AddCert(ca.cert)
+	ca.file = ca.write(t, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ca
+}
+
+// Issue signs a certificate with the fields of tmpl and returns the paths of the cert and key files.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (string, string) {
+	ca.serial++
+	tmpl.SerialNumber = big.NewInt(ca.serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if tmpl.ExtKeyUsage == nil {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.write(t, &pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		ca.write(t, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// Write writes a PEM block to a temporary file and returns its name.
+func (ca *testCA) write(t *testing.T, block *pem.Block) string {
+	f, err := ioutil.TempFile("", "pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem.Encode(f, block)
+	f.Close()
+	ca.files = append(ca.files, f.Name())
+	return f.Name()
+}
+
+// Cleanup removes the files.
+func (ca *testCA) cleanup() {
+	for _, f := range ca.files {
+		os.Remove(f)
+	}
+}
+
+// ServeTLS accepts TLS connections with config until the returned listener is closed.
+func serveTLS(t *testing.T, config *tls.Config) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}(conn)
+		}
+	}()
+	return ln
+}
@@ -38,17 +38,10 @@ func main() {
 	})
 	glog.Info(s)
 
-	// Read yaml
-	configYaml, err := ioutil.ReadFile(*configPath)
-	if err != nil {
-		glog.Exit(err)
-	}
-
 	// Read config file.
-	cfg := &gateway.Config{}
-	err = yaml.Unmarshal(configYaml, cfg)
+	cfg, err := readConfig(*configPath)
 	if err != nil {
-		glog.Exit("parsing config", configPath, err)
+		glog.Exit(err)
 	}
 
 	//TODO Use contour workgroup or https://github.com/oklog/run to manage go routines
@@ -63,14 +56,65 @@ func main() {
 		}
 	}()
 
-	// Create Prometheus endpoint
+	// Reload re-reads the config file and applies it to the running gateway.
+	reload := func() error {
+		cfg, err := readConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		return gw.Reload(cfg)
+	}
+
+	// Create Prometheus and management endpoints
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/healthz", gw.Healthz)
+		http.HandleFunc("/readyz", gw.Readyz)
+		http.HandleFunc("/jwks", gw.JWKS)
+		http.HandleFunc("/targets", gw.Targets)
+		http.HandleFunc("/canaries", gw.Canaries)
+		http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			err := reload()
+			if err != nil {
+				glog.Error("reload config: ", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, "config reloaded")
+		})
 		glog.Fatal(http.ListenAndServe(cfg.Management.Bind, nil))
 	}()
 
-	// Wait for SIGINT
+	// Wait for SIGINT, reload config on SIGHUP
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, syscall.SIGINT)
-	<-c
+	signal.Notify(c, syscall.SIGINT, syscall.SIGHUP)
+	for s := range c {
+		if s != syscall.SIGHUP {
+			break
+		}
+		err := reload()
+		if err != nil {
+			glog.Error("reload config: ", err)
+		}
+	}
+}
+
+// ReadConfig reads a yaml config file.
+func readConfig(path string) (*gateway.Config, error) {
+	configYaml, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &gateway.Config{}
+	err = yaml.Unmarshal(configYaml, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %s: %v", path, err)
+	}
+
+	return cfg, nil
 }
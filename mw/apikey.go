@@ -0,0 +1,285 @@
+package mw
+
+/*
+	APIKey middleware checks the API keys of operations that have apiKey security schemes.
+
+	Keys are looked up by their SHA-256 hash in a key store file, a key maps to a client id and the operations the
+	client is allowed to call. The key store is reloaded when the file changes.
+
+	This middleware only records which schemes are satisfied, the OAuth2 middleware decides if the security
+	requirements of the operation are met. Therefore it must be placed before the OAuth2 middleware.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/mmlt/apigw/path"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// APIKeyConfig defines the config for APIKey middleware.
+	APIKeyConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper middleware.Skipper
+
+		// Operation is a function that gets the operation for a path.
+		// Required.
+		Operation OperationFunc
+
+		// Store contains the valid keys.
+		// Required.
+		Store *APIKeyStore
+	}
+
+	// APIKeyStore holds API keys that are read from a YAML file of the form:
+	//  keys:
+	//  - hash: sha256:<hex encoded SHA-256 hash of the key>
+	//    clientId: app1
+	//    operations: [getPet, "POST /pets"]
+	APIKeyStore struct {
+		// File is the path of the key store file.
+		file string
+		// Mutex protects the fields below.
+		mutex sync.RWMutex
+		// Keys by hex encoded hash.
+		keys map[string]*APIKey
+		// Checksum of the file content that is loaded.
+		checksum [sha256.Size]byte
+	}
+
+	// APIKey is a key store entry.
+	APIKey struct {
+		// Hash is the hex encoded SHA-256 hash of the key, optionally prefixed with 'sha256:'.
+		Hash string `yaml:"hash"`
+		// ClientID identifies the application that uses the key.
+		ClientID string `yaml:"clientId"`
+		// Operations the key gives access to; operationIds or "METHOD path" as defined in the API definition.
+		// "*" allows all operations.
+		Operations []string `yaml:"operations"`
+	}
+)
+
+// Errors
+var (
+	ErrAPIKeyInvalid   = echo.NewHTTPError(http.StatusUnauthorized, "Invalid API key")
+	ErrAPIKeyForbidden = echo.NewHTTPError(http.StatusForbidden, "API key not allowed")
+)
+
+var (
+	// DefaultAPIKeyConfig is the default APIKey middleware config.
+	DefaultAPIKeyConfig = APIKeyConfig{
+		Skipper: middleware.DefaultSkipper,
+	}
+)
+
+// APIKeyWithConfig returns an APIKey middleware with config.
+// A key that is presented but unknown results in Unauthorized, a key that doesn't give access to the operation
+// results in Forbidden.
+// The client ids of the satisfied schemes are added to context as "Schemes" (map of scheme name to client id).
+// See: `APIKeyConfig`.
+func APIKeyWithConfig(config APIKeyConfig) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultAPIKeyConfig.Skipper
+	}
+	if config.Operation == nil {
+		panic("echo: APIKey middleware requires an Operation function.")
+	}
+	if config.Store == nil {
+		panic("echo: APIKey middleware requires a Store.")
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			op, err := operation(c, config.Operation)
+			if err != nil {
+				return err
+			}
+			if op == nil {
+				return next(c)
+			}
+
+			satisfied := map[string]string{}
+			for _, req := range op.Security {
+				for _, s := range req.Schemes {
+					if s.Type != path.SchemeTypeAPIKey {
+						continue
+					}
+					if _, ok := satisfied[s.Name]; ok {
+						continue
+					}
+					key := extractAPIKey(c.Request(), s)
+					if key == "" {
+						continue
+					}
+					k := config.Store.Lookup(key)
+					if k == nil {
+						glog.V(2).Infof("%s %s: unknown key for scheme %s", c.Request().Method, c.Request().URL.Path, s.Name)
+						return ErrAPIKeyInvalid
+					}
+					if !k.allowed(op) {
+						glog.V(2).Infof("%s %s: key of client %s doesn't allow %s", c.Request().Method, c.Request().URL.Path, k.ClientID, op.Name())
+						return ErrAPIKeyForbidden
+					}
+					satisfied[s.Name] = k.ClientID
+				}
+			}
+			if len(satisfied) > 0 {
+				c.Set("Schemes", satisfied)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Operation returns the operation that is stored in context or, when there is none, gets it with fn and stores it
+// in context.
+func operation(c echo.Context, fn OperationFunc) (*path.Operation, error) {
+	if op, ok := c.Get("Operation").(*path.Operation); ok {
+		return op, nil
+	}
+	op, err := fn(c.Request().Method, c.Request().URL)
+	if err != nil {
+		return nil, err
+	}
+	if op != nil {
+		// make it possible for other middleware to use the matched operation.
+		c.Set("Operation", op)
+	}
+	return op, nil
+}
+
+// ExtractAPIKey gets the key for scheme s from a request and removes it so it isn't forwarded upstream.
+func extractAPIKey(req *http.Request, s path.Scheme) string {
+	var key string
+	switch s.In {
+	case "header":
+		key = req.Header.Get(s.Param)
+		req.Header.Del(s.Param)
+	case "query":
+		q := req.URL.Query()
+		key = q.Get(s.Param)
+		if _, ok := q[s.Param]; ok {
+			q.Del(s.Param)
+			req.URL.RawQuery = q.Encode()
+		}
+	case "cookie":
+		cookies := req.Cookies()
+		req.Header.Del("Cookie")
+		for _, ck := range cookies {
+			if ck.Name == s.Param {
+				key = ck.Value
+				continue
+			}
+			req.AddCookie(ck)
+		}
+	}
+	return key
+}
+
+// Allowed returns true if the key gives access to op.
+func (k *APIKey) allowed(op *path.Operation) bool {
+	for _, o := range k.Operations {
+		if o == "*" || (op.ID != "" && o == op.ID) || o == op.Method+" "+op.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAPIKeyStore returns a store with the keys read from file.
+func NewAPIKeyStore(file string) (*APIKeyStore, error) {
+	s := &APIKeyStore{file: file}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run reloads the key store periodically until ctx is done.
+func (s *APIKeyStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := s.Reload()
+			if err != nil {
+				glog.Error("api key store reload: ", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reload reads the key store file and replaces the current keys when the content has changed.
+// On error the current keys remain in use.
+func (s *APIKeyStore) Reload() error {
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	cs := sha256.Sum256(b)
+	s.mutex.RLock()
+	same := cs == s.checksum && s.keys != nil
+	s.mutex.RUnlock()
+	if same {
+		return nil
+	}
+
+	var content struct {
+		Keys []*APIKey `yaml:"keys"`
+	}
+	err = yaml.UnmarshalStrict(b, &content)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.file, err)
+	}
+	keys := make(map[string]*APIKey, len(content.Keys))
+	for i, k := range content.Keys {
+		h := strings.ToLower(strings.TrimPrefix(k.Hash, "sha256:"))
+		if b, err := hex.DecodeString(h); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%s: key %d: hash must be a hex encoded SHA-256 hash", s.file, i)
+		}
+		if k.ClientID == "" {
+			return fmt.Errorf("%s: key %d: clientId is required", s.file, i)
+		}
+		if _, ok := keys[h]; ok {
+			return fmt.Errorf("%s: key %d: duplicate hash", s.file, i)
+		}
+		keys[h] = k
+	}
+
+	s.mutex.Lock()
+	s.keys = keys
+	s.checksum = cs
+	s.mutex.Unlock()
+	glog.Infof("api key store %s: loaded %d keys", s.file, len(keys))
+
+	return nil
+}
+
+// Lookup returns the entry for key or nil if the key is unknown.
+func (s *APIKeyStore) Lookup(key string) *APIKey {
+	h := sha256.Sum256([]byte(key))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keys[hex.EncodeToString(h[:])]
+}
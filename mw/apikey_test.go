@@ -0,0 +1,150 @@
+package mw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// TestAPIKey shows that API keys satisfy apiKey schemes, alone or combined with an OAuth2 token.
+func TestAPIKey(t *testing.T) {
+	file := writeKeyStore(t, fmt.Sprintf(`
+keys:
+- hash: sha256:%s
+  clientId: app1
+  operations: [getPet]
+- hash: %s
+  clientId: app2
+  operations: ["*"]
+`, hashKey("key1"), hashKey("key2")))
+	defer os.Remove(file)
+	store, err := NewAPIKeyStore(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	header := path.Scheme{Name: "api_key", Type: path.SchemeTypeAPIKey, In: "header", Param: "X-Api-Key"}
+	query := path.Scheme{Name: "api_key_query", Type: path.SchemeTypeAPIKey, In: "query", Param: "key"}
+	var tests = []struct {
+		required path.Requirements
+		id       string
+		key      string
+		query    string
+		token    bool
+		want     int
+		clientID string
+		info     string
+	}{
+		{required: path.Requirements{{Schemes: []path.Scheme{header}}}, id: "getPet", key: "key1", want: http.StatusOK, clientID: "app1", info: "api key"},
+		{required: path.Requirements{{Schemes: []path.Scheme{query}}}, id: "getPet", query: "key=key2&a=b", want: http.StatusOK, clientID: "app2", info: "api key in query"},
+		{required: path.Requirements{{Schemes: []path.Scheme{header}}}, id: "getPet", key: "wrong", want: http.StatusUnauthorized, info: "unknown key"},
+		{required: path.Requirements{{Schemes: []path.Scheme{header}}}, id: "addPet", key: "key1", want: http.StatusForbidden, info: "operation not allowed"},
+		{required: path.Requirements{{Schemes: []path.Scheme{header}}}, id: "getPet", want: http.StatusUnauthorized, info: "missing key"},
+		{required: path.Requirements{{Scopes: path.Scopes{"read"}}, {Schemes: []path.Scheme{header}}}, id: "getPet", token: true, want: http.StatusOK, clientID: "tokenclient", info: "token alternative"},
+		{required: path.Requirements{{Scopes: path.Scopes{"read"}}, {Schemes: []path.Scheme{header}}}, id: "getPet", key: "key1", want: http.StatusOK, clientID: "app1", info: "api key alternative"},
+		{required: path.Requirements{{Scopes: path.Scopes{"read"}, Schemes: []path.Scheme{header}}}, id: "getPet", key: "key1", want: http.StatusUnauthorized, info: "api key without token"},
+		{required: path.Requirements{{Scopes: path.Scopes{"read"}, Schemes: []path.Scheme{header}}}, id: "getPet", token: true, want: http.StatusUnauthorized, info: "token without api key"},
+		{required: path.Requirements{{Scopes: path.Scopes{"read"}, Schemes: []path.Scheme{header}}}, id: "getPet", key: "key1", token: true, want: http.StatusOK, clientID: "tokenclient", info: "api key and token"},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest(echo.GET, "/pets/1?"+tst.query, nil)
+		if tst.key != "" {
+			req.Header.Set("X-Api-Key", tst.key)
+		}
+		if tst.token {
+			req.Header.Set("Authorization", "Bearer value-not-important")
+		}
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		opFn := func(method string, url *url.URL) (*path.Operation, error) {
+			return &path.Operation{Method: method, Path: "/pets/{id}", ID: tst.id, Security: tst.required}, nil
+		}
+		apiKey := APIKeyWithConfig(APIKeyConfig{Operation: opFn, Store: store})
+		oauth2 := OAuth2WithConfig(OAuth2Config{
+			Operation: opFn,
+			Tokeninfo: func(token string) (*TokeninfoResponse, error) {
+				return &TokeninfoResponse{ClientID: "tokenclient", Scopes: map[string]struct{}{"read": {}}, ExpiresIn: 10}, nil
+			},
+		})
+		var upstream *http.Request
+		h := apiKey(oauth2(func(c echo.Context) error {
+			upstream = c.Request()
+			return c.String(http.StatusOK, "test")
+		}))
+
+		err := h(c)
+		if err != nil {
+			assert.Equal(t, tst.want, err.(*echo.HTTPError).Code, tst.info)
+			continue
+		}
+		assert.Equal(t, tst.want, c.Response().Status, tst.info)
+		assert.Equal(t, tst.clientID, c.Get("ClientID"), tst.info)
+		// keys are not forwarded
+		assert.Equal(t, "", upstream.Header.Get("X-Api-Key"), tst.info)
+		assert.Equal(t, "", upstream.URL.Query().Get("key"), tst.info)
+	}
+}
+
+// TestAPIKeyStoreReload shows that changes to the key store file are picked up and that an invalid file doesn't
+// replace the current keys.
+func TestAPIKeyStoreReload(t *testing.T) {
+	file := writeKeyStore(t, fmt.Sprintf("keys:\n- hash: %s\n  clientId: app1\n", hashKey("key1")))
+	defer os.Remove(file)
+	store, err := NewAPIKeyStore(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.NotNil(t, store.Lookup("key1")) {
+		assert.Equal(t, "app1", store.Lookup("key1").ClientID)
+	}
+	assert.Nil(t, store.Lookup("key2"))
+
+	// rotate
+	err = ioutil.WriteFile(file, []byte(fmt.Sprintf("keys:\n- hash: %s\n  clientId: app1\n", hashKey("key2"))), 0600)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Reload())
+	assert.Nil(t, store.Lookup("key1"))
+	assert.NotNil(t, store.Lookup("key2"))
+
+	// invalid content
+	for _, content := range []string{
+		"keys:\n- hash: notahash\n  clientId: app1\n",
+		fmt.Sprintf("keys:\n- hash: %s\n", hashKey("key3")),
+		fmt.Sprintf("keys:\n- hash: %s\n  clientId: app1\n- hash: %[1]s\n  clientId: app2\n", hashKey("key3")),
+	} {
+		err = ioutil.WriteFile(file, []byte(content), 0600)
+		assert.NoError(t, err)
+		assert.Error(t, store.Reload(), content)
+		assert.NotNil(t, store.Lookup("key2"), content)
+	}
+}
+
+// WriteKeyStore writes content to a temporary file and returns its name.
+func writeKeyStore(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// HashKey returns the hex encoded SHA-256 hash of key.
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,287 @@
+package mw
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Load balancing techniques in addition to the random and round-robin balancers of proxy.go.
+
+	All balancers skip targets that are unhealthy or ejected and return nil when no target is available.
+*/
+
+type (
+	// HashKeyFunc returns the key that a consistent hash balancer maps to a target.
+	HashKeyFunc func(echo.Context) string
+
+	// WeightedRoundRobinBalancer implements a smooth weighted round-robin load balancing technique.
+	weightedRoundRobinBalancer struct {
+		*commonBalancer
+		// lock guards current.
+		lock sync.Mutex
+		// current weight per target.
+		current map[*ProxyTarget]int
+	}
+
+	// LeastOutstandingBalancer selects the target with the least in-flight requests relative to its weight.
+	leastOutstandingBalancer struct {
+		*commonBalancer
+		// i rotates the start of the search so ties are spread.
+		i uint32
+	}
+
+	// P2CBalancer selects the least loaded of two randomly chosen targets (power of two choices).
+	p2cBalancer struct {
+		*commonBalancer
+	}
+
+	// ConsistentHashBalancer maps a request key to a target on a hash ring.
+	consistentHashBalancer struct {
+		*commonBalancer
+		key HashKeyFunc
+		// ring is sorted by hash, guarded by commonBalancer.mutex.
+		ring []ringNode
+		// i is used to round-robin requests without a key.
+		i uint32
+	}
+
+	// RingNode is a point on the hash ring.
+	ringNode struct {
+		hash   uint32
+		target *ProxyTarget
+	}
+)
+
+// RingReplicas is the number of points a target with weight 1 has on the hash ring.
+const ringReplicas = 100
+
+// NewWeightedRoundRobinBalancer returns a proxy balancer that distributes requests in proportion to target weights.
+func NewWeightedRoundRobinBalancer(targets []*ProxyTarget) ProxyBalancer {
+	b := &weightedRoundRobinBalancer{commonBalancer: new(commonBalancer), current: map[*ProxyTarget]int{}}
+	b.targets = targets
+	return b
+}
+
+// NewLeastOutstandingBalancer returns a proxy balancer that selects the target with the least in-flight requests.
+func NewLeastOutstandingBalancer(targets []*ProxyTarget) ProxyBalancer {
+	b := &leastOutstandingBalancer{commonBalancer: new(commonBalancer)}
+	b.targets = targets
+	return b
+}
+
+// NewP2CBalancer returns a proxy balancer that selects the least loaded of two random targets.
+func NewP2CBalancer(targets []*ProxyTarget) ProxyBalancer {
+	b := &p2cBalancer{commonBalancer: new(commonBalancer)}
+	b.targets = targets
+	return b
+}
+
+// NewConsistentHashBalancer returns a proxy balancer that sends requests with the same key to the same target.
+// Requests without a key are balanced round-robin.
+func NewConsistentHashBalancer(targets []*ProxyTarget, key HashKeyFunc) ProxyBalancer {
+	if key == nil {
+		panic("echo: consistent hash balancer requires key")
+	}
+	b := &consistentHashBalancer{commonBalancer: new(commonBalancer), key: key}
+	b.targets = targets
+	b.ring = newRing(targets)
+	return b
+}
+
+// HashByClientID returns a HashKeyFunc that keys requests by "ClientID" from context.
+func HashByClientID() HashKeyFunc {
+	return func(c echo.Context) string {
+		id, _ := c.Get("ClientID").(string)
+		return id
+	}
+}
+
+// HashByHeader returns a HashKeyFunc that keys requests by the value of a request header.
+func HashByHeader(name string) HashKeyFunc {
+	return func(c echo.Context) string {
+		return c.Request().Header.Get(name)
+	}
+}
+
+// HashByCookie returns a HashKeyFunc that keys requests by the value of a cookie.
+func HashByCookie(name string) HashKeyFunc {
+	return func(c echo.Context) string {
+		cookie, err := c.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// Next returns an upstream target using smooth weighted round-robin technique.
+// See https://github.com/phusion/nginx/commit/27e94984486058d73157038f7950a0a36ecc6e35
+func (b *weightedRoundRobinBalancer) Next(c echo.Context) *ProxyTarget {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	available := availableTargets(b.targets)
+	if len(available) == 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var best *ProxyTarget
+	total := 0
+	for _, t := range available {
+		w := t.weight()
+		b.current[t] += w
+		total += w
+		if best == nil || b.current[t] > b.current[best] {
+			best = t
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// RemoveTarget removes an upstream target from the list.
+func (b *weightedRoundRobinBalancer) RemoveTarget(name string) bool {
+	ok := b.commonBalancer.RemoveTarget(name)
+	if ok {
+		b.mutex.RLock()
+		b.lock.Lock()
+		current := make(map[*ProxyTarget]int, len(b.targets))
+		for _, t := range b.targets {
+			current[t] = b.current[t]
+		}
+		b.current = current
+		b.lock.Unlock()
+		b.mutex.RUnlock()
+	}
+	return ok
+}
+
+// Next returns the upstream target with the least outstanding requests relative to its weight.
+func (b *leastOutstandingBalancer) Next(c echo.Context) *ProxyTarget {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	now := timeNow()
+	n := uint32(len(b.targets))
+	start := atomic.AddUint32(&b.i, 1) - 1
+	var best *ProxyTarget
+	for j := uint32(0); j < n; j++ {
+		t := b.targets[(start+j)%n]
+		if t.available(now) && (best == nil || t.lessLoaded(best)) {
+			best = t
+		}
+	}
+	return best
+}
+
+// Next returns the least loaded of two randomly chosen upstream targets.
+func (b *p2cBalancer) Next(c echo.Context) *ProxyTarget {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	available := availableTargets(b.targets)
+	switch n := len(available); n {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	default:
+		i := rand.Intn(n)
+		j := rand.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+		if available[j].lessLoaded(available[i]) {
+			return available[j]
+		}
+		return available[i]
+	}
+}
+
+// Next returns the upstream target that the request key maps to.
+// When that target isn't available the next one on the ring is returned.
+func (b *consistentHashBalancer) Next(c echo.Context) *ProxyTarget {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	now := timeNow()
+	key := b.key(c)
+	if key == "" {
+		n := uint32(len(b.targets))
+		for j := uint32(0); j < n; j++ {
+			t := b.targets[(atomic.AddUint32(&b.i, 1)-1)%n]
+			if t.available(now) {
+				return t
+			}
+		}
+		return nil
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	n := len(b.ring)
+	i := sort.Search(n, func(i int) bool { return b.ring[i].hash >= h })
+	for j := 0; j < n; j++ {
+		t := b.ring[(i+j)%n].target
+		if t.available(now) {
+			return t
+		}
+	}
+	return nil
+}
+
+// AddTarget adds an upstream target to the list and the hash ring.
+func (b *consistentHashBalancer) AddTarget(target *ProxyTarget) bool {
+	ok := b.commonBalancer.AddTarget(target)
+	if ok {
+		b.rebuild()
+	}
+	return ok
+}
+
+// RemoveTarget removes an upstream target from the list and the hash ring.
+func (b *consistentHashBalancer) RemoveTarget(name string) bool {
+	ok := b.commonBalancer.RemoveTarget(name)
+	if ok {
+		b.rebuild()
+	}
+	return ok
+}
+
+// Rebuild replaces the hash ring with one for the current targets.
+func (b *consistentHashBalancer) rebuild() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ring = newRing(b.targets)
+}
+
+// NewRing returns a hash ring with ringReplicas points per target weight.
+func newRing(targets []*ProxyTarget) []ringNode {
+	var ring []ringNode
+	for _, t := range targets {
+		for i := 0; i < ringReplicas*t.weight(); i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", t.URL, i)))
+			ring = append(ring, ringNode{hash: h, target: t})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// Weight returns the weight of the target, at least 1.
+func (t *ProxyTarget) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// LessLoaded returns true when t has less outstanding requests relative to its weight than o.
+func (t *ProxyTarget) lessLoaded(o *ProxyTarget) bool {
+	// compare t.outstanding/t.weight < o.outstanding/o.weight without division.
+	return int64(atomic.LoadInt32(&t.outstanding))*int64(o.weight()) <
+		int64(atomic.LoadInt32(&o.outstanding))*int64(t.weight())
+}
@@ -0,0 +1,208 @@
+package mw
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// NewTargets returns n targets named t0..tn-1.
+func newTargets(n int) []*ProxyTarget {
+	var targets []*ProxyTarget
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("t%d", i)
+		targets = append(targets, &ProxyTarget{Name: name, URL: &url.URL{Scheme: "http", Host: name}})
+	}
+	return targets
+}
+
+// Balancers returns an instance of each balancer for targets.
+func balancers(targets []*ProxyTarget) map[string]ProxyBalancer {
+	return map[string]ProxyBalancer{
+		"random":             NewRandomBalancer(targets),
+		"roundRobin":         NewRoundRobinBalancer(targets),
+		"weightedRoundRobin": NewWeightedRoundRobinBalancer(targets),
+		"leastOutstanding":   NewLeastOutstandingBalancer(targets),
+		"p2c":                NewP2CBalancer(targets),
+		"consistentHash":     NewConsistentHashBalancer(targets, HashByHeader("X-Key")),
+	}
+}
+
+// TestBalancerNoTargets shows that balancers return nil instead of panicking when no target is available.
+func TestBalancerNoTargets(t *testing.T) {
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set("X-Key", "k")
+	c := echo.New().NewContext(req, nil)
+
+	for name, b := range balancers(nil) {
+		assert.Nil(t, b.Next(c), "%s without targets", name)
+	}
+
+	targets := newTargets(2)
+	for _, x := range targets {
+		x.setDown(1)
+	}
+	for name, b := range balancers(targets) {
+		assert.Nil(t, b.Next(c), "%s without healthy targets", name)
+	}
+}
+
+// TestWeightedRoundRobin shows that requests are spread smoothly in proportion to the weights.
+func TestWeightedRoundRobin(t *testing.T) {
+	targets := newTargets(3)
+	targets[0].Weight = 5
+	b := NewWeightedRoundRobinBalancer(targets)
+
+	var got []string
+	for i := 0; i < 7; i++ {
+		got = append(got, b.Next(nil).Name)
+	}
+	assert.Equal(t, []string{"t0", "t0", "t1", "t0", "t2", "t0", "t0"}, got)
+
+	assert.True(t, b.RemoveTarget("t0"))
+	got = nil
+	for i := 0; i < 4; i++ {
+		got = append(got, b.Next(nil).Name)
+	}
+	assert.ElementsMatch(t, []string{"t1", "t1", "t2", "t2"}, got)
+}
+
+// TestLeastOutstanding shows that the target with the least in-flight requests relative to its weight is selected.
+func TestLeastOutstanding(t *testing.T) {
+	targets := newTargets(3)
+	targets[0].outstanding = 2
+	targets[1].outstanding = 3
+	targets[1].Weight = 2
+	targets[2].outstanding = 2
+	b := NewLeastOutstandingBalancer(targets)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "t1", b.Next(nil).Name, "%d) weighted", i)
+	}
+
+	targets[1].setDown(1)
+	got := map[string]int{}
+	for i := 0; i < 4; i++ {
+		got[b.Next(nil).Name]++
+	}
+	assert.Equal(t, map[string]int{"t0": 2, "t2": 2}, got, "ties are spread")
+}
+
+// TestP2C shows that the least loaded of two targets is selected.
+func TestP2C(t *testing.T) {
+	targets := newTargets(2)
+	targets[0].outstanding = 10
+	b := NewP2CBalancer(targets)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "t1", b.Next(nil).Name, "%d)", i)
+	}
+}
+
+// TestConsistentHash shows that requests with the same key go to the same target, also when other targets are
+// added or removed.
+func TestConsistentHash(t *testing.T) {
+	e := echo.New()
+	context := func(key string) echo.Context {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		if key != "" {
+			req.Header.Set("X-Key", key)
+			req.AddCookie(&http.Cookie{Name: "session", Value: key})
+		}
+		c := e.NewContext(req, nil)
+		if key != "" {
+			c.Set("ClientID", key)
+		}
+		return c
+	}
+
+	for _, key := range []HashKeyFunc{HashByHeader("X-Key"), HashByCookie("session"), HashByClientID()} {
+		targets := newTargets(4)
+		b := NewConsistentHashBalancer(targets, key)
+
+		keys := map[string]string{}
+		spread := map[string]int{}
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("client%d", i)
+			keys[k] = b.Next(context(k)).Name
+			spread[keys[k]]++
+			assert.Equal(t, keys[k], b.Next(context(k)).Name, "same key, same target")
+		}
+		assert.Len(t, spread, 4, "all targets are used")
+
+		// only the keys of a removed target move.
+		assert.True(t, b.RemoveTarget("t3"))
+		assert.True(t, b.AddTarget(&ProxyTarget{Name: "t4", URL: &url.URL{Scheme: "http", Host: "t4"}}))
+		targets[0].setDown(1)
+		for k, name := range keys {
+			got := b.Next(context(k)).Name
+			if name == "t0" || name == "t3" {
+				assert.NotEqual(t, "t0", got, "unavailable target")
+				assert.NotEqual(t, "t3", got, "removed target")
+			} else if got != "t4" {
+				assert.Equal(t, name, got, "target is kept")
+			}
+		}
+
+		// requests without key are balanced round-robin.
+		got := map[string]int{}
+		for i := 0; i < 3; i++ {
+			got[b.Next(context("")).Name]++
+		}
+		assert.Equal(t, map[string]int{"t1": 1, "t2": 1, "t4": 1}, got)
+	}
+}
+
+// TestBalancerRace shows that balancers can be used concurrently (run with -race).
+func TestBalancerRace(t *testing.T) {
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set("X-Key", "k")
+	c := echo.New().NewContext(req, nil)
+
+	for name, b := range balancers(newTargets(4)) {
+		var wg sync.WaitGroup
+		var nils int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					if b.Next(c) == nil {
+						atomic.AddInt32(&nils, 1)
+					}
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				x := &ProxyTarget{Name: "extra", URL: &url.URL{Scheme: "http", Host: "extra"}}
+				b.AddTarget(x)
+				b.RemoveTarget("extra")
+			}
+		}()
+		wg.Wait()
+		assert.Equal(t, int32(0), nils, name)
+	}
+}
+
+func BenchmarkBalancers(b *testing.B) {
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set("X-Key", "k")
+	c := echo.New().NewContext(req, nil)
+
+	for name, lb := range balancers(newTargets(10)) {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					lb.Next(c)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package mw
+
+/*
+	BasicAuth middleware checks the HTTP Basic credentials of operations that have basic security schemes.
+
+	Credentials are checked against a htpasswd file with bcrypt hashed passwords, the file is reloaded when it changes.
+	The username is the client id.
+
+	Like the APIKey middleware this middleware only records which schemes are satisfied, the OAuth2 middleware
+	decides if the security requirements of the operation are met. Therefore it must be placed before the OAuth2
+	middleware.
+
+	See https://tools.ietf.org/html/rfc7617
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/mmlt/apigw/path"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// BasicAuthConfig defines the config for BasicAuth middleware.
+	BasicAuthConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper middleware.Skipper
+
+		// Operation is a function that gets the operation for a path.
+		// Required.
+		Operation OperationFunc
+
+		// Store contains the users and their password hashes.
+		// Required.
+		Store *HtpasswdStore
+
+		// Realm is the realm of the WWW-Authenticate challenge.
+		// Optional. Default value apigw.
+		Realm string
+	}
+
+	// HtpasswdStore holds users and bcrypt password hashes that are read from a htpasswd file with lines of the form:
+	//  user:$2y$10$...
+	// Lines starting with # are comments.
+	HtpasswdStore struct {
+		// File is the path of the htpasswd file.
+		file string
+		// Mutex protects the fields below.
+		mutex sync.RWMutex
+		// Users maps usernames to password hashes.
+		users map[string][]byte
+		// Verified maps usernames to the HMAC of the last verified password so bcrypt is only needed once.
+		// The HMAC key is random so a (heap) dump doesn't contain hashes that are faster to crack than bcrypt.
+		verified map[string][sha256.Size]byte
+		// Key of the verified HMACs.
+		key []byte
+		// Checksum of the file content that is loaded.
+		checksum [sha256.Size]byte
+	}
+)
+
+// Errors
+var (
+	ErrBasicInvalid = echo.NewHTTPError(http.StatusUnauthorized, "Invalid username or password")
+)
+
+var (
+	// DefaultBasicAuthConfig is the default BasicAuth middleware config.
+	DefaultBasicAuthConfig = BasicAuthConfig{
+		Skipper: middleware.DefaultSkipper,
+		Realm:   "apigw",
+	}
+
+	// DummyHash is compared when a user is unknown so the response time doesn't reveal which users exist.
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+)
+
+// BasicAuthWithConfig returns a BasicAuth middleware with config.
+// Invalid credentials result in Unauthorized. A WWW-Authenticate Basic challenge is added to Unauthorized responses
+// of operations that accept basic credentials.
+// The username of a satisfied scheme is added to the "Schemes" context value (map of scheme name to client id).
+// See: `BasicAuthConfig`.
+func BasicAuthWithConfig(config BasicAuthConfig) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultBasicAuthConfig.Skipper
+	}
+	if config.Operation == nil {
+		panic("echo: BasicAuth middleware requires an Operation function.")
+	}
+	if config.Store == nil {
+		panic("echo: BasicAuth middleware requires a Store.")
+	}
+	if config.Realm == "" {
+		config.Realm = DefaultBasicAuthConfig.Realm
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			op, err := operation(c, config.Operation)
+			if err != nil {
+				return err
+			}
+			if op == nil {
+				return next(c)
+			}
+			var schemes []string
+			for _, req := range op.Security {
+				for _, s := range req.Schemes {
+					if s.Type == path.SchemeTypeBasic {
+						schemes = append(schemes, s.Name)
+					}
+				}
+			}
+			if len(schemes) == 0 {
+				return next(c)
+			}
+
+			req := c.Request()
+			user, password, ok := req.BasicAuth()
+			if ok {
+				if !config.Store.Verify(user, password) {
+					glog.V(2).Infof("%s %s: invalid credentials for user %s", req.Method, req.URL.Path, user)
+					return basicChallenge(c, ErrBasicInvalid, config.Realm)
+				}
+				// the password isn't forwarded upstream.
+				req.Header.Del(echo.HeaderAuthorization)
+
+				satisfied, _ := c.Get("Schemes").(map[string]string)
+				if satisfied == nil {
+					satisfied = map[string]string{}
+				}
+				for _, n := range schemes {
+					satisfied[n] = user
+				}
+				c.Set("Schemes", satisfied)
+			}
+
+			err = next(c)
+			if he, ok := err.(*echo.HTTPError); ok && he.Code == http.StatusUnauthorized {
+				// the client may retry with basic credentials.
+				return basicChallenge(c, err, config.Realm)
+			}
+			return err
+		}
+	}
+}
+
+// BasicChallenge adds a WWW-Authenticate Basic challenge for realm and returns err.
+func basicChallenge(c echo.Context, err error, realm string) error {
+	c.Response().Header().Add(echo.HeaderWWWAuthenticate, fmt.Sprintf(`Basic realm="%s"`, realm))
+	return err
+}
+
+// NewHtpasswdStore returns a store with the users read from file.
+func NewHtpasswdStore(file string) (*HtpasswdStore, error) {
+	key := make([]byte, sha256.Size)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &HtpasswdStore{file: file, key: key}
+	err = s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run reloads the htpasswd file periodically until ctx is done.
+func (s *HtpasswdStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := s.Reload()
+			if err != nil {
+				glog.Error("htpasswd reload: ", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reload reads the htpasswd file and replaces the current users when the content has changed.
+// Only bcrypt hashes are accepted.
+// On error the current users remain in use.
+func (s *HtpasswdStore) Reload() error {
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	cs := sha256.Sum256(b)
+	s.mutex.RLock()
+	same := cs == s.checksum && s.users != nil
+	s.mutex.RUnlock()
+	if same {
+		return nil
+	}
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return fmt.Errorf("%s: line %d: expected user:hash", s.file, n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("%s: line %d: user %s: password must be bcrypt hashed", s.file, n, user)
+		}
+		if _, ok := users[user]; ok {
+			return fmt.Errorf("%s: line %d: duplicate user %s", s.file, n, user)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", s.file, err)
+	}
+
+	s.mutex.Lock()
+	s.users = users
+	s.verified = map[string][sha256.Size]byte{}
+	s.checksum = cs
+	s.mutex.Unlock()
+	glog.Infof("htpasswd %s: loaded %d users", s.file, len(users))
+
+	return nil
+}
+
+// Verify returns true if password is the password of user.
+func (s *HtpasswdStore) Verify(user, password string) bool {
+	ph := s.mac(password)
+	s.mutex.RLock()
+	hash, ok := s.users[user]
+	v, verified := s.verified[user]
+	s.mutex.RUnlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	if verified && subtle.ConstantTimeCompare(v[:], ph[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	s.mutex.Lock()
+	// the users might have been reloaded in the mean time.
+	if h, ok := s.users[user]; ok && bytes.Equal(h, hash) {
+		s.verified[user] = ph
+	}
+	s.mutex.Unlock()
+	return true
+}
+
+// Mac returns the HMAC-SHA256 of password with the key of the store.
+func (s *HtpasswdStore) mac(password string) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(password))
+	copy(sum[:], m.Sum(nil))
+	return sum
+}
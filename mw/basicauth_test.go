@@ -0,0 +1,135 @@
+package mw
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// TestBasicAuth shows that basic credentials satisfy basic schemes and that they can be combined with OAuth2
+// alternatives.
+func TestBasicAuth(t *testing.T) {
+	file := writeKeyStore(t, "# tooling users\n"+htpasswdLine("alice", "secret"))
+	defer os.Remove(file)
+	store, err := NewHtpasswdStore(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	basic := path.Requirements{{Schemes: []path.Scheme{{Name: "tooling", Type: path.SchemeTypeBasic}}}}
+	basicOrToken := path.Requirements{{Scopes: path.Scopes{"admin"}}, {Schemes: []path.Scheme{{Name: "tooling", Type: path.SchemeTypeBasic}}}}
+	var tests = []struct {
+		required      path.Requirements
+		authorization string
+		want          int
+		clientID      string
+		challenge     []string
+		info          string
+	}{
+		{required: basic, authorization: basicAuth("alice", "secret"), want: http.StatusOK, clientID: "alice", info: "valid credentials"},
+		{required: basic, authorization: basicAuth("alice", "wrong"), want: http.StatusUnauthorized, challenge: []string{`Basic realm="tools"`}, info: "wrong password"},
+		{required: basic, authorization: basicAuth("bob", "secret"), want: http.StatusUnauthorized, challenge: []string{`Basic realm="tools"`}, info: "unknown user"},
+		{required: basic, want: http.StatusUnauthorized, challenge: []string{"Bearer", `Basic realm="tools"`}, info: "missing credentials"},
+		{required: basicOrToken, authorization: basicAuth("alice", "secret"), want: http.StatusOK, clientID: "alice", info: "basic alternative"},
+		{required: basicOrToken, authorization: "Bearer value-not-important", want: http.StatusOK, clientID: "tokenclient", info: "token alternative"},
+		{required: basicOrToken, want: http.StatusUnauthorized, challenge: []string{"Bearer", `Basic realm="tools"`}, info: "both challenges"},
+		{required: path.Requirements{{Scopes: path.Scopes{"admin"}}}, authorization: basicAuth("alice", "secret"), want: http.StatusUnauthorized, challenge: []string{"Bearer"}, info: "no basic scheme"},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest(echo.POST, "/jobs", nil)
+		if tst.authorization != "" {
+			req.Header.Set("Authorization", tst.authorization)
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		opFn := func(method string, url *url.URL) (*path.Operation, error) {
+			return &path.Operation{Method: method, Path: "/jobs", Security: tst.required}, nil
+		}
+		basicAuth := BasicAuthWithConfig(BasicAuthConfig{Operation: opFn, Store: store, Realm: "tools"})
+		oauth2 := OAuth2WithConfig(OAuth2Config{
+			Operation: opFn,
+			Tokeninfo: func(token string) (*TokeninfoResponse, error) {
+				return &TokeninfoResponse{ClientID: "tokenclient", Scopes: map[string]struct{}{"admin": {}}, ExpiresIn: 10}, nil
+			},
+		})
+		var upstream *http.Request
+		h := basicAuth(oauth2(func(c echo.Context) error {
+			upstream = c.Request()
+			return c.String(http.StatusOK, "test")
+		}))
+
+		err := h(c)
+		if err != nil {
+			assert.Equal(t, tst.want, err.(*echo.HTTPError).Code, tst.info)
+			assert.Equal(t, tst.challenge, rec.Header()["Www-Authenticate"], tst.info)
+			continue
+		}
+		assert.Equal(t, tst.want, c.Response().Status, tst.info)
+		assert.Equal(t, tst.clientID, c.Get("ClientID"), tst.info)
+		if tst.clientID == "alice" {
+			// the password is not forwarded
+			assert.Equal(t, "", upstream.Header.Get("Authorization"), tst.info)
+		}
+	}
+}
+
+// TestHtpasswdStoreReload shows that changes to the htpasswd file are picked up and that an invalid file doesn't
+// replace the current users.
+func TestHtpasswdStoreReload(t *testing.T) {
+	file := writeKeyStore(t, htpasswdLine("alice", "secret"))
+	defer os.Remove(file)
+	store, err := NewHtpasswdStore(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, store.Verify("alice", "secret"))
+	assert.True(t, store.Verify("alice", "secret"), "verified before")
+	assert.False(t, store.Verify("alice", "other"))
+	// the cache doesn't contain an unsalted hash of the password.
+	assert.NotEqual(t, sha256.Sum256([]byte("secret")), store.verified["alice"])
+	other, _ := NewHtpasswdStore(file)
+	assert.NotEqual(t, other.mac("secret"), store.mac("secret"), "random key")
+
+	// change password
+	err = ioutil.WriteFile(file, []byte(htpasswdLine("alice", "other")), 0600)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Reload())
+	assert.False(t, store.Verify("alice", "secret"))
+	assert.True(t, store.Verify("alice", "other"))
+
+	// invalid content
+	for _, content := range []string{
+		"alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n",
+		"alice\n",
+		htpasswdLine("alice", "a") + htpasswdLine("alice", "b"),
+	} {
+		err = ioutil.WriteFile(file, []byte(content), 0600)
+		assert.NoError(t, err)
+		assert.Error(t, store.Reload(), content)
+		assert.True(t, store.Verify("alice", "other"), content)
+	}
+}
+
+// HtpasswdLine returns a htpasswd line for user with a bcrypt hashed password.
+func htpasswdLine(user, password string) string {
+	h, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	return fmt.Sprintf("%s:%s\n", user, h)
+}
+
+// BasicAuth returns an Authorization header value with basic credentials.
+func basicAuth(user, password string) string {
+	r := &http.Request{Header: http.Header{}}
+	r.SetBasicAuth(user, password)
+	return r.Header.Get("Authorization")
+}
@@ -0,0 +1,145 @@
+package mw
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"hash/crc32"
+	"math/rand"
+	"sync/atomic"
+)
+
+/*
+	Canary traffic splitting between target pools.
+
+	A canary takes requests that are routed to its pool and sends them to the canary pool when:
+	- the request has the canary header
+	- the ClientID of the request is on the canary list
+	- the client falls in the Weight percentage
+	Clients are assigned by hashing their sticky key so a client stays on the same pool, raising the weight only moves
+	clients from the pool to the canary pool.
+*/
+
+type (
+	// CanaryConfig defines a canary.
+	CanaryConfig struct {
+		// Pool is the pool that requests are taken from.
+		// Required.
+		Pool string
+		// Canary is the pool that requests are sent to.
+		// Required.
+		Canary string
+		// Weight is the percentage (0-100) of clients that is sent to Canary.
+		// Optional.
+		Weight int
+		// Header sends requests with this header to Canary.
+		// Optional.
+		Header string
+		// HeaderValue is the value Header must have, when empty any value matches.
+		// Optional.
+		HeaderValue string
+		// ClientIDs are sent to Canary.
+		// Optional.
+		ClientIDs []string
+		// StickyKey returns the key that assigns a client to a pool, when it returns "" the request is assigned
+		// randomly.
+		// Optional. Default value HashByClientID().
+		StickyKey HashKeyFunc
+	}
+
+	// Canary splits traffic between a pool and a canary pool.
+	Canary struct {
+		config    CanaryConfig
+		clientIDs map[string]bool
+		// weight is accessed atomically.
+		weight int32
+	}
+
+	// CanaryStatus is the state of a canary.
+	CanaryStatus struct {
+		Pool   string `json:"pool"`
+		Canary string `json:"canary"`
+		// Weight is the effective weight.
+		Weight int `json:"weight"`
+		// ConfiguredWeight is the weight of the config, it differs from Weight when the weight is set at runtime.
+		ConfiguredWeight int `json:"configuredWeight"`
+	}
+)
+
+// NewCanary returns a canary.
+func NewCanary(config CanaryConfig) (*Canary, error) {
+	if config.Pool == "" || config.Canary == "" {
+		return nil, fmt.Errorf("canary requires pool and canary")
+	}
+	if config.Pool == config.Canary {
+		return nil, fmt.Errorf("canary pool %q must differ from pool", config.Canary)
+	}
+	// Defaults
+	if config.StickyKey == nil {
+		config.StickyKey = HashByClientID()
+	}
+
+	cn := &Canary{config: config, clientIDs: map[string]bool{}}
+	for _, id := range config.ClientIDs {
+		cn.clientIDs[id] = true
+	}
+	err := cn.SetWeight(config.Weight)
+	if err != nil {
+		return nil, err
+	}
+	return cn, nil
+}
+
+// Weight returns the percentage of clients that is sent to the canary pool.
+func (cn *Canary) Weight() int {
+	return int(atomic.LoadInt32(&cn.weight))
+}
+
+// SetWeight changes the percentage of clients that is sent to the canary pool.
+func (cn *Canary) SetWeight(weight int) error {
+	if weight < 0 || weight > 100 {
+		return fmt.Errorf("canary weight %d must be between 0 and 100", weight)
+	}
+	atomic.StoreInt32(&cn.weight, int32(weight))
+	return nil
+}
+
+// Status returns the state of the canary.
+func (cn *Canary) Status() CanaryStatus {
+	return CanaryStatus{Pool: cn.config.Pool, Canary: cn.config.Canary, Weight: cn.Weight(), ConfiguredWeight: cn.config.Weight}
+}
+
+// CopyWeight takes the weight of from when it's the same canary with the same configured weight, so a weight that is
+// set at runtime survives a rebuild from unchanged config. It returns true when the weight is copied.
+func (cn *Canary) CopyWeight(from *Canary) bool {
+	if from.config.Pool != cn.config.Pool || from.config.Canary != cn.config.Canary || from.config.Weight != cn.config.Weight {
+		return false
+	}
+	atomic.StoreInt32(&cn.weight, int32(from.Weight()))
+	return true
+}
+
+// Selects returns true when the request is sent to the canary pool.
+func (cn *Canary) selects(c echo.Context) bool {
+	if h := cn.config.Header; h != "" {
+		v := c.Request().Header.Get(h)
+		if v != "" && (cn.config.HeaderValue == "" || v == cn.config.HeaderValue) {
+			return true
+		}
+	}
+	if id, ok := c.Get("ClientID").(string); ok && cn.clientIDs[id] {
+		return true
+	}
+
+	w := cn.Weight()
+	switch {
+	case w <= 0:
+		return false
+	case w >= 100:
+		return true
+	}
+	key := cn.config.StickyKey(c)
+	if key == "" {
+		return rand.Intn(100) < w
+	}
+	return int(crc32.ChecksumIEEE([]byte(cn.config.Pool+"/"+key))%100) < w
+}
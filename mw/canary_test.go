@@ -0,0 +1,104 @@
+package mw
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestCanary shows that requests with the canary header or ClientID and a sticky percentage of clients are selected.
+func TestCanary(t *testing.T) {
+	e := echo.New()
+	context := func(clientID, header string) echo.Context {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		if header != "" {
+			req.Header.Set("X-Canary", header)
+		}
+		c := e.NewContext(req, nil)
+		if clientID != "" {
+			c.Set("ClientID", clientID)
+		}
+		return c
+	}
+	cn, err := NewCanary(CanaryConfig{Pool: "stable", Canary: "canary", Header: "X-Canary", HeaderValue: "always", ClientIDs: []string{"tester"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var tests = []struct {
+		clientID string
+		header   string
+		want     bool
+		info     string
+	}{
+		{clientID: "app1", want: false, info: "weight 0"},
+		{clientID: "app1", header: "always", want: true, info: "header"},
+		{clientID: "app1", header: "never", want: false, info: "other header value"},
+		{clientID: "tester", want: true, info: "client id"},
+	}
+	for _, tst := range tests {
+		assert.Equal(t, tst.want, cn.selects(context(tst.clientID, tst.header)), tst.info)
+	}
+
+	assert.Error(t, cn.SetWeight(101))
+	assert.Error(t, cn.SetWeight(-1))
+	assert.NoError(t, cn.SetWeight(100))
+	assert.True(t, cn.selects(context("app1", "")), "weight 100")
+
+	// a percentage of the clients is selected, raising the weight keeps them selected.
+	selected := map[string]bool{}
+	assert.NoError(t, cn.SetWeight(20))
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("app%d", i)
+		if cn.selects(context(id, "")) {
+			selected[id] = true
+		}
+		assert.Equal(t, selected[id], cn.selects(context(id, "")), "sticky %s", id)
+	}
+	assert.InDelta(t, 200, len(selected), 50, "20%")
+	assert.NoError(t, cn.SetWeight(50))
+	for id := range selected {
+		assert.True(t, cn.selects(context(id, "")), "%s stays selected", id)
+	}
+	assert.Equal(t, CanaryStatus{Pool: "stable", Canary: "canary", Weight: 50}, cn.Status())
+
+	// the weight is copied to the same canary.
+	same, _ := NewCanary(CanaryConfig{Pool: "stable", Canary: "canary"})
+	assert.True(t, same.CopyWeight(cn))
+	assert.Equal(t, 50, same.Weight())
+	changed, _ := NewCanary(CanaryConfig{Pool: "stable", Canary: "canary", Weight: 10})
+	assert.False(t, changed.CopyWeight(cn), "configured weight changed")
+	assert.Equal(t, 10, changed.Weight())
+
+	_, err = NewCanary(CanaryConfig{Pool: "stable", Canary: "stable"})
+	assert.Error(t, err, "same pool")
+	_, err = NewCanary(CanaryConfig{Pool: "stable", Canary: "canary", Weight: 200})
+	assert.Error(t, err, "weight")
+}
+
+// TestPoolBalancerCanary shows that a canary takes requests of its pool only.
+func TestPoolBalancerCanary(t *testing.T) {
+	pools := map[string]ProxyBalancer{}
+	for _, name := range []string{"monolith", "accounts", "accounts-v2"} {
+		pools[name] = NewRoundRobinBalancer([]*ProxyTarget{{Pool: name, URL: &url.URL{Scheme: "http", Host: name}}})
+	}
+	cn, _ := NewCanary(CanaryConfig{Pool: "accounts", Canary: "accounts-v2", Weight: 100})
+	b := NewPoolBalancer(PoolBalancerConfig{
+		Pools:    pools,
+		Default:  "monolith",
+		Routes:   []PoolRoute{{PathPrefix: "/accounts", Pool: "accounts"}},
+		Canaries: []*Canary{cn},
+	})
+
+	e := echo.New()
+	for p, want := range map[string]string{"/accounts": "accounts-v2", "/other": "monolith"} {
+		c := e.NewContext(httptest.NewRequest(echo.GET, p, nil), nil)
+		assert.Equal(t, want, b.Next(c).Pool, p)
+	}
+	cn.SetWeight(0)
+	c := e.NewContext(httptest.NewRequest(echo.GET, "/accounts", nil), nil)
+	assert.Equal(t, "accounts", b.Next(c).Pool, "weight changed at runtime")
+}
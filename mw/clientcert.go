@@ -0,0 +1,128 @@
+package mw
+
+/*
+	ClientCert middleware maps a verified TLS client certificate to a ClientID and enforces client certificates for
+	operations that require them.
+
+	Certificates are verified by the TLS server against the configured CA bundle, this middleware only uses the
+	result of that verification.
+
+	See https://tools.ietf.org/html/rfc8705 (a later step is to support certificate-bound access tokens)
+*/
+
+import (
+	"crypto/x509"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+)
+
+type (
+	// ClientCertConfig defines the config for ClientCert middleware.
+	ClientCertConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper middleware.Skipper
+
+		// Operation is an optional function that gets the operation for a path.
+		// When set, operations that require a client certificate are Forbidden without one.
+		Operation OperationFunc
+
+		// ClientID is the certificate field that becomes the ClientID; cn (subject common name), subject, dns, uri or
+		// email (the first subject alternative name of that type).
+		// Optional. Default value cn.
+		ClientID string
+	}
+)
+
+// Errors
+var (
+	ErrClientCertRequired = echo.NewHTTPError(http.StatusForbidden, "Client certificate required")
+)
+
+var (
+	// DefaultClientCertConfig is the default ClientCert middleware config.
+	DefaultClientCertConfig = ClientCertConfig{
+		Skipper:  middleware.DefaultSkipper,
+		ClientID: "cn",
+	}
+)
+
+// ClientCert returns a ClientCert middleware.
+func ClientCert() echo.MiddlewareFunc {
+	return ClientCertWithConfig(DefaultClientCertConfig)
+}
+
+// ClientCertWithConfig returns a ClientCert middleware with config.
+// The verified certificate is added to context as "ClientCert" and the ClientID that is derived from it as "ClientID".
+// Authentication by the middleware that follows (OAuth2) replaces the ClientID.
+// See: `ClientCertConfig`.
+func ClientCertWithConfig(config ClientCertConfig) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultClientCertConfig.Skipper
+	}
+	if config.ClientID == "" {
+		config.ClientID = DefaultClientCertConfig.ClientID
+	}
+	switch config.ClientID {
+	case "cn", "subject", "dns", "uri", "email":
+	default:
+		panic("echo: ClientCert middleware ClientID must be one of cn, subject, dns, uri or email.")
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			// only certificates that are verified against the CA bundle count.
+			var cert *x509.Certificate
+			if cs := c.Request().TLS; cs != nil && len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 0 {
+				cert = cs.VerifiedChains[0][0]
+				c.Set("ClientCert", cert)
+				if id := certClientID(cert, config.ClientID); id != "" {
+					c.Set("ClientID", id)
+				}
+			}
+
+			if config.Operation != nil {
+				op, err := operation(c, config.Operation)
+				if err != nil {
+					return err
+				}
+				if op != nil && op.ClientCert && cert == nil {
+					return ErrClientCertRequired
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// CertClientID returns the value of field of cert or "" if there is none.
+func certClientID(cert *x509.Certificate, field string) string {
+	first := func(ss []string) string {
+		if len(ss) == 0 {
+			return ""
+		}
+		return ss[0]
+	}
+	switch field {
+	case "cn":
+		return cert.Subject.CommonName
+	case "subject":
+		return cert.Subject.String()
+	case "dns":
+		return first(cert.DNSNames)
+	case "uri":
+		if len(cert.URIs) == 0 {
+			return ""
+		}
+		return cert.URIs[0].String()
+	case "email":
+		return first(cert.EmailAddresses)
+	}
+	return ""
+}
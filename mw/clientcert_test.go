@@ -0,0 +1,62 @@
+package mw
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestClientCert shows that a verified client certificate is mapped to a ClientID and that operations can require
+// a client certificate.
+func TestClientCert(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/app3")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "app1", Organization: []string{"Example"}},
+		DNSNames:       []string{"app2.example.com"},
+		URIs:           []*url.URL{spiffe},
+		EmailAddresses: []string{"app4@example.com"},
+	}
+	var tests = []struct {
+		state      *tls.ConnectionState
+		clientID   string
+		clientCert bool
+		want       interface{}
+		wantErr    error
+		info       string
+	}{
+		{state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, clientID: "cn", want: "app1", info: "common name"},
+		{state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, clientID: "subject", want: "CN=app1,O=Example", info: "subject"},
+		{state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, clientID: "dns", want: "app2.example.com", info: "dns"},
+		{state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, clientID: "uri", want: "spiffe://example.com/app3", info: "uri"},
+		{state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, clientID: "email", clientCert: true, want: "app4@example.com", info: "email, required"},
+		{state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, want: nil, info: "unverified certificate"},
+		{state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, clientCert: true, wantErr: ErrClientCertRequired, info: "unverified certificate, required"},
+		{state: nil, clientCert: true, wantErr: ErrClientCertRequired, info: "no tls, required"},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest(echo.GET, "/jobs", nil)
+		req.TLS = tst.state
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		h := ClientCertWithConfig(ClientCertConfig{
+			Operation: func(method string, url *url.URL) (*path.Operation, error) {
+				return &path.Operation{ClientCert: tst.clientCert}, nil
+			},
+			ClientID: tst.clientID,
+		})(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})
+
+		err := h(c)
+		assert.Equal(t, tst.wantErr, err, tst.info)
+		assert.Equal(t, tst.want, c.Get("ClientID"), tst.info)
+	}
+}
@@ -0,0 +1,282 @@
+package mw
+
+/*
+	Active health checking of proxy targets.
+
+	A target is probed with a HTTP GET, a 2xx or 3xx response is a success. A target that fails UnhealthyThreshold
+	consecutive probes is taken out of balancer rotation, it's restored after HealthyThreshold consecutive successes.
+*/
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// HealthCheckConfig defines how a target is probed.
+	HealthCheckConfig struct {
+		// Path is the url path that is probed, relative to the target url.
+		Path string
+		// Interval between probes.
+		// Optional. Default value 10s.
+		Interval time.Duration
+		// Timeout of a probe.
+		// Optional. Default value 2s.
+		Timeout time.Duration
+		// HealthyThreshold is the number of consecutive successes that make an unhealthy target healthy.
+		// Optional. Default value 2.
+		HealthyThreshold int
+		// UnhealthyThreshold is the number of consecutive failures that make a healthy target unhealthy.
+		// Optional. Default value 3.
+		UnhealthyThreshold int
+	}
+
+	// TargetStatus is the health of a target.
+	TargetStatus struct {
+		Name    string `json:"name,omitempty"`
+		Pool    string `json:"pool,omitempty"`
+		URL     string `json:"url"`
+		Healthy bool   `json:"healthy"`
+		// Checked is false when the target isn't health checked.
+		Checked bool `json:"checked"`
+		// LastCheck is the time of the last probe.
+		LastCheck time.Time `json:"lastCheck,omitempty"`
+		// LastError is the error of the last probe or empty when it succeeded.
+		LastError string `json:"lastError,omitempty"`
+		// EjectedUntil is set when the target is ejected by outlier detection.
+		EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	}
+
+	// TargetHealth is the health check state of a target.
+	targetHealth struct {
+		mutex sync.Mutex
+		// successes and failures are the number of consecutive probe results.
+		successes int
+		failures  int
+		lastCheck time.Time
+		lastError string
+	}
+)
+
+var (
+	// DefaultHealthCheckConfig is the default health check config.
+	DefaultHealthCheckConfig = HealthCheckConfig{
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+)
+
+// Metrics
+var (
+	proxyTargetHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "apigw",
+			Subsystem: "proxy",
+			Name:      "target_healthy",
+			Help:      "Health of a proxy target (1 healthy, 0 unhealthy).",
+		}, []string{"target", "pool"})
+
+	// HealthGaugeOwners maps the labels of a proxyTargetHealthy series to the target whose health check sets it.
+	// On reload the health check of the new target starts before the one of the old target stops, only the owner
+	// sets and deletes the series.
+	healthGaugeOwners = map[[2]string]*ProxyTarget{}
+	healthGaugeMutex  sync.Mutex
+)
+
+func init() {
+	prometheus.MustRegister(proxyTargetHealthy)
+}
+
+// Healthy returns true when the target passes active health checks.
+func (t *ProxyTarget) Healthy() bool {
+	return t.down() == 0
+}
+
+// Status returns the health of the target.
+func (t *ProxyTarget) Status() TargetStatus {
+	s := TargetStatus{
+		Name:    t.Name,
+		Pool:    t.Pool,
+		URL:     t.URL.String(),
+		Healthy: t.Healthy(),
+		Checked: t.HealthCheck != nil,
+	}
+	if now := timeNow(); t.Ejected(now) {
+		until := time.Unix(0, atomic.LoadInt64(&t.outlier.ejectedUntil))
+		s.EjectedUntil = &until
+	}
+	t.health.mutex.Lock()
+	s.LastCheck = t.health.lastCheck
+	s.LastError = t.health.lastError
+	t.health.mutex.Unlock()
+	return s
+}
+
+// CopyHealth copies the active and passive health of from to t, it's used to keep the state of a target when the
+// config is reloaded.
+func (t *ProxyTarget) CopyHealth(from *ProxyTarget) {
+	t.setDown(from.down())
+	from.health.mutex.Lock()
+	t.health.mutex.Lock()
+	t.health.successes = from.health.successes
+	t.health.failures = from.health.failures
+	t.health.lastCheck = from.health.lastCheck
+	t.health.lastError = from.health.lastError
+	t.health.mutex.Unlock()
+	from.health.mutex.Unlock()
+
+	from.outlier.mutex.Lock()
+	t.outlier.mutex.Lock()
+	t.outlier.errors = from.outlier.errors
+	t.outlier.ejections = from.outlier.ejections
+	atomic.StoreInt64(&t.outlier.ejectedUntil, atomic.LoadInt64(&from.outlier.ejectedUntil))
+	t.outlier.mutex.Unlock()
+	from.outlier.mutex.Unlock()
+}
+
+// RunHealthCheck probes the target immediately and then periodically until ctx is done.
+// It does nothing when the target has no HealthCheck.
+func (t *ProxyTarget) RunHealthCheck(ctx context.Context) {
+	if t.HealthCheck == nil {
+		return
+	}
+	config := t.HealthCheck.withDefaults()
+	labels := [2]string{t.URL.String(), t.Pool}
+	healthGaugeMutex.Lock()
+	healthGaugeOwners[labels] = t
+	healthGaugeMutex.Unlock()
+	defer t.deleteHealthGauge(labels)
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	for {
+		healthy := t.CheckHealth()
+		t.setHealthGauge(labels, healthy)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetHealthGauge sets the proxyTargetHealthy series when t owns it.
+func (t *ProxyTarget) setHealthGauge(labels [2]string, healthy bool) {
+	healthGaugeMutex.Lock()
+	defer healthGaugeMutex.Unlock()
+	if healthGaugeOwners[labels] == t {
+		proxyTargetHealthy.WithLabelValues(labels[0], labels[1]).Set(boolGauge(healthy))
+	}
+}
+
+// DeleteHealthGauge deletes the proxyTargetHealthy series when t owns it, a series that is owned by the health check
+// of a newer target is kept.
+func (t *ProxyTarget) deleteHealthGauge(labels [2]string) {
+	healthGaugeMutex.Lock()
+	defer healthGaugeMutex.Unlock()
+	if healthGaugeOwners[labels] == t {
+		delete(healthGaugeOwners, labels)
+		proxyTargetHealthy.DeleteLabelValues(labels[0], labels[1])
+	}
+}
+
+// CheckHealth probes the target once, updates its health and returns true when it's healthy.
+func (t *ProxyTarget) CheckHealth() bool {
+	config := t.HealthCheck.withDefaults()
+	err := t.probe(config)
+
+	h := &t.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastCheck = timeNow()
+	if err != nil {
+		h.lastError = err.Error()
+		h.failures++
+		h.successes = 0
+		if t.Healthy() && h.failures >= config.UnhealthyThreshold {
+			glog.Warningf("proxy target %s is unhealthy: %v", t.URL, err)
+			t.setDown(1)
+		}
+	} else {
+		h.lastError = ""
+		h.successes++
+		h.failures = 0
+		if !t.Healthy() && h.successes >= config.HealthyThreshold {
+			glog.Infof("proxy target %s is healthy", t.URL)
+			t.setDown(0)
+		}
+	}
+	return t.Healthy()
+}
+
+// Probe performs a health check request.
+func (t *ProxyTarget) probe(config HealthCheckConfig) error {
+	u := *t.URL
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = singleJoiningSlash(u.Path, config.Path)
+	u.RawQuery = ""
+
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s status %d", u.Path, resp.StatusCode)
+	}
+	return nil
+}
+
+// WithDefaults returns c with defaults for the fields that aren't set.
+func (c *HealthCheckConfig) withDefaults() HealthCheckConfig {
+	r := *c
+	if r.Interval <= 0 {
+		r.Interval = DefaultHealthCheckConfig.Interval
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = DefaultHealthCheckConfig.Timeout
+	}
+	if r.HealthyThreshold <= 0 {
+		r.HealthyThreshold = DefaultHealthCheckConfig.HealthyThreshold
+	}
+	if r.UnhealthyThreshold <= 0 {
+		r.UnhealthyThreshold = DefaultHealthCheckConfig.UnhealthyThreshold
+	}
+	return r
+}
+
+// BoolGauge returns 1 for true and 0 for false.
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package mw
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCheckHealth shows that a target is taken out of rotation after UnhealthyThreshold failed probes and restored
+// after HealthyThreshold successful probes.
+func TestCheckHealth(t *testing.T) {
+	var status int32 = http.StatusOK
+	var path atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path.Store(r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL + "/api")
+	target := &ProxyTarget{URL: u, HealthCheck: &HealthCheckConfig{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 2}}
+
+	var tests = []struct {
+		status int32
+		want   bool
+		info   string
+	}{
+		{status: http.StatusOK, want: true, info: "ok"},
+		{status: http.StatusServiceUnavailable, want: true, info: "1st failure"},
+		{status: http.StatusServiceUnavailable, want: false, info: "2nd failure"},
+		{status: http.StatusFound, want: false, info: "1st success"},
+		{status: http.StatusOK, want: true, info: "2nd success"},
+	}
+	for _, tst := range tests {
+		atomic.StoreInt32(&status, tst.status)
+		assert.Equal(t, tst.want, target.CheckHealth(), tst.info)
+		assert.Equal(t, "/api/health", path.Load(), tst.info)
+	}
+
+	upstream.Close()
+	target.CheckHealth()
+	target.CheckHealth()
+	s := target.Status()
+	assert.False(t, s.Healthy, "closed")
+	assert.True(t, s.Checked, "closed")
+	assert.NotEmpty(t, s.LastError, "closed")
+}
+
+// TestHealthGauge shows that the health check of an old target doesn't delete the series of a newer target with the
+// same url and pool.
+func TestHealthGauge(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	run := func(target *ProxyTarget) (context.CancelFunc, chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			target.RunHealthCheck(ctx)
+			close(done)
+		}()
+		return cancel, done
+	}
+	// waitGauge waits until the series has value want, -1 means not present.
+	waitGauge := func(want float64, info string) {
+		for i := 0; i < 100 && healthGauge(upstream.URL, "default") != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, want, healthGauge(upstream.URL, "default"), info)
+	}
+
+	old := &ProxyTarget{URL: u, Pool: "default", HealthCheck: &HealthCheckConfig{Path: "/health"}}
+	cancelOld, oldDone := run(old)
+	waitGauge(1, "old")
+
+	// reload
+	cur := &ProxyTarget{URL: u, Pool: "default", HealthCheck: &HealthCheckConfig{Path: "/health"}}
+	cancelCur, curDone := run(cur)
+	for i := 0; i < 100 && !ownsHealthGauge(cur); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancelOld()
+	<-oldDone
+	assert.Equal(t, float64(1), healthGauge(upstream.URL, "default"), "old stopped")
+
+	// target removed
+	cancelCur()
+	<-curDone
+	assert.Equal(t, float64(-1), healthGauge(upstream.URL, "default"), "removed")
+}
+
+// HealthGauge returns the value of the proxyTargetHealthy series or -1 when it isn't present.
+func healthGauge(target, pool string) float64 {
+	mfs, _ := prometheus.DefaultGatherer.Gather()
+	for _, mf := range mfs {
+		if mf.GetName() != "apigw_proxy_target_healthy" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["target"] == target && labels["pool"] == pool {
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	return -1
+}
+
+// OwnsHealthGauge returns true when the health check of t sets its series.
+func ownsHealthGauge(t *ProxyTarget) bool {
+	healthGaugeMutex.Lock()
+	defer healthGaugeMutex.Unlock()
+	return healthGaugeOwners[[2]string{t.URL.String(), t.Pool}] == t
+}
+
+// TestBalancerHealth shows that the balancers skip unhealthy targets and that the proxy responds with 503 when no
+// target is healthy.
+func TestBalancerHealth(t *testing.T) {
+	u1, _ := url.Parse("http://one")
+	u2, _ := url.Parse("http://two")
+	one := &ProxyTarget{URL: u1}
+	two := &ProxyTarget{URL: u2}
+	two.setDown(1)
+	targets := []*ProxyTarget{one, two}
+
+	c := echo.New().NewContext(nil, nil)
+	for _, b := range []ProxyBalancer{NewRoundRobinBalancer(targets), NewRandomBalancer(targets)} {
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, one, b.Next(c))
+		}
+	}
+
+	one.setDown(1)
+	e := echo.New()
+	e.Use(Proxy(NewRoundRobinBalancer(targets)))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(echo.GET, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,149 @@
+package mw
+
+/*
+	Identity middleware forwards the identity that is verified by the OAuth2 (or APIKey) middleware to the upstream
+	service so the service doesn't need to call the IDP itself.
+
+	Incoming copies of the identity headers are always removed, also for public operations, so clients can't forge them.
+*/
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// IdentityConfig defines the request headers that carry the verified identity.
+	// Headers with an empty name are not set.
+	IdentityConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper middleware.Skipper
+
+		// ClientIDHeader is the name of the header that gets the OAuth2 ClientID, for example X-Client-Id.
+		ClientIDHeader string
+
+		// ScopesHeader is the name of the header that gets the space-delimited granted scopes, for example X-Scopes.
+		ScopesHeader string
+
+		// Fields maps header names to tokeninfo response fields, for example X-User-Id: uid
+		Fields map[string]string
+	}
+)
+
+var (
+	// DefaultIdentityConfig is the default Identity middleware config.
+	DefaultIdentityConfig = IdentityConfig{
+		Skipper:        middleware.DefaultSkipper,
+		ClientIDHeader: "X-Client-Id",
+		ScopesHeader:   "X-Scopes",
+	}
+)
+
+// Identity returns an Identity middleware.
+func Identity() echo.MiddlewareFunc {
+	return IdentityWithConfig(DefaultIdentityConfig)
+}
+
+// IdentityWithConfig returns an Identity middleware with config.
+// It must be placed after the OAuth2 middleware.
+// See: `IdentityConfig`.
+func IdentityWithConfig(config IdentityConfig) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultIdentityConfig.Skipper
+	}
+
+	// Canonical names of all headers that are set by this middleware.
+	var names []string
+	for _, n := range []string{config.ClientIDHeader, config.ScopesHeader} {
+		if n != "" {
+			names = append(names, http.CanonicalHeaderKey(n))
+		}
+	}
+	for n := range config.Fields {
+		names = append(names, http.CanonicalHeaderKey(n))
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			// Remove incoming copies.
+			h := c.Request().Header
+			for _, n := range names {
+				h.Del(n)
+			}
+
+			ti, ok := c.Get("Tokeninfo").(*TokeninfoResponse)
+			if !ok {
+				// client verified by an API key or no verified identity (public operation)
+				if id, ok := c.Get("ClientID").(string); ok && config.ClientIDHeader != "" && id != "" {
+					h.Set(config.ClientIDHeader, headerValue(id))
+				}
+				return next(c)
+			}
+
+			if config.ClientIDHeader != "" && ti.ClientID != "" {
+				h.Set(config.ClientIDHeader, headerValue(ti.ClientID))
+			}
+			if config.ScopesHeader != "" {
+				h.Set(config.ScopesHeader, strings.Join(ti.scopes(), " "))
+			}
+			for n, f := range config.Fields {
+				if v, ok := ti.Extra[f]; ok && v != nil {
+					h.Set(n, headerValue(v))
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Scopes returns the granted scopes in a stable order.
+func (r *TokeninfoResponse) scopes() []string {
+	if len(r.Scope) > 0 {
+		return r.Scope
+	}
+	ss := make([]string, 0, len(r.Scopes))
+	for s := range r.Scopes {
+		ss = append(ss, s)
+	}
+	sort.Strings(ss)
+	return ss
+}
+
+// HeaderValue returns v as a string that is safe to use as header value.
+// Arrays are space-delimited.
+func headerValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case float64:
+		// json numbers
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, i := range v {
+			ss = append(ss, fmt.Sprint(i))
+		}
+		s = strings.Join(ss, " ")
+	default:
+		s = fmt.Sprint(v)
+	}
+	// control characters could be used to inject headers.
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,78 @@
+package mw
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestIdentity shows that the verified identity is forwarded and that incoming identity headers are removed.
+func TestIdentity(t *testing.T) {
+	config := IdentityConfig{
+		ClientIDHeader: "X-Client-Id",
+		ScopesHeader:   "X-Scopes",
+		Fields:         map[string]string{"X-User-Id": "uid", "X-Realm": "realm", "X-Auth-Time": "auth_time"},
+	}
+	var tests = []struct {
+		tokeninfo *TokeninfoResponse
+		clientID  string
+		want      map[string]string
+		info      string
+	}{
+		{
+			tokeninfo: nil,
+			want:      map[string]string{"X-Client-Id": "", "X-Scopes": "", "X-User-Id": "", "X-Realm": "", "X-Auth-Time": ""},
+			info:      "public operation, spoofed headers removed",
+		},
+		{
+			tokeninfo: &TokeninfoResponse{
+				ClientID: "client1",
+				Scope:    []string{"read", "write"},
+				Extra:    map[string]interface{}{"uid": "user1", "auth_time": float64(1546344000)},
+			},
+			want: map[string]string{"X-Client-Id": "client1", "X-Scopes": "read write", "X-User-Id": "user1", "X-Realm": "", "X-Auth-Time": "1546344000"},
+			info: "verified identity",
+		},
+		{
+			tokeninfo: &TokeninfoResponse{
+				ClientID: "client1\r\nX-Admin: true",
+				Scopes:   map[string]struct{}{"write": {}, "read": {}},
+			},
+			want: map[string]string{"X-Client-Id": "client1X-Admin: true", "X-Scopes": "read write", "X-User-Id": ""},
+			info: "control characters removed, scopes from map",
+		},
+		{
+			clientID: "client2",
+			want:     map[string]string{"X-Client-Id": "client2", "X-Scopes": "", "X-User-Id": ""},
+			info:     "client verified by api key",
+		},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		for _, h := range []string{"X-Client-Id", "X-Scopes", "x-user-id", "X-Realm", "X-Auth-Time"} {
+			req.Header.Set(h, "spoofed")
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		if tst.tokeninfo != nil {
+			c.Set("Tokeninfo", tst.tokeninfo)
+		}
+		if tst.clientID != "" {
+			c.Set("ClientID", tst.clientID)
+		}
+
+		var got http.Header
+		h := IdentityWithConfig(config)(func(c echo.Context) error {
+			got = c.Request().Header
+			return nil
+		})
+		assert.NoError(t, h(c), tst.info)
+
+		for k, v := range tst.want {
+			assert.Equal(t, v, got.Get(k), "%s: %s", tst.info, k)
+		}
+	}
+}
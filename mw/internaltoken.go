@@ -0,0 +1,287 @@
+package mw
+
+/*
+	InternalToken middleware adds a short-lived JWT signed by the gateway to the upstream request.
+
+	The JWT carries the verified client_id and scopes, the matched operation and the request id so upstream services
+	can verify that a request passed through the gateway. The public key is published as a JWKS document.
+
+	See https://tools.ietf.org/html/rfc7519 (JWT) and https://tools.ietf.org/html/rfc7638 (JWK thumbprint)
+*/
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/mmlt/apigw/path"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+type (
+	// InternalTokenConfig defines the config for InternalToken middleware.
+	InternalTokenConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper middleware.Skipper
+
+		// Key signs the tokens.
+		// Required.
+		Key *SigningKey
+
+		// Header is the name of the request header that gets the token.
+		// Optional. Default value X-Apigw-Token.
+		Header string
+
+		// Replace the caller's token; the token is sent as 'Authorization: Bearer <token>' instead of in Header.
+		Replace bool
+
+		// TTL is the lifetime of a token.
+		// Optional. Default value 1 minute.
+		TTL time.Duration
+
+		// Issuer is the value of the 'iss' claim.
+		// Optional. Default value apigw.
+		Issuer string
+
+		// Audience is the value of the 'aud' claim.
+		// Optional, when empty there is no 'aud' claim.
+		Audience string
+	}
+
+	// SigningKey is a private key that signs tokens.
+	SigningKey struct {
+		// Kid is the JWK thumbprint of the public key.
+		Kid string
+		// key is a *rsa.PrivateKey or *ecdsa.PrivateKey
+		key crypto.Signer
+		// method is the signing algorithm.
+		method jwt.SigningMethod
+	}
+
+	// JWKSet is a JSON Web Key Set document.
+	JWKSet struct {
+		Keys []map[string]string `json:"keys"`
+	}
+)
+
+var (
+	// DefaultInternalTokenConfig is the default InternalToken middleware config.
+	DefaultInternalTokenConfig = InternalTokenConfig{
+		Skipper: middleware.DefaultSkipper,
+		Header:  "X-Apigw-Token",
+		TTL:     time.Minute,
+		Issuer:  "apigw",
+	}
+)
+
+// InternalTokenWithConfig returns an InternalToken middleware with config.
+// It must be placed after the OAuth2 middleware.
+// See: `InternalTokenConfig`.
+func InternalTokenWithConfig(config InternalTokenConfig) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultInternalTokenConfig.Skipper
+	}
+	if config.Key == nil {
+		panic("echo: InternalToken middleware requires a Key.")
+	}
+	if config.Header == "" {
+		config.Header = DefaultInternalTokenConfig.Header
+	}
+	if config.TTL == 0 {
+		config.TTL = DefaultInternalTokenConfig.TTL
+	}
+	if config.Issuer == "" {
+		config.Issuer = DefaultInternalTokenConfig.Issuer
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) {
+				return next(c)
+			}
+
+			req := c.Request()
+			// Remove incoming copies.
+			req.Header.Del(config.Header)
+
+			// Make sure the request has an id that can be correlated with the upstream logs.
+			requestID := req.Header.Get(echo.HeaderXRequestID)
+			if requestID == "" {
+				requestID = newRequestID()
+				req.Header.Set(echo.HeaderXRequestID, requestID)
+			}
+
+			now := timeNow()
+			claims := jwt.MapClaims{
+				"iss":        config.Issuer,
+				"iat":        now.Unix(),
+				"exp":        now.Add(config.TTL).Unix(),
+				"request_id": requestID,
+			}
+			if config.Audience != "" {
+				claims["aud"] = config.Audience
+			}
+			if op, ok := c.Get("Operation").(*path.Operation); ok {
+				claims["operation"] = op.Name()
+			}
+			if ti, ok := c.Get("Tokeninfo").(*TokeninfoResponse); ok {
+				claims["sub"] = ti.ClientID
+				claims["client_id"] = ti.ClientID
+				claims["scope"] = strings.Join(ti.scopes(), " ")
+			} else if id, ok := c.Get("ClientID").(string); ok && id != "" {
+				// client verified by an API key
+				claims["sub"] = id
+				claims["client_id"] = id
+			}
+
+			token, err := config.Key.Sign(claims)
+			if err != nil {
+				return err
+			}
+			if config.Replace {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			} else {
+				req.Header.Set(config.Header, token)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// LoadSigningKey reads a PEM encoded RSA or EC private key (PKCS #1, SEC 1 or PKCS #8) from file.
+func LoadSigningKey(file string) (*SigningKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %q", file, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	return NewSigningKey(key)
+}
+
+// NewSigningKey returns a SigningKey for a *rsa.PrivateKey or *ecdsa.PrivateKey.
+func NewSigningKey(key interface{}) (*SigningKey, error) {
+	k := &SigningKey{}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		k.key = key
+		k.method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		k.key = key
+		switch key.Curve.Params().Name {
+		case "P-256":
+			k.method = jwt.SigningMethodES256
+		case "P-384":
+			k.method = jwt.SigningMethodES384
+		case "P-521":
+			k.method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	// The thumbprint is the hash of the required members of the JWK in lexicographic order.
+	jwk := k.JWK()
+	var members string
+	switch jwk["kty"] {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk["e"], jwk["n"])
+	case "EC":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk["crv"], jwk["x"], jwk["y"])
+	}
+	h := sha256.Sum256([]byte(members))
+	k.Kid = base64.RawURLEncoding.EncodeToString(h[:])
+
+	return k, nil
+}
+
+// Sign returns a signed JWT with claims.
+func (k *SigningKey) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.Kid
+	return token.SignedString(k.key)
+}
+
+// JWK returns the public key as JSON Web Key.
+func (k *SigningKey) JWK() map[string]string {
+	jwk := map[string]string{
+		"use": "sig",
+		"alg": k.method.Alg(),
+	}
+	if k.Kid != "" {
+		jwk["kid"] = k.Kid
+	}
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = pub.Curve.Params().Name
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(padLeft(pub.X.Bytes(), size))
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(padLeft(pub.Y.Bytes(), size))
+	}
+	return jwk
+}
+
+// NewJWKSet returns a JWKS document with the public keys.
+func NewJWKSet(keys ...*SigningKey) *JWKSet {
+	set := &JWKSet{Keys: []map[string]string{}}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.JWK())
+	}
+	return set
+}
+
+// PadLeft returns b with leading zeros so it has at least size bytes.
+func padLeft(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	p := make([]byte, size)
+	copy(p[size-len(b):], b)
+	return p
+}
+
+// NewRequestID returns a random request id.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,133 @@
+package mw
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestInternalToken shows that a signed token with identity, operation and request id is added to the request and
+// that it can be verified with the published JWKS.
+func TestInternalToken(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for _, key := range []interface{}{rsaKey, ecKey} {
+		sk, err := NewSigningKey(key)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(NewJWKSet(sk))
+		}))
+		verifier := NewJWTTokeninfo(JWTConfig{JWKSURL: srv.URL, Issuer: "apigw", Audience: "upstream"})
+		assert.NoError(t, verifier.Refresh())
+
+		var tests = []struct {
+			replace   bool
+			requestID string
+			tokeninfo *TokeninfoResponse
+			info      string
+		}{
+			{replace: false, requestID: "req1", tokeninfo: &TokeninfoResponse{ClientID: "client1", Scope: []string{"read"}}, info: "augment"},
+			{replace: true, requestID: "", tokeninfo: &TokeninfoResponse{ClientID: "client1", Scope: []string{"read"}}, info: "replace"},
+			{replace: false, requestID: "req3", tokeninfo: nil, info: "public operation"},
+		}
+		for _, tst := range tests {
+			req := httptest.NewRequest(echo.GET, "/pets/1", nil)
+			req.Header.Set("Authorization", "Bearer caller-token")
+			req.Header.Set("X-Apigw-Token", "spoofed")
+			if tst.requestID != "" {
+				req.Header.Set("X-Request-Id", tst.requestID)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("Operation", &path.Operation{Method: "GET", Path: "/pets/{id}", ID: "getPet"})
+			if tst.tokeninfo != nil {
+				c.Set("Tokeninfo", tst.tokeninfo)
+			}
+
+			var got http.Header
+			h := InternalTokenWithConfig(InternalTokenConfig{Key: sk, Replace: tst.replace, Audience: "upstream"})(func(c echo.Context) error {
+				got = c.Request().Header
+				return nil
+			})
+			if !assert.NoError(t, h(c), tst.info) {
+				continue
+			}
+
+			token := got.Get("X-Apigw-Token")
+			if tst.replace {
+				assert.Equal(t, "", token, tst.info)
+				token = got.Get("Authorization")[len("Bearer "):]
+			} else {
+				assert.Equal(t, "Bearer caller-token", got.Get("Authorization"), tst.info)
+			}
+			requestID := got.Get("X-Request-Id")
+			assert.NotEmpty(t, requestID, tst.info)
+
+			// Verify
+			ti, err := verifier.Call(token)
+			if !assert.NoError(t, err, tst.info) {
+				continue
+			}
+			assert.Equal(t, "getPet", ti.Extra["operation"], tst.info)
+			assert.Equal(t, requestID, ti.Extra["request_id"], tst.info)
+			if tst.tokeninfo != nil {
+				assert.Equal(t, "client1", ti.ClientID, tst.info)
+				assert.Equal(t, []string{"read"}, ti.Scope, tst.info)
+			} else {
+				assert.Equal(t, "", ti.ClientID, tst.info)
+			}
+		}
+		srv.Close()
+	}
+}
+
+// TestLoadSigningKey shows that PEM encoded keys are read.
+func TestLoadSigningKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+
+	var tests = []struct {
+		block *pem.Block
+		alg   string
+		err   bool
+	}{
+		{block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, alg: "RS256"},
+		{block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}, alg: "ES384"},
+		{block: &pem.Block{Type: "CERTIFICATE", Bytes: []byte{}}, err: true},
+	}
+	for _, tst := range tests {
+		f, err := ioutil.TempFile("", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pem.Encode(f, tst.block)
+		f.Close()
+
+		k, err := LoadSigningKey(f.Name())
+		os.Remove(f.Name())
+		if tst.err {
+			assert.Error(t, err, tst.block.Type)
+			continue
+		}
+		if assert.NoError(t, err, tst.block.Type) {
+			assert.Equal(t, tst.alg, k.JWK()["alg"])
+			assert.NotEmpty(t, k.Kid)
+			assert.Equal(t, k.Kid, k.JWK()["kid"])
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package mw
+
+/*
+	JWT tokeninfo validates JWT access tokens locally instead of calling the tokeninfo endpoint of the IDP.
+
+	The keys to verify signatures are read from a JSON Web Key Set (JWKS) document that is fetched periodically.
+	Tokens are matched with keys by 'kid', a token with an unknown kid triggers a (rate limited) fetch so rotated keys
+	are picked-up quickly.
+
+	See https://tools.ietf.org/html/rfc7517 (JWK) and https://tools.ietf.org/html/rfc7519 (JWT)
+*/
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/golang/glog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// JWTConfig defines how to validate JWT access tokens.
+	JWTConfig struct {
+		// JWKSURL is the url of the JSON Web Key Set that contains the keys that sign access tokens.
+		// Required.
+		JWKSURL string
+		// Issuer is the required value of the 'iss' claim.
+		// Optional, when empty 'iss' isn't checked.
+		Issuer string
+		// Audience is a value that must be present in the 'aud' claim.
+		// Optional, when empty 'aud' isn't checked.
+		Audience string
+		// RefreshInterval is the time between JWKS fetches.
+		// Optional. Default value 5 minutes.
+		RefreshInterval time.Duration
+	}
+
+	// JWTTokeninfo validates JWT access tokens with keys from a JWKS endpoint.
+	JWTTokeninfo struct {
+		config JWTConfig
+		client *http.Client
+		// fetchMutex serializes JWKS fetches so concurrent requests with an unknown kid share one fetch.
+		fetchMutex sync.Mutex
+		// mutex guards the fields below.
+		mutex sync.RWMutex
+		// keys by kid.
+		keys map[string]interface{}
+		// refreshed is the time of the last fetch attempt.
+		refreshed time.Time
+	}
+
+	// Jwks is a JSON Web Key Set, only the fields needed to construct public keys are defined.
+	jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			// RSA
+			N string `json:"n"`
+			E string `json:"e"`
+			// EC
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+)
+
+var (
+	// DefaultJWTConfig is the default JWT tokeninfo config.
+	DefaultJWTConfig = JWTConfig{
+		RefreshInterval: 5 * time.Minute,
+	}
+
+	// JwksMinRefreshInterval limits the fetches triggered by tokens with an unknown kid.
+	jwksMinRefreshInterval = 10 * time.Second
+
+	// JwtValidMethods are the accepted signing algorithms, symmetric algorithms and 'none' are not accepted.
+	jwtValidMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+// NewJWTTokeninfo returns a JWTTokeninfo.
+// Call Refresh to fetch the keys before first use and Run to keep them up-to-date.
+func NewJWTTokeninfo(config JWTConfig) *JWTTokeninfo {
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultJWTConfig.RefreshInterval
+	}
+	return &JWTTokeninfo{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]interface{}{},
+	}
+}
+
+// Run fetches the JWKS periodically until ctx is done.
+func (j *JWTTokeninfo) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := j.Refresh()
+			if err != nil {
+				glog.Error("jwks refresh: ", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh fetches the JWKS and replaces the current keys.
+// On error the current keys remain in use.
+func (j *JWTTokeninfo) Refresh() error {
+	j.fetchMutex.Lock()
+	defer j.fetchMutex.Unlock()
+	return j.refresh()
+}
+
+// Refresh is Refresh without locking.
+// Prerequisite: j.fetchMutex is locked.
+func (j *JWTTokeninfo) refresh() error {
+	j.mutex.Lock()
+	j.refreshed = time.Now()
+	j.mutex.Unlock()
+
+	resp, err := j.client.Get(j.config.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s status %d", j.config.JWKSURL, resp.StatusCode)
+	}
+
+	var set jwks
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return fmt.Errorf("jwks unmarshall error %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaPublicKey(k.N, k.E)
+		case "EC":
+			key, err = ecPublicKey(k.Crv, k.X, k.Y)
+		default:
+			glog.V(2).Infof("jwks key %s of type %s ignored", k.Kid, k.Kty)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("jwks key %s: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("jwks %s contains no signing keys", j.config.JWKSURL)
+	}
+
+	j.mutex.Lock()
+	j.keys = keys
+	j.mutex.Unlock()
+
+	return nil
+}
+
+// Call validates a JWT access token and returns the TokeninfoResponse for it.
+// Its signature matches TokeninfoFunc.
+func (j *JWTTokeninfo) Call(token string) (*TokeninfoResponse, error) {
+	// clock the time now so we're always on the save side when calculating ExpiresIn
+	now := timeNow()
+
+	parser := &jwt.Parser{
+		ValidMethods: jwtValidMethods,
+		// claims are validated below
+		SkipClaimsValidation: true,
+	}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, j.keyFunc)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %v", err)
+	}
+
+	// Validate claims.
+	unix := now.Unix()
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("jwt: exp claim missing")
+	}
+	if !claims.VerifyExpiresAt(unix, true) {
+		return nil, fmt.Errorf("jwt: token is expired")
+	}
+	if !claims.VerifyNotBefore(unix, false) {
+		return nil, fmt.Errorf("jwt: token is not valid yet")
+	}
+	if j.config.Issuer != "" && !claims.VerifyIssuer(j.config.Issuer, true) {
+		return nil, fmt.Errorf("jwt: unexpected issuer %v", claims["iss"])
+	}
+	if j.config.Audience != "" && !stringInSlice(j.config.Audience, claimStrings(claims["aud"])) {
+		return nil, fmt.Errorf("jwt: unexpected audience %v", claims["aud"])
+	}
+
+	// Map claims to a TokeninfoResponse.
+	r := &TokeninfoResponse{
+		ClientID:  firstClaim(claims, "client_id", "azp", "cid"),
+		Timestamp: now,
+		Extra:     claims,
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		r.ExpiresIn = int(int64(exp) - unix)
+		r.Expires = time.Unix(int64(exp), 0)
+	}
+	scope, ok := claims["scope"]
+	if !ok {
+		scope = claims["scp"]
+	}
+	r.Scope = claimStrings(scope)
+	r.Scopes = make(map[string]struct{}, len(r.Scope))
+	for _, s := range r.Scope {
+		r.Scopes[s] = struct{}{}
+	}
+
+	return r, nil
+}
+
+// KeyFunc returns the key to verify a token.
+// An unknown kid triggers a JWKS fetch (no more than once per jwksMinRefreshInterval), concurrent requests wait for
+// the fetch that is in progress instead of starting their own.
+func (j *JWTTokeninfo) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := j.key(kid)
+	if !ok {
+		key, ok = j.fetchKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+
+	// The key type must match the algorithm.
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("kid %q is not an RSA key", kid)
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); !ok {
+			return nil, fmt.Errorf("kid %q is not an EC key", kid)
+		}
+	}
+
+	return key, nil
+}
+
+// FetchKey returns the key for kid after fetching the JWKS, unless the JWKS is fetched less than
+// jwksMinRefreshInterval ago.
+func (j *JWTTokeninfo) fetchKey(kid string) (interface{}, bool) {
+	j.fetchMutex.Lock()
+	defer j.fetchMutex.Unlock()
+	// the fetch that was in progress might have returned the key.
+	if key, ok := j.key(kid); ok {
+		return key, true
+	}
+	j.mutex.RLock()
+	refresh := time.Since(j.refreshed) >= jwksMinRefreshInterval
+	j.mutex.RUnlock()
+	if !refresh {
+		return nil, false
+	}
+	err := j.refresh()
+	if err != nil {
+		glog.Error("jwks refresh: ", err)
+	}
+	return j.key(kid)
+}
+
+// Key returns the key for kid.
+// A token without kid matches when there is only one key.
+func (j *JWTTokeninfo) key(kid string) (interface{}, bool) {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	if kid == "" && len(j.keys) == 1 {
+		for _, k := range j.keys {
+			return k, true
+		}
+	}
+	k, ok := j.keys[kid]
+	return k, ok
+}
+
+// RsaPublicKey returns a RSA public key from base64url encoded modulus and exponent.
+func rsaPublicKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("modulus: %v", err)
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("exponent: %v", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: int(new(big.Int).SetBytes(eb).Int64()),
+	}, nil
+}
+
+// EcPublicKey returns an EC public key from a curve name and base64url encoded coordinates.
+func ecPublicKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("x: %v", err)
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, fmt.Errorf("y: %v", err)
+	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xb),
+		Y:     new(big.Int).SetBytes(yb),
+	}, nil
+}
+
+// ClaimStrings returns a claim that is either a space delimited string or an array of strings as a slice.
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	default:
+		return nil
+	}
+}
+
+// FirstClaim returns the value of the first named claim that is a non-empty string.
+func firstClaim(claims jwt.MapClaims, names ...string) string {
+	for _, n := range names {
+		if s, ok := claims[n].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
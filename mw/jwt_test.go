@@ -0,0 +1,229 @@
+package mw
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestJWTTokeninfo shows that tokens are validated and claims are mapped to a TokeninfoResponse.
+func TestJWTTokeninfo(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := newTestJwks()
+	jwks.add("rsa1", &rsaKey.PublicKey)
+	jwks.add("ec1", &ecKey.PublicKey)
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	ti := NewJWTTokeninfo(JWTConfig{
+		JWKSURL:  srv.URL,
+		Issuer:   "https://idp.example.com",
+		Audience: "apigw",
+	})
+	assert.NoError(t, ti.Refresh())
+
+	now := time.Now().Unix()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":       "https://idp.example.com",
+			"aud":       []string{"other", "apigw"},
+			"exp":       now + 60,
+			"client_id": "client1",
+			"scope":     "read write",
+		}
+	}
+	with := func(k string, v interface{}) jwt.MapClaims {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	var tests = []struct {
+		token  string
+		client string
+		scopes []string
+		err    bool
+		info   string
+	}{
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, valid()), client: "client1", scopes: []string{"read", "write"}, info: "valid RS256"},
+		{token: sign(t, jwt.SigningMethodES256, "ec1", ecKey, valid()), client: "client1", scopes: []string{"read", "write"}, info: "valid ES256"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, with("aud", "apigw")), client: "client1", scopes: []string{"read", "write"}, info: "aud string"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, with("scope", []string{"read"})), client: "client1", scopes: []string{"read"}, info: "scope array"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, jwt.MapClaims{"iss": "https://idp.example.com", "aud": "apigw", "exp": now + 60, "azp": "client2", "scp": []string{"a"}}), client: "client2", scopes: []string{"a"}, info: "azp and scp claims"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, with("exp", now-1)), err: true, info: "expired"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, with("exp", nil)), err: true, info: "exp missing"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, with("nbf", now+60)), err: true, info: "not valid yet"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, with("iss", "https://evil.example.com")), err: true, info: "wrong issuer"},
+		{token: sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, with("aud", "other")), err: true, info: "wrong audience"},
+		{token: sign(t, jwt.SigningMethodRS256, "ec1", rsaKey, valid()), err: true, info: "key type doesn't match alg"},
+		{token: sign(t, jwt.SigningMethodHS256, "rsa1", []byte("secret"), valid()), err: true, info: "symmetric alg"},
+		{token: sign(t, jwt.SigningMethodNone, "rsa1", jwt.UnsafeAllowNoneSignatureType, valid()), err: true, info: "alg none"},
+		{token: "not-a-jwt", err: true, info: "garbage"},
+	}
+
+	for _, tst := range tests {
+		got, err := ti.Call(tst.token)
+		if tst.err {
+			assert.Error(t, err, tst.info)
+			continue
+		}
+		if assert.NoError(t, err, tst.info) {
+			assert.Equal(t, tst.client, got.ClientID, tst.info)
+			assert.Equal(t, tst.scopes, got.Scope, tst.info)
+			for _, s := range tst.scopes {
+				assert.Contains(t, got.Scopes, s, tst.info)
+			}
+			assert.InDelta(t, 60, got.ExpiresIn, 1, tst.info)
+		}
+	}
+}
+
+// TestJWTTokeninfoKeyRotation shows that a token signed with a new key is accepted after the JWKS has been updated.
+func TestJWTTokeninfoKeyRotation(t *testing.T) {
+	defer func(d time.Duration) { jwksMinRefreshInterval = d }(jwksMinRefreshInterval)
+
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := newTestJwks()
+	jwks.add("k1", &key1.PublicKey)
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	ti := NewJWTTokeninfo(JWTConfig{JWKSURL: srv.URL})
+	assert.NoError(t, ti.Refresh())
+
+	claims := jwt.MapClaims{"exp": time.Now().Unix() + 60, "client_id": "client1"}
+	_, err := ti.Call(sign(t, jwt.SigningMethodRS256, "k1", key1, claims))
+	assert.NoError(t, err, "known kid")
+
+	// Rotate keys.
+	jwks.add("k2", &key2.PublicKey)
+	token2 := sign(t, jwt.SigningMethodRS256, "k2", key2, claims)
+
+	jwksMinRefreshInterval = time.Hour
+	_, err = ti.Call(token2)
+	assert.Error(t, err, "unknown kid, refresh is rate limited")
+
+	jwksMinRefreshInterval = 0
+	_, err = ti.Call(token2)
+	assert.NoError(t, err, "unknown kid triggers refresh")
+}
+
+// TestJWTTokeninfoConcurrentRefresh shows that concurrent requests with an unknown kid share one JWKS fetch.
+func TestJWTTokeninfoConcurrentRefresh(t *testing.T) {
+	defer func(d time.Duration) { jwksMinRefreshInterval = d }(jwksMinRefreshInterval)
+	jwksMinRefreshInterval = 0
+
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := newTestJwks()
+	jwks.add("k1", &key1.PublicKey)
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		jwks.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ti := NewJWTTokeninfo(JWTConfig{JWKSURL: srv.URL})
+	assert.NoError(t, ti.Refresh())
+	jwks.add("k2", &key2.PublicKey)
+	token := sign(t, jwt.SigningMethodRS256, "k2", key2, jwt.MapClaims{"exp": time.Now().Unix() + 60})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ti.Call(token)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "initial fetch and one for the unknown kid")
+}
+
+// TestJWTTokeninfoDefaults shows that a negative RefreshInterval gets the default value.
+func TestJWTTokeninfoDefaults(t *testing.T) {
+	ti := NewJWTTokeninfo(JWTConfig{JWKSURL: "http://127.0.0.1:1", RefreshInterval: -time.Second})
+	assert.Equal(t, DefaultJWTConfig.RefreshInterval, ti.config.RefreshInterval)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotPanics(t, func() { ti.Run(ctx) })
+}
+
+// Sign returns a signed JWT.
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestJwks is a http.Handler that serves a JSON Web Key Set.
+type testJwks struct {
+	sync.Mutex
+	keys []map[string]string
+}
+
+func newTestJwks() *testJwks {
+	return &testJwks{}
+}
+
+// Add a public key.
+func (j *testJwks) add(kid string, key interface{}) {
+	b64 := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	k := map[string]string{"kid": kid, "use": "sig"}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		k["kty"] = "RSA"
+		k["n"] = b64(key.N)
+		k["e"] = b64(big.NewInt(int64(key.E)))
+	case *ecdsa.PublicKey:
+		k["kty"] = "EC"
+		k["crv"] = key.Curve.Params().Name
+		k["x"] = b64(key.X)
+		k["y"] = b64(key.Y)
+	}
+	j.Lock()
+	j.keys = append(j.keys, k)
+	j.Unlock()
+}
+
+func (j *testJwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.Lock()
+	defer j.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": j.keys})
+}
@@ -12,11 +12,15 @@ import (
 	"net/http"
 	"strings"
 
+	"container/list"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/mmlt/apigw/path"
+	"github.com/prometheus/client_golang/prometheus"
 	"io/ioutil"
 	"net/url"
 	"sync"
@@ -32,25 +36,38 @@ type (
 		// Tokeninfo is a function that gets a TokeninfoResponse for a given access_token.
 		Tokeninfo TokeninfoFunc
 
+		// Operation is an optional function that gets the operation for a path.
+		// When set it takes precedence over RequiredScopes.
+		// Access is allowed when the access token satisfies at least one of the operation's security alternatives.
+		// Status codes are as described for RequiredScopes.
+		// Alternatives with apiKey schemes are only satisfied when the APIKey middleware, that must be placed before
+		// this one, has accepted the keys. When no alternative can be satisfied the response is Unauthorized.
+		Operation OperationFunc
+
 		// RequiredScopes is an optional function that gets the scopes that are required to access a path.
 		//
 		// If RequiredScopes is not set:
-		//  missing token -> BadRequest
+		//  missing token -> Unauthorized
 		//  invalid or expired tokens -> Unauthorized
 		//
 		// If RequiredScopes is set and the resulting set of scopes is empty no error is returned and processing
 		// continues with the next middleware.
 		//
 		// If RequiredScopes is set and it returns a non empty set of scopes for a path:
-		//  missing token -> BadRequest
+		//  missing token -> Unauthorized
 		//  invalid or expired tokens -> Unauthorized
-		//  scopes don't match -> Unauthorized
+		//  scopes don't match -> Forbidden
+		//
+		// A WWW-Authenticate header as described in RFC 6750 is set on Unauthorized and Forbidden responses.
 		RequiredScopes ScopesFunc
 	}
 
 	// ScopesFunc gets the scopes to access a path.
 	ScopesFunc func(method string, url *url.URL) ([]string, error)
 
+	// OperationFunc gets the operation for a method/path.
+	OperationFunc func(method string, url *url.URL) (*path.Operation, error)
+
 	// TokeninfoFunc gets a TokeninfoResponse for a given access_token.
 	TokeninfoFunc func(token string) (*TokeninfoResponse, error)
 
@@ -65,22 +82,86 @@ type (
 		ExpiresIn int `json:"expires_in"`
 		// Error is empty on success or contains an error name when something went wrong.
 		Error string `json:"error"`
-		//TODO Expires is calculated from ExpiresIn at time of reception.
-		//TODOExpires time.Time
+		// Expires is the absolute expiry time, it's calculated from ExpiresIn at time of reception.
+		// When zero Timestamp + ExpiresIn is used.
+		Expires time.Time `json:"-"`
 		// Scopes is a map representation of Scope.
 		Scopes map[string]struct{}
 		// Timestamp is when the tokeninfo response is produced.
 		// Timestamp + ExpiresIn is the absolute expiry time.
 		Timestamp time.Time
+		// Extra contains all fields of the tokeninfo response (or JWT claims) by name.
+		Extra map[string]interface{} `json:"-"`
+	}
+
+	// IntrospectionResponse is the subset of a RFC 7662 introspection response that is used.
+	// See https://tools.ietf.org/html/rfc7662#section-2.2
+	introspectionResponse struct {
+		// Active is true when the token is valid.
+		Active bool `json:"active"`
+		// Scope is a space-delimited list of scopes.
+		Scope string `json:"scope"`
+		// ClientID identifies the application for which the token created.
+		ClientID string `json:"client_id"`
+		// Exp is the expiry time in seconds since epoch (optional).
+		Exp int64 `json:"exp"`
+	}
+
+	// TokenRejectedError is returned by a TokeninfoFunc when the IDP responds that a token is invalid or expired.
+	// Other errors mean the IDP couldn't be asked.
+	TokenRejectedError struct {
+		// Reason tells why the token is rejected.
+		Reason string
 	}
 )
 
+func (e *TokenRejectedError) Error() string {
+	return "token rejected: " + e.Reason
+}
+
+// TimeNow returns the current time, tests replace it to control the clock.
+var timeNow = time.Now
+
+// Expired returns true when the token is expired at now.
+func (r *TokeninfoResponse) expired(now time.Time) bool {
+	switch {
+	case !r.Expires.IsZero():
+		return !now.Before(r.Expires)
+	case !r.Timestamp.IsZero():
+		return !now.Before(r.Timestamp.Add(time.Duration(r.ExpiresIn) * time.Second))
+	default:
+		return r.ExpiresIn <= 0
+	}
+}
+
 // Errors
 var (
-	ErrTokenMissing = echo.NewHTTPError(http.StatusBadRequest, "Missing or malformed token")
-	ErrTokenInvalid = echo.NewHTTPError(http.StatusUnauthorized, "Not allowed")
+	ErrTokenMissing       = echo.NewHTTPError(http.StatusUnauthorized, "Missing or malformed token")
+	ErrTokenInvalid       = echo.NewHTTPError(http.StatusUnauthorized, "Not allowed")
+	ErrInsufficientScope  = echo.NewHTTPError(http.StatusForbidden, "Insufficient scope")
+	ErrCredentialsMissing = echo.NewHTTPError(http.StatusUnauthorized, "Missing credentials")
 )
 
+// Error codes as defined in RFC 6750.
+// See https://tools.ietf.org/html/rfc6750#section-3.1
+const (
+	ErrorCodeInvalidToken      = "invalid_token"
+	ErrorCodeInsufficientScope = "insufficient_scope"
+)
+
+// ErrorCode returns the RFC 6750 error code of an error returned by the OAuth2 middleware or "" if there is none.
+// A missing token has no error code.
+func ErrorCode(err error) string {
+	switch err {
+	case ErrTokenInvalid:
+		return ErrorCodeInvalidToken
+	case ErrInsufficientScope:
+		return ErrorCodeInsufficientScope
+	default:
+		return ""
+	}
+}
+
 var (
 	// DefaultOauth2Config is the default config.
 	DefaultOauth2Config = OAuth2Config{
@@ -112,56 +193,144 @@ func OAuth2WithConfig(config OAuth2Config) echo.MiddlewareFunc {
 			}
 			var err error
 
-			// get required scopes
-			var required []string
-			if config.RequiredScopes != nil {
-				required, err = config.RequiredScopes(c.Request().Method, c.Request().URL)
+			// get required security
+			var required path.Requirements
+			switch {
+			case config.Operation != nil:
+				op, err := operation(c, config.Operation)
+				if err != nil {
+					return err
+				}
+				if op != nil {
+					required = op.Security
+				}
+			case config.RequiredScopes != nil:
+				scopes, err := config.RequiredScopes(c.Request().Method, c.Request().URL)
 				if err != nil {
 					return err
 				}
+				if len(scopes) > 0 {
+					required = path.Requirements{{Token: true, Scopes: scopes}}
+				}
 			}
 
-			if len(required) == 0 {
+			if required.Public() {
 				// no required scopes, proceed
 				return next(c)
 			}
 
+			// only alternatives of which the other schemes (apiKey) are satisfied remain.
+			satisfied, _ := c.Get("Schemes").(map[string]string)
+			required, clientID := satisfiedRequirements(required, satisfied)
+			if len(required) == 0 {
+				if clientID != "" {
+					// an alternative is satisfied without a token.
+					c.Set("ClientID", clientID)
+					return next(c)
+				}
+				return challenge(c, ErrCredentialsMissing, nil)
+			}
+
 			// get token
 			token, err := extractToken(c)
 			if err != nil {
-				return err
+				return challenge(c, err, nil)
 			}
 			// get tokeninfo
 			ti, err := config.Tokeninfo(token)
 			if err != nil || ti == nil {
 				// log internal error but don't let the caller know.
 				glog.Info(err)
-				return ErrTokenInvalid
+				return challenge(c, ErrTokenInvalid, nil)
 			}
 
-			// check if token still valid.
-			if ti.ExpiresIn <= 0 {
-				return ErrTokenInvalid
+			// check if token still valid (a cached tokeninfo has the ExpiresIn of the moment of reception).
+			if ti.expired(timeNow()) {
+				return challenge(c, ErrTokenInvalid, nil)
 			}
 
-			// check allowed scopes (allowed is a superset of required scopes)
+			// check allowed scopes (allowed is a superset of the required scopes of at least one alternative)
 			allowed := ti.Scopes
-			// all required scopes must be allowed
-			for _, r := range required {
-				if _, ok := allowed[r]; !ok {
-					glog.V(2).Infof("%s %s requires scopes %v (allowed=%v)", c.Request().Method, c.Request().URL, required, allowed)
-					return ErrTokenInvalid
-				}
+			if !anyScopesAllowed(required, allowed) {
+				glog.V(2).Infof("%s %s requires scopes %v (allowed=%v)", c.Request().Method, c.Request().URL, required, allowed)
+				return challenge(c, ErrInsufficientScope, required[0].Scopes)
 			}
 
-			// make it possible for other middleware to use ClientID.
+			// make it possible for other middleware to use ClientID and the verified tokeninfo.
 			c.Set("ClientID", ti.ClientID)
+			c.Set("Tokeninfo", ti)
 
 			return next(c)
 		}
 	}
 }
 
+// Challenge sets the WWW-Authenticate header for err and returns err.
+// Scope is the list of scopes that is needed to access the resource (insufficient_scope only), when there are
+// alternatives the scopes of the first alternative are used.
+// See https://tools.ietf.org/html/rfc6750#section-3
+func challenge(c echo.Context, err error, scope path.Scopes) error {
+	v := "Bearer"
+	if code := ErrorCode(err); code != "" {
+		v += fmt.Sprintf(` error="%s"`, code)
+	}
+	if len(scope) > 0 {
+		v += fmt.Sprintf(`, scope="%s"`, strings.Join(scope, " "))
+	}
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, v)
+	return err
+}
+
+// SatisfiedRequirements returns the alternatives of which all other schemes are satisfied and that need a token.
+// When an alternative is satisfied without a token no requirements are returned but the client id of that
+// alternative.
+// Satisfied maps scheme names to client ids.
+func satisfiedRequirements(required path.Requirements, satisfied map[string]string) (path.Requirements, string) {
+	var reqs path.Requirements
+	for _, req := range required {
+		clientID := ""
+		ok := true
+		for _, s := range req.Schemes {
+			id, found := satisfied[s.Name]
+			if !found {
+				ok = false
+				break
+			}
+			if clientID == "" {
+				clientID = id
+			}
+		}
+		if !ok {
+			continue
+		}
+		if !req.NeedsToken() {
+			return nil, clientID
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, ""
+}
+
+// AnyScopesAllowed returns true if all required scopes of at least one requirement are allowed.
+func anyScopesAllowed(required path.Requirements, allowed map[string]struct{}) bool {
+	for _, req := range required {
+		if scopesAllowed(req.Scopes, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopesAllowed returns true if all required scopes are allowed.
+func scopesAllowed(required path.Scopes, allowed map[string]struct{}) bool {
+	for _, r := range required {
+		if _, ok := allowed[r]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // ExtractToken gets an OAuth2 token from a header of the form: `Authorization : Bearer cn389ncoiwuencr`.
 // See https://tools.ietf.org/html/rfc6750
 func extractToken(c echo.Context) (string, error) {
@@ -183,14 +352,18 @@ func extractToken(c echo.Context) (string, error) {
 func BasicTokeninfo(url string) TokeninfoFunc {
 	return func(token string) (*TokeninfoResponse, error) {
 		// clock the timeInserted now so we're always on the save side when adding ExpiresIn
-		now := time.Now()
+		now := timeNow()
 
 		resp, err := http.Get(url + "?access_token=" + token)
 		if err != nil {
 			return nil, err
 		}
 		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusBadRequest, http.StatusUnauthorized:
+			return nil, &TokenRejectedError{Reason: fmt.Sprintf("GET %s?access_token=xxxx status %d", url, resp.StatusCode)}
+		default:
 			return nil, fmt.Errorf("GET %s?access_token=xxxx status %d", url, resp.StatusCode)
 		}
 		// Read body.
@@ -201,12 +374,15 @@ func BasicTokeninfo(url string) TokeninfoFunc {
 		// Unmarshal.
 		var r TokeninfoResponse
 		err = json.Unmarshal(body, &r)
+		if err == nil {
+			err = json.Unmarshal(body, &r.Extra)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("tokeninfo response unmarshall error %v", err)
 		}
 		// Check json for errors.
 		if r.Error != "" {
-			return nil, fmt.Errorf("tokeninfo response error %v", r.Error)
+			return nil, &TokenRejectedError{Reason: fmt.Sprintf("tokeninfo response error %v", r.Error)}
 		}
 
 		// Do post processing of fields...
@@ -215,94 +391,362 @@ func BasicTokeninfo(url string) TokeninfoFunc {
 		for _, s := range r.Scope {
 			r.Scopes[s] = struct{}{}
 		}
-		//TODOr.Expires = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
 		r.Timestamp = now
+		r.Expires = now.Add(time.Duration(r.ExpiresIn) * time.Second)
 
 		return &r, err
 	}
 }
 
+// IntrospectionTokeninfo returns a function that calls the RFC 7662 introspection endpoint of an OAuth2 IDP.
+// The token is POST-ed as a form and the gateway authenticates with clientID and clientSecret (HTTP Basic).
+// The exp field of the response is optional, an active token without exp is valid for maxAge.
+// This implementation performs a HTTP POST for each invocation.
+// See https://tools.ietf.org/html/rfc7662
+func IntrospectionTokeninfo(u, clientID, clientSecret string, maxAge time.Duration) TokeninfoFunc {
+	return func(token string) (*TokeninfoResponse, error) {
+		// clock the time now so we're always on the save side when calculating ExpiresIn
+		now := timeNow()
+
+		form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+		req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("POST %s status %d", u, resp.StatusCode)
+		}
+		// Read body.
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		// Unmarshal.
+		var ir introspectionResponse
+		err = json.Unmarshal(body, &ir)
+		var extra map[string]interface{}
+		if err == nil {
+			err = json.Unmarshal(body, &extra)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("introspection response unmarshall error %v", err)
+		}
+		if !ir.Active {
+			return nil, &TokenRejectedError{Reason: "introspection response: token is not active"}
+		}
+		expiresIn, expires := int(ir.Exp-now.Unix()), time.Unix(ir.Exp, 0)
+		if ir.Exp == 0 {
+			// the IDP doesn't tell when the token expires so it's asked again after maxAge.
+			expiresIn, expires = int(maxAge/time.Second), now.Add(maxAge)
+		}
+
+		r := &TokeninfoResponse{
+			ClientID:  ir.ClientID,
+			Scope:     strings.Fields(ir.Scope),
+			ExpiresIn: expiresIn,
+			Timestamp: now,
+			Expires:   expires,
+			Extra:     extra,
+		}
+		r.Scopes = make(map[string]struct{}, len(r.Scope))
+		for _, s := range r.Scope {
+			r.Scopes[s] = struct{}{}
+		}
+
+		return r, nil
+	}
+}
+
+// TokeninfoClientConfig defines how a TokeninfoClient calls the OAuth2 IDP.
+type TokeninfoClientConfig struct {
+	// URL of the tokeninfo or introspection endpoint.
+	// Required.
+	URL string
+	// Introspection selects RFC 7662 introspection (POST with client authentication) instead of tokeninfo
+	// (GET with ?access_token=).
+	Introspection bool
+	// ClientID and ClientSecret authenticate the gateway at the introspection endpoint.
+	// Required when Introspection is true.
+	ClientID     string
+	ClientSecret string
+	// Freshness is how long a cached response is used before the IDP is asked again.
+	// Optional. Default value 10 seconds.
+	Freshness time.Duration
+	// NegativeTTL is how long a rejected token is cached.
+	// Optional. Default value 5 seconds, a negative value disables caching of rejected tokens.
+	NegativeTTL time.Duration
+	// MaxEntries is the maximum number of cached responses, the least recently used entry is evicted when the cache
+	// is full.
+	// Optional. Default value 10000.
+	MaxEntries int
+	// GCInterval is the time between removals of expired entries from the cache.
+	// Optional. Default value 1 minute.
+	GCInterval time.Duration
+}
+
+var (
+	// DefaultTokeninfoClientConfig is the default TokeninfoClient config.
+	DefaultTokeninfoClientConfig = TokeninfoClientConfig{
+		Freshness:   10 * time.Second,
+		NegativeTTL: 5 * time.Second,
+		MaxEntries:  10000,
+		GCInterval:  time.Minute,
+	}
+
+	tokeninfoCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "apigw",
+			Subsystem: "tokeninfo_cache",
+			Name:      "requests_total",
+			Help:      "Counter of tokeninfo cache lookups",
+		}, []string{"result"})
+
+	tokeninfoCacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "apigw",
+			Subsystem: "tokeninfo_cache",
+			Name:      "evictions_total",
+			Help:      "Counter of entries removed from the tokeninfo cache",
+		}, []string{"reason"})
+
+	tokeninfoCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "apigw",
+			Subsystem: "tokeninfo_cache",
+			Name:      "entries",
+			Help:      "Number of entries in the tokeninfo cache",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(tokeninfoCacheRequests)
+	prometheus.MustRegister(tokeninfoCacheEvictions)
+	prometheus.MustRegister(tokeninfoCacheSize)
+}
+
 // TokeninfoClient is used to call and OAuth2 tokeninfo endpoint with caching to reduce the load on the OAuth2 IDP.
 // A side effect of caching is that a token may be invalid due to logout before it is expired. To limit this effect we
-// do another tokeninfo call if the cached value is older then N seconds.
+// do another tokeninfo call if the cached value is older then Freshness.
+// Concurrent calls for the same token result in one call to the IDP.
+// Tokens that are rejected by the IDP are cached for a short time (NegativeTTL) to protect the IDP against clients that
+// retry with a bad token.
 type TokeninfoClient struct {
-	cache     *tokeninfoCache
-	url       string
-	basicCall TokeninfoFunc
+	cache       *tokeninfoCache
+	flight      flightGroup
+	url         string
+	basicCall   TokeninfoFunc
+	freshness   time.Duration
+	negativeTTL time.Duration
 }
 
-// NewTokeninfoClient returns an initialized TokeninfoClient.
+// NewTokeninfoClient returns an initialized TokeninfoClient that calls a tokeninfo endpoint.
 func NewTokeninfoClient(url string) *TokeninfoClient {
+	return NewTokeninfoClientWithConfig(TokeninfoClientConfig{URL: url})
+}
+
+// NewTokeninfoClientWithConfig returns an initialized TokeninfoClient with config.
+// See: `TokeninfoClientConfig`.
+func NewTokeninfoClientWithConfig(config TokeninfoClientConfig) *TokeninfoClient {
+	// Defaults
+	if config.Freshness == 0 {
+		config.Freshness = DefaultTokeninfoClientConfig.Freshness
+	}
+	if config.NegativeTTL == 0 {
+		config.NegativeTTL = DefaultTokeninfoClientConfig.NegativeTTL
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultTokeninfoClientConfig.MaxEntries
+	}
+	if config.GCInterval <= 0 {
+		config.GCInterval = DefaultTokeninfoClientConfig.GCInterval
+	}
+
+	call := BasicTokeninfo(config.URL)
+	if config.Introspection {
+		// a token without exp is cached no longer than Freshness.
+		call = IntrospectionTokeninfo(config.URL, config.ClientID, config.ClientSecret, config.Freshness)
+	}
 	return &TokeninfoClient{
-		cache:     newTokeninfoCache(),
-		url:       url,
-		basicCall: BasicTokeninfo(url),
+		cache:       newTokeninfoCache(config.MaxEntries, config.GCInterval),
+		url:         config.URL,
+		basicCall:   call,
+		freshness:   config.Freshness,
+		negativeTTL: config.NegativeTTL,
 	}
 }
 
 // Call a tokeninfo endpoint with caching.
 func (c *TokeninfoClient) Call(token string) (*TokeninfoResponse, error) {
-	// Check if there is a cached entry (not older than 10 seconds) for token.
-	ti, ok := c.cache.get(token)
-	if ok && ti.Timestamp.Add(10*time.Second).After(time.Now()) {
-		return ti, nil
-	}
-	// Call tokeninfo.
-	ti, err := c.basicCall(token)
-	if err != nil {
-		return nil, err
+	key := tokenKey(token)
+
+	// Check if there is a fresh cached entry or a rejection within negativeTTL for token.
+	now := timeNow()
+	e, ok := c.cache.get(key)
+	if ok && e.expires.After(now) {
+		if e.err != nil {
+			tokeninfoCacheRequests.WithLabelValues("hit").Inc()
+			return nil, e.err
+		}
+		if e.ti.Timestamp.Add(c.freshness).After(now) {
+			tokeninfoCacheRequests.WithLabelValues("hit").Inc()
+			return e.ti, nil
+		}
 	}
-	// Store the result for future use.
-	c.cache.set(token, ti)
+	tokeninfoCacheRequests.WithLabelValues("miss").Inc()
+
+	// Call tokeninfo, concurrent calls for the same token share the result.
+	return c.flight.do(key, func() (*TokeninfoResponse, error) {
+		ti, err := c.basicCall(token)
+		if err == nil {
+			if ti.Expires.IsZero() {
+				ti.Expires = ti.Timestamp.Add(time.Duration(ti.ExpiresIn) * time.Second)
+			}
+			if ti.expired(timeNow()) {
+				err = &TokenRejectedError{Reason: "token is expired"}
+			}
+		}
+		if err != nil {
+			if _, ok := err.(*TokenRejectedError); ok && c.negativeTTL > 0 {
+				c.cache.set(key, &tokeninfoEntry{err: err, expires: timeNow().Add(c.negativeTTL)})
+			}
+			return nil, err
+		}
+		// Store the result for future use, the entry can't outlive the token.
+		c.cache.set(key, &tokeninfoEntry{ti: ti, expires: ti.Expires})
 
-	return ti, nil
+		return ti, nil
+	})
 }
 
 // EnableGC of cached tokeninfo responses that are expired. TODO use context to shutdown GC
+// Disabling GC also empties the cache.
 func (c *TokeninfoClient) EnableGC(b bool) {
 	if b {
 		c.cache.runGC()
 	} else {
 		c.cache.stopGC()
+		c.cache.clear()
 	}
 }
 
-// TokeninfoCache is a cache for tokeninfo responses.
-// The cache has garbage collection to prevent ever increasing memory consumption.
+// TokenKey returns the cache key for a token.
+// Tokens are hashed so they don't appear in (heap) dumps.
+func tokenKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return string(h[:])
+}
+
+// TokeninfoEntry is a cached tokeninfo result; a response or a rejection.
+type tokeninfoEntry struct {
+	// key is the hashed token.
+	key string
+	// ti is the response (nil when the token is rejected).
+	ti *TokeninfoResponse
+	// err is the rejection (nil when the token is accepted).
+	err error
+	// expires is when the entry can be garbage collected.
+	expires time.Time
+}
+
+// TokeninfoCache is a LRU cache for tokeninfo responses.
+// The cache has a maximum number of entries and garbage collection to prevent ever increasing memory consumption.
 type tokeninfoCache struct {
-	// RWMutex
-	sync.RWMutex
-	// data holds cached TokeninfoResponses.
-	data map[string]*TokeninfoResponse
+	// Mutex (a get updates the LRU list so there are no read-only operations)
+	sync.Mutex
+	// maxEntries is the maximum number of entries.
+	maxEntries int
+	// ll holds entries in most recently used order.
+	ll *list.List
+	// data holds list elements by key.
+	data map[string]*list.Element
+	// gcInterval is the time between garbage collections.
+	gcInterval time.Duration
 	// ticker sets the garbage collect interval.
 	ticker *time.Ticker
 	// stop the garbage collector.
 	stop chan struct{}
 }
 
-func newTokeninfoCache() *tokeninfoCache {
+func newTokeninfoCache(maxEntries int, gcInterval time.Duration) *tokeninfoCache {
 	return &tokeninfoCache{
-		data: map[string]*TokeninfoResponse{},
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		data:       map[string]*list.Element{},
+		gcInterval: gcInterval,
+	}
+}
+
+func (c *tokeninfoCache) get(key string) (*tokeninfoEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.data[key]
+	if !ok {
+		return nil, false
 	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*tokeninfoEntry), true
 }
 
-func (c *tokeninfoCache) get(key string) (*TokeninfoResponse, bool) {
-	c.RLock()
-	defer c.RUnlock()
-	v, ok := c.data[key]
-	return v, ok
+func (c *tokeninfoCache) set(key string, value *tokeninfoEntry) {
+	c.Lock()
+	defer c.Unlock()
+	value.key = key
+	if el, ok := c.data[key]; ok {
+		el.Value = value
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.data[key] = c.ll.PushFront(value)
+	tokeninfoCacheSize.Inc()
+	for c.ll.Len() > c.maxEntries {
+		c.remove(c.ll.Back())
+		tokeninfoCacheEvictions.WithLabelValues("capacity").Inc()
+	}
 }
 
-func (c *tokeninfoCache) set(key string, value *TokeninfoResponse) {
+func (c *tokeninfoCache) len() int {
 	c.Lock()
 	defer c.Unlock()
-	c.data[key] = value
+	return c.ll.Len()
 }
 
-func (c *tokeninfoCache) delete(key string, value *TokeninfoResponse) {
+func (c *tokeninfoCache) clear() {
 	c.Lock()
 	defer c.Unlock()
-	delete(c.data, key)
+	tokeninfoCacheSize.Sub(float64(c.ll.Len()))
+	c.ll.Init()
+	c.data = map[string]*list.Element{}
+}
+
+// Remove an element.
+// Prerequisite: c is locked.
+func (c *tokeninfoCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.data, el.Value.(*tokeninfoEntry).key)
+	tokeninfoCacheSize.Dec()
+}
+
+// Gc removes expired entries.
+func (c *tokeninfoCache) gc(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*tokeninfoEntry).expires.Before(now) {
+			c.remove(el)
+			tokeninfoCacheEvictions.WithLabelValues("expired").Inc()
+		}
+		el = prev
+	}
 }
 
 func (c *tokeninfoCache) runGC() {
@@ -312,23 +756,17 @@ func (c *tokeninfoCache) runGC() {
 	}
 
 	c.Lock()
-	c.ticker = time.NewTicker(time.Minute)
+	c.ticker = time.NewTicker(c.gcInterval)
 	c.stop = make(chan struct{})
+	ticker, stop := c.ticker, c.stop
 	c.Unlock()
 
 	go func() {
 		for {
 			select {
-			case <-c.ticker.C:
-				now := time.Now()
-				c.Lock()
-				for k, v := range c.data {
-					if v.Timestamp.Add(time.Duration(v.ExpiresIn) * time.Second).Before(now) {
-						delete(c.data, k)
-					}
-				}
-				c.Unlock()
-			case <-c.stop:
+			case now := <-ticker.C:
+				c.gc(now)
+			case <-stop:
 				return
 			}
 		}
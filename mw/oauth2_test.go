@@ -1,12 +1,17 @@
 package mw
 
 import (
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // TestScopeValidation shows that the correct HTTP Status code is returned for a given combination of required scopes and
@@ -23,8 +28,8 @@ func TestScopeValidation(t *testing.T) {
 		{required: []string{}, allowed: map[string]struct{}{"read": {}}, want: http.StatusOK, info: "more allowed than required"},
 		{required: []string{"read"}, allowed: map[string]struct{}{"read": {}}, want: http.StatusOK, info: "allowed == required (1 scope)"},
 		{required: []string{"read", "write"}, allowed: map[string]struct{}{"write": {}, "read": {}}, want: http.StatusOK, info: "allowed == required (2 scopes)"},
-		{required: []string{"read"}, allowed: map[string]struct{}{"write": {}}, want: http.StatusUnauthorized, info: "allowed != required (1 scope)"},
-		{required: []string{"read"}, allowed: map[string]struct{}{}, want: http.StatusUnauthorized, info: "more required than allowed (1 scope)"},
+		{required: []string{"read"}, allowed: map[string]struct{}{"write": {}}, want: http.StatusForbidden, info: "allowed != required (1 scope)"},
+		{required: []string{"read"}, allowed: map[string]struct{}{}, want: http.StatusForbidden, info: "more required than allowed (1 scope)"},
 	}
 
 	for _, tst := range tests {
@@ -71,10 +76,10 @@ func TestTokenMissing(t *testing.T) {
 	}{
 		{required: []string{}, allowed: map[string]struct{}{}, want: http.StatusOK, info: "public access"},
 		{required: []string{}, allowed: map[string]struct{}{"read": {}}, want: http.StatusOK, info: "more allowed than required"},
-		{required: []string{"read"}, allowed: map[string]struct{}{"read": {}}, want: http.StatusBadRequest, info: "allowed == required (1 scope)"},
-		{required: []string{"read", "write"}, allowed: map[string]struct{}{"write": {}, "read": {}}, want: http.StatusBadRequest, info: "allowed == required (2 scopes)"},
-		{required: []string{"read"}, allowed: map[string]struct{}{"write": {}}, want: http.StatusBadRequest, info: "allowed != required (1 scope)"},
-		{required: []string{"read"}, allowed: map[string]struct{}{}, want: http.StatusBadRequest, info: "more required than allowed (1 scope)"},
+		{required: []string{"read"}, allowed: map[string]struct{}{"read": {}}, want: http.StatusUnauthorized, info: "allowed == required (1 scope)"},
+		{required: []string{"read", "write"}, allowed: map[string]struct{}{"write": {}, "read": {}}, want: http.StatusUnauthorized, info: "allowed == required (2 scopes)"},
+		{required: []string{"read"}, allowed: map[string]struct{}{"write": {}}, want: http.StatusUnauthorized, info: "allowed != required (1 scope)"},
+		{required: []string{"read"}, allowed: map[string]struct{}{}, want: http.StatusUnauthorized, info: "more required than allowed (1 scope)"},
 	}
 
 	for _, tst := range tests {
@@ -254,3 +259,457 @@ func TestScopesFail(t *testing.T) {
 		}
 	}
 }
+
+// TestSecurityAlternatives shows that access is granted when the allowed scopes satisfy at least one of the
+// security alternatives of an operation.
+func TestSecurityAlternatives(t *testing.T) {
+	readOrAdmin := path.Requirements{{Scopes: path.Scopes{"read"}}, {Scopes: path.Scopes{"admin"}}}
+	readAndWrite := path.Requirements{{Scopes: path.Scopes{"read", "write"}}}
+	var tests = []struct {
+		required path.Requirements
+		allowed  map[string]struct{}
+		want     int
+		info     string
+	}{
+		{required: nil, allowed: map[string]struct{}{}, want: http.StatusOK, info: "no requirements"},
+		{required: path.Requirements{{}, {Scopes: path.Scopes{"read"}}}, allowed: map[string]struct{}{}, want: http.StatusOK, info: "optional security"},
+		{required: readOrAdmin, allowed: map[string]struct{}{"read": {}}, want: http.StatusOK, info: "first alternative"},
+		{required: readOrAdmin, allowed: map[string]struct{}{"admin": {}}, want: http.StatusOK, info: "second alternative"},
+		{required: readOrAdmin, allowed: map[string]struct{}{"write": {}}, want: http.StatusForbidden, info: "no alternative"},
+		{required: readAndWrite, allowed: map[string]struct{}{"read": {}}, want: http.StatusForbidden, info: "partial alternative"},
+		{required: readAndWrite, allowed: map[string]struct{}{"read": {}, "write": {}}, want: http.StatusOK, info: "complete alternative"},
+		{required: path.Requirements{{Token: true}}, allowed: map[string]struct{}{}, want: http.StatusOK, info: "token without scopes"},
+	}
+
+	for _, tst := range tests {
+		e := echo.New()
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.Header.Add("Authorization", "Bearer value-not-important")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		// Configure middleware
+		oauth2 := OAuth2WithConfig(OAuth2Config{
+			Operation: func(method string, url *url.URL) (*path.Operation, error) {
+				return &path.Operation{Security: tst.required}, nil
+			},
+			Tokeninfo: func(token string) (*TokeninfoResponse, error) {
+				return &TokeninfoResponse{
+					Scopes:    tst.allowed,
+					ExpiresIn: 10,
+				}, nil
+			},
+		})
+		// Create chain of handlers
+		h := oauth2(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})
+
+		// Invoke handler and check result
+		err := h(c)
+		if err != nil {
+			assert.Equal(t, tst.want, err.(*echo.HTTPError).Code, tst.info)
+		} else {
+			assert.Equal(t, tst.want, c.Response().Status, tst.info)
+		}
+	}
+}
+
+// TestIntrospectionTokeninfo shows that a token is POST-ed to a RFC 7662 introspection endpoint with client
+// authentication and that the response is mapped to a TokeninfoResponse.
+func TestIntrospectionTokeninfo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if r.Method != http.MethodPost || !ok || id != "apigw" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("access_token") != "" {
+			t.Error("token must not be in the url")
+		}
+		exp := time.Now().Unix() + 60
+		switch r.PostFormValue("token") {
+		case "active":
+			fmt.Fprintf(w, `{"active": true, "client_id": "client1", "scope": "read write", "exp": %d}`, exp)
+		case "noexp":
+			fmt.Fprint(w, `{"active": true, "client_id": "client2", "scope": "read"}`)
+		default:
+			fmt.Fprint(w, `{"active": false}`)
+		}
+	}))
+	defer srv.Close()
+
+	ti := IntrospectionTokeninfo(srv.URL, "apigw", "s3cret", 10*time.Second)
+
+	got, err := ti("active")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "client1", got.ClientID)
+		assert.Equal(t, []string{"read", "write"}, got.Scope)
+		assert.Contains(t, got.Scopes, "write")
+		assert.InDelta(t, 60, got.ExpiresIn, 1)
+	}
+
+	got, err = ti("noexp")
+	if assert.NoError(t, err, "active token without exp") {
+		assert.Equal(t, "client2", got.ClientID)
+		assert.Equal(t, 10, got.ExpiresIn, "max age")
+		assert.False(t, got.expired(got.Timestamp.Add(9*time.Second)))
+		assert.True(t, got.expired(got.Timestamp.Add(10*time.Second)))
+	}
+
+	_, err = ti("inactive")
+	assert.Error(t, err, "inactive token")
+	_, isRejected := err.(*TokenRejectedError)
+	assert.True(t, isRejected, "inactive token is rejected")
+
+	_, err = IntrospectionTokeninfo(srv.URL, "apigw", "wrong", 10*time.Second)("active")
+	assert.Error(t, err, "wrong client secret")
+
+	// A token without exp is cached for Freshness.
+	tic := NewTokeninfoClientWithConfig(TokeninfoClientConfig{URL: srv.URL, Introspection: true,
+		ClientID: "apigw", ClientSecret: "s3cret", Freshness: time.Minute})
+	got, err = tic.Call("noexp")
+	if assert.NoError(t, err, "client") {
+		assert.Equal(t, "client2", got.ClientID)
+		e, ok := tic.cache.get(tokenKey("noexp"))
+		if assert.True(t, ok, "cached") {
+			assert.Equal(t, got.Timestamp.Add(time.Minute), e.expires)
+		}
+	}
+}
+
+// TestTokeninfoClientCoalescing shows that concurrent calls for the same token result in one IDP call.
+func TestTokeninfoClientCoalescing(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	tic := NewTokeninfoClient("not-used")
+	tic.basicCall = func(token string) (*TokeninfoResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &TokeninfoResponse{ClientID: "client1", ExpiresIn: 60, Timestamp: time.Now()}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ti, err := tic.Call("token")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "client1", ti.ClientID)
+			}
+		}()
+	}
+	// give the goroutines time to join the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+// TestFlightGroupPanic shows that callers waiting for a call that panics get an error and that the key can be used
+// again.
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		defer func() {
+			recover()
+		}()
+		g.do("key", func() (*TokeninfoResponse, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	go func() {
+		_, err := g.do("key", func() (*TokeninfoResponse, error) {
+			t.Error("waiter must not call fn")
+			return nil, nil
+		})
+		done <- err
+	}()
+	// give the waiter time to join the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-done:
+		assert.Equal(t, errFlightPanic, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter is blocked")
+	}
+
+	ti, err := g.do("key", func() (*TokeninfoResponse, error) {
+		return &TokeninfoResponse{ClientID: "client1"}, nil
+	})
+	if assert.NoError(t, err, "key is released") {
+		assert.Equal(t, "client1", ti.ClientID)
+	}
+}
+
+// TestTokeninfoClientDefaults shows that a negative MaxEntries or GCInterval gets the default value.
+func TestTokeninfoClientDefaults(t *testing.T) {
+	tic := NewTokeninfoClientWithConfig(TokeninfoClientConfig{MaxEntries: -1, GCInterval: -time.Second})
+	tic.basicCall = func(token string) (*TokeninfoResponse, error) {
+		return &TokeninfoResponse{ClientID: "client1", ExpiresIn: 60, Timestamp: time.Now()}, nil
+	}
+	assert.Equal(t, DefaultTokeninfoClientConfig.MaxEntries, tic.cache.maxEntries)
+	assert.Equal(t, DefaultTokeninfoClientConfig.GCInterval, tic.cache.gcInterval)
+
+	assert.NotPanics(t, func() {
+		_, err := tic.Call("token")
+		assert.NoError(t, err)
+		tic.EnableGC(true)
+		tic.EnableGC(false)
+	})
+}
+
+// TestTokeninfoClientNegativeCache shows that rejected tokens are cached for NegativeTTL and other errors are not
+// cached.
+func TestTokeninfoClientNegativeCache(t *testing.T) {
+	var calls int
+	var err error
+	tic := NewTokeninfoClientWithConfig(TokeninfoClientConfig{NegativeTTL: 50 * time.Millisecond})
+	tic.basicCall = func(token string) (*TokeninfoResponse, error) {
+		calls++
+		return nil, err
+	}
+
+	// IDP unavailable
+	err = fmt.Errorf("connection refused")
+	tic.Call("bad")
+	tic.Call("bad")
+	assert.Equal(t, 2, calls, "errors are not cached")
+
+	// IDP rejects token
+	calls = 0
+	err = &TokenRejectedError{Reason: "invalid"}
+	_, got := tic.Call("bad")
+	assert.Equal(t, err, got)
+	_, got = tic.Call("bad")
+	assert.Equal(t, err, got)
+	assert.Equal(t, 1, calls, "rejections are cached")
+
+	time.Sleep(60 * time.Millisecond)
+	tic.Call("bad")
+	assert.Equal(t, 2, calls, "rejections expire after NegativeTTL")
+}
+
+// TestTokeninfoCache shows that the cache is bounded (least recently used entries are evicted), keyed by token hash and
+// that expired entries are garbage collected.
+func TestTokeninfoCache(t *testing.T) {
+	c := newTokeninfoCache(2, time.Minute)
+	now := time.Now()
+
+	c.set(tokenKey("a"), &tokeninfoEntry{expires: now.Add(time.Minute)})
+	c.set(tokenKey("b"), &tokeninfoEntry{expires: now.Add(-time.Second)})
+	_, ok := c.get(tokenKey("a"))
+	assert.True(t, ok)
+	// "b" is least recently used
+	c.set(tokenKey("c"), &tokeninfoEntry{expires: now.Add(time.Minute)})
+	assert.Equal(t, 2, c.len())
+	_, ok = c.get(tokenKey("b"))
+	assert.False(t, ok, "b evicted")
+
+	for k := range c.data {
+		assert.NotContains(t, []string{"a", "b", "c"}, k, "raw token used as key")
+	}
+
+	c.set(tokenKey("d"), &tokeninfoEntry{expires: now.Add(-time.Second)})
+	c.gc(now)
+	assert.Equal(t, 1, c.len())
+	_, ok = c.get(tokenKey("c"))
+	assert.True(t, ok, "c not expired")
+}
+
+// TestTokenExpiresWhileCached shows that a cached tokeninfo is rejected as soon as its absolute expiry time has passed
+// even when it's still fresh.
+func TestTokenExpiresWhileCached(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := t0
+	timeNow = func() time.Time { return now }
+
+	var calls int
+	tic := NewTokeninfoClientWithConfig(TokeninfoClientConfig{Freshness: time.Minute})
+	tic.basicCall = func(token string) (*TokeninfoResponse, error) {
+		calls++
+		return &TokeninfoResponse{
+			Scopes:    map[string]struct{}{"read": {}},
+			ExpiresIn: 5,
+			Timestamp: t0,
+		}, nil
+	}
+	oauth2 := OAuth2WithConfig(OAuth2Config{
+		RequiredScopes: func(method string, url *url.URL) ([]string, error) {
+			return []string{"read"}, nil
+		},
+		Tokeninfo: tic.Call,
+	})
+	h := oauth2(func(c echo.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	call := func() int {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.Header.Add("Authorization", "Bearer value-not-important")
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		err := h(c)
+		if err != nil {
+			return err.(*echo.HTTPError).Code
+		}
+		return c.Response().Status
+	}
+
+	var tests = []struct {
+		at    time.Duration
+		want  int
+		calls int
+		info  string
+	}{
+		{at: 0, want: http.StatusOK, calls: 1, info: "valid"},
+		{at: 4 * time.Second, want: http.StatusOK, calls: 1, info: "valid, cached"},
+		{at: 5 * time.Second, want: http.StatusUnauthorized, calls: 2, info: "expired, cached entry not used"},
+		{at: 6 * time.Second, want: http.StatusUnauthorized, calls: 2, info: "expired, rejection cached"},
+	}
+	for _, tst := range tests {
+		now = t0.Add(tst.at)
+		assert.Equal(t, tst.want, call(), tst.info)
+		assert.Equal(t, tst.calls, calls, tst.info)
+	}
+}
+
+// TestTokeninfoResponseExpired shows how the absolute expiry is determined.
+func TestTokeninfoResponseExpired(t *testing.T) {
+	t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		ti   TokeninfoResponse
+		now  time.Time
+		want bool
+		info string
+	}{
+		{ti: TokeninfoResponse{Expires: t0}, now: t0.Add(-time.Second), want: false, info: "before Expires"},
+		{ti: TokeninfoResponse{Expires: t0}, now: t0, want: true, info: "at Expires"},
+		{ti: TokeninfoResponse{Expires: t0, ExpiresIn: 60, Timestamp: t0}, now: t0.Add(time.Second), want: true, info: "Expires takes precedence"},
+		{ti: TokeninfoResponse{ExpiresIn: 60, Timestamp: t0}, now: t0.Add(59 * time.Second), want: false, info: "before Timestamp+ExpiresIn"},
+		{ti: TokeninfoResponse{ExpiresIn: 60, Timestamp: t0}, now: t0.Add(60 * time.Second), want: true, info: "at Timestamp+ExpiresIn"},
+		{ti: TokeninfoResponse{ExpiresIn: 10}, now: t0, want: false, info: "only ExpiresIn"},
+		{ti: TokeninfoResponse{ExpiresIn: 0}, now: t0, want: true, info: "only ExpiresIn, expired"},
+	}
+	for _, tst := range tests {
+		assert.Equal(t, tst.want, tst.ti.expired(tst.now), tst.info)
+	}
+}
+
+// TestWWWAuthenticate shows that a RFC 6750 WWW-Authenticate header is set when access is denied.
+func TestWWWAuthenticate(t *testing.T) {
+	var tests = []struct {
+		auth    string
+		tierr   error
+		allowed map[string]struct{}
+		want    int
+		header  string
+		info    string
+	}{
+		{auth: "", want: http.StatusUnauthorized, header: `Bearer`, info: "missing token"},
+		{auth: "Bearer x", tierr: &TokenRejectedError{Reason: "invalid"}, want: http.StatusUnauthorized, header: `Bearer error="invalid_token"`, info: "invalid token"},
+		{auth: "Bearer x", allowed: map[string]struct{}{"read": {}}, want: http.StatusForbidden, header: `Bearer error="insufficient_scope", scope="read write"`, info: "insufficient scope"},
+		{auth: "Bearer x", allowed: map[string]struct{}{"read": {}, "write": {}}, want: http.StatusOK, header: "", info: "allowed"},
+	}
+
+	for _, tst := range tests {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		if tst.auth != "" {
+			req.Header.Add("Authorization", tst.auth)
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		oauth2 := OAuth2WithConfig(OAuth2Config{
+			RequiredScopes: func(method string, url *url.URL) ([]string, error) {
+				return []string{"read", "write"}, nil
+			},
+			Tokeninfo: func(token string) (*TokeninfoResponse, error) {
+				return &TokeninfoResponse{Scopes: tst.allowed, ExpiresIn: 10}, tst.tierr
+			},
+		})
+		h := oauth2(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})
+
+		err := h(c)
+		if err != nil {
+			assert.Equal(t, tst.want, err.(*echo.HTTPError).Code, tst.info)
+		} else {
+			assert.Equal(t, tst.want, c.Response().Status, tst.info)
+		}
+		assert.Equal(t, tst.header, rec.Header().Get("WWW-Authenticate"), tst.info)
+	}
+
+	// Missing credentials of an operation that requires an api key and a token.
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	oauth2 := OAuth2WithConfig(OAuth2Config{
+		Operation: func(method string, url *url.URL) (*path.Operation, error) {
+			key := path.Scheme{Name: "api_key", Type: path.SchemeTypeAPIKey, In: "header", Param: "X-Api-Key"}
+			return &path.Operation{Security: path.Requirements{{Token: true, Schemes: []path.Scheme{key}}}}, nil
+		},
+		Tokeninfo: func(token string) (*TokeninfoResponse, error) {
+			return nil, fmt.Errorf("not used")
+		},
+	})
+	err := oauth2(func(c echo.Context) error {
+		return c.String(http.StatusOK, "test")
+	})(c)
+	assert.Equal(t, ErrCredentialsMissing, err)
+	assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"), "missing credentials")
+}
+
+// TestTokenWithoutScopes shows that a requirement of a token without scopes isn't public.
+func TestTokenWithoutScopes(t *testing.T) {
+	var tests = []struct {
+		authorization string
+		want          int
+		info          string
+	}{
+		{authorization: "", want: http.StatusUnauthorized, info: "missing token"},
+		{authorization: "Bearer invalid", want: http.StatusUnauthorized, info: "invalid token"},
+		{authorization: "Bearer valid", want: http.StatusOK, info: "valid token"},
+	}
+
+	for _, tst := range tests {
+		e := echo.New()
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		if tst.authorization != "" {
+			req.Header.Add("Authorization", tst.authorization)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		oauth2 := OAuth2WithConfig(OAuth2Config{
+			Operation: func(method string, url *url.URL) (*path.Operation, error) {
+				return &path.Operation{Security: path.Requirements{{Token: true}}}, nil
+			},
+			Tokeninfo: func(token string) (*TokeninfoResponse, error) {
+				if token != "valid" {
+					return nil, &TokenRejectedError{Reason: "invalid"}
+				}
+				return &TokeninfoResponse{ClientID: "app1", ExpiresIn: 10}, nil
+			},
+		})
+		h := oauth2(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})
+
+		err := h(c)
+		if err != nil {
+			assert.Equal(t, tst.want, err.(*echo.HTTPError).Code, tst.info)
+			assert.Contains(t, rec.Header().Get(echo.HeaderWWWAuthenticate), "Bearer", tst.info)
+		} else {
+			assert.Equal(t, tst.want, c.Response().Status, tst.info)
+		}
+	}
+}
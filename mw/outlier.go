@@ -0,0 +1,181 @@
+package mw
+
+/*
+	Passive health checking (outlier detection) of proxy targets.
+
+	Connection errors and 5xx responses of live traffic are counted per target. A target with ConsecutiveErrors
+	errors in a row is ejected from balancer rotation for BaseEjectionTime, each next ejection doubles that time up to
+	MaxEjectionTime. A target that stays in rotation for MaxEjectionTime starts over at BaseEjectionTime.
+	No more than MaxEjectionPercent of the targets (of a pool) are ejected at the same time.
+*/
+
+import (
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// OutlierConfig defines when targets are ejected.
+	OutlierConfig struct {
+		// ConsecutiveErrors is the number of connection errors or 5xx responses in a row that eject a target.
+		// Optional. Default value 5.
+		ConsecutiveErrors int
+		// BaseEjectionTime is the duration of the first ejection.
+		// Optional. Default value 30s.
+		BaseEjectionTime time.Duration
+		// MaxEjectionTime caps the exponentially growing ejection duration.
+		// Optional. Default value 5m.
+		MaxEjectionTime time.Duration
+		// MaxEjectionPercent is the max percentage of targets that are ejected at the same time.
+		// Optional. Default value 50.
+		MaxEjectionPercent int
+	}
+
+	// OutlierDetector ejects targets that fail live traffic.
+	OutlierDetector struct {
+		config OutlierConfig
+		// pools are groups of targets that MaxEjectionPercent applies to.
+		pools [][]*ProxyTarget
+		// mutex serializes ejection decisions so MaxEjectionPercent holds.
+		mutex sync.Mutex
+	}
+
+	// TargetOutlier is the outlier detection state of a target.
+	targetOutlier struct {
+		mutex sync.Mutex
+		// errors is the number of consecutive errors.
+		errors int
+		// ejections is the number of consecutive ejections.
+		ejections int
+		// ejectedUntil is the end of the current or last ejection in unix nanoseconds (accessed atomically).
+		ejectedUntil int64
+	}
+)
+
+var (
+	// DefaultOutlierConfig is the default outlier detection config.
+	DefaultOutlierConfig = OutlierConfig{
+		ConsecutiveErrors:  5,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}
+)
+
+// Metrics
+var (
+	proxyTargetEjections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "apigw",
+			Subsystem: "proxy",
+			Name:      "target_ejections_total",
+			Help:      "Number of times a proxy target is ejected by outlier detection.",
+		}, []string{"target"})
+)
+
+func init() {
+	prometheus.MustRegister(proxyTargetEjections)
+}
+
+// NewOutlierDetector returns an outlier detector for one or more pools of targets.
+func NewOutlierDetector(config OutlierConfig, pools ...[]*ProxyTarget) *OutlierDetector {
+	// Defaults
+	if config.ConsecutiveErrors <= 0 {
+		config.ConsecutiveErrors = DefaultOutlierConfig.ConsecutiveErrors
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = DefaultOutlierConfig.BaseEjectionTime
+	}
+	if config.MaxEjectionTime <= 0 {
+		config.MaxEjectionTime = DefaultOutlierConfig.MaxEjectionTime
+	}
+	if config.MaxEjectionTime < config.BaseEjectionTime {
+		config.MaxEjectionTime = config.BaseEjectionTime
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = DefaultOutlierConfig.MaxEjectionPercent
+	}
+	if config.MaxEjectionPercent > 100 {
+		config.MaxEjectionPercent = 100
+	}
+
+	return &OutlierDetector{config: config, pools: pools}
+}
+
+// Success records a successful request to t.
+func (d *OutlierDetector) Success(t *ProxyTarget) {
+	t.outlier.mutex.Lock()
+	t.outlier.errors = 0
+	t.outlier.mutex.Unlock()
+}
+
+// Failure records a connection error or 5xx response of t and ejects t when it has too many consecutive errors.
+func (d *OutlierDetector) Failure(t *ProxyTarget) {
+	o := &t.outlier
+	o.mutex.Lock()
+	o.errors++
+	n := o.errors
+	o.mutex.Unlock()
+	if n < d.config.ConsecutiveErrors {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := timeNow()
+	if t.Ejected(now) {
+		// requests that were in-flight during ejection.
+		return
+	}
+	ejected := 0
+	targets := d.pool(t)
+	for _, x := range targets {
+		if x.Ejected(now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > d.config.MaxEjectionPercent*len(targets) {
+		glog.Warningf("proxy target %s has %d consecutive errors, not ejected because %d of %d targets are ejected",
+			t.URL, n, ejected, len(targets))
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&o.ejectedUntil))) > d.config.MaxEjectionTime {
+		// the target has been in rotation long enough to start over.
+		o.ejections = 0
+	}
+	o.ejections++
+	o.errors = 0
+	duration := d.config.BaseEjectionTime
+	for i := 1; i < o.ejections && duration < d.config.MaxEjectionTime; i++ {
+		duration *= 2
+	}
+	if duration > d.config.MaxEjectionTime {
+		duration = d.config.MaxEjectionTime
+	}
+	atomic.StoreInt64(&o.ejectedUntil, now.Add(duration).UnixNano())
+	proxyTargetEjections.WithLabelValues(t.URL.String()).Inc()
+	glog.Warningf("proxy target %s is ejected for %v after %d consecutive errors", t.URL, duration, n)
+}
+
+// Pool returns the targets of the pool of t.
+func (d *OutlierDetector) pool(t *ProxyTarget) []*ProxyTarget {
+	for _, p := range d.pools {
+		for _, x := range p {
+			if x == t {
+				return p
+			}
+		}
+	}
+	return []*ProxyTarget{t}
+}
+
+// Ejected returns true when t is ejected by outlier detection at time now.
+func (t *ProxyTarget) Ejected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&t.outlier.ejectedUntil)
+}
@@ -0,0 +1,106 @@
+package mw
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestOutlierDetector shows that targets are ejected for an exponentially growing period and that no more than
+// MaxEjectionPercent of the targets are ejected.
+func TestOutlierDetector(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	var targets []*ProxyTarget
+	for _, h := range []string{"one", "two", "three", "four"} {
+		targets = append(targets, &ProxyTarget{URL: &url.URL{Scheme: "http", Host: h}})
+	}
+	d := NewOutlierDetector(OutlierConfig{
+		ConsecutiveErrors:  2,
+		BaseEjectionTime:   time.Second,
+		MaxEjectionTime:    3 * time.Second,
+		MaxEjectionPercent: 50,
+	}, targets)
+	one := targets[0]
+
+	// errors must be consecutive.
+	d.Failure(one)
+	d.Success(one)
+	d.Failure(one)
+	assert.False(t, one.Ejected(now), "not consecutive")
+
+	var tests = []struct {
+		want time.Duration
+		info string
+	}{
+		{want: 1 * time.Second, info: "1st ejection"},
+		{want: 2 * time.Second, info: "2nd ejection"},
+		{want: 3 * time.Second, info: "3rd ejection is capped"},
+	}
+	d.Success(one)
+	for _, tst := range tests {
+		d.Failure(one)
+		d.Failure(one)
+		assert.True(t, one.Ejected(now), tst.info)
+		assert.True(t, one.Ejected(now.Add(tst.want-time.Millisecond)), tst.info)
+		assert.False(t, one.Ejected(now.Add(tst.want)), tst.info)
+		now = now.Add(tst.want)
+	}
+
+	// in rotation longer than MaxEjectionTime starts over.
+	now = now.Add(4 * time.Second)
+	d.Failure(one)
+	d.Failure(one)
+	assert.False(t, one.Ejected(now.Add(time.Second)), "start over")
+
+	// max 2 of 4 targets are ejected.
+	for _, x := range targets[1:] {
+		d.Failure(x)
+		d.Failure(x)
+	}
+	assert.True(t, targets[1].Ejected(now), "2nd target")
+	assert.False(t, targets[2].Ejected(now), "3rd target")
+	assert.False(t, targets[3].Ejected(now), "4th target")
+	assert.NotNil(t, one.Status().EjectedUntil)
+	assert.Nil(t, targets[2].Status().EjectedUntil)
+}
+
+// TestProxyOutlier shows that a target that responds with 5xx is taken out of rotation.
+func TestProxyOutlier(t *testing.T) {
+	upstream := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+	}
+	good := upstream(http.StatusOK)
+	defer good.Close()
+	bad := upstream(http.StatusBadGateway)
+	defer bad.Close()
+
+	var targets []*ProxyTarget
+	for _, s := range []*httptest.Server{good, bad} {
+		u, _ := url.Parse(s.URL)
+		targets = append(targets, &ProxyTarget{URL: u})
+	}
+	config := DefaultProxyConfig
+	config.Balancer = NewRoundRobinBalancer(targets)
+	config.OutlierDetector = NewOutlierDetector(OutlierConfig{ConsecutiveErrors: 2}, targets)
+	e := echo.New()
+	e.Use(ProxyWithConfig(config))
+
+	var got []int
+	for i := 0; i < 8; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(echo.GET, "/", nil))
+		got = append(got, rec.Code)
+	}
+	assert.Equal(t, []int{200, 502, 200, 502, 200, 200, 200, 200}, got)
+	assert.False(t, targets[0].Ejected(time.Now()))
+	assert.True(t, targets[1].Ejected(time.Now()))
+}
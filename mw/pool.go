@@ -0,0 +1,200 @@
+package mw
+
+import (
+	"github.com/golang/glog"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Routing requests to named target pools.
+
+	The pool of a request is, in order of precedence:
+	- the x-apigw-upstream extension of the operation
+	- the pool of the first matching route
+	- the default pool
+	A canary of the pool can send the request to its canary pool instead. Each pool has its own balancer.
+*/
+
+type (
+	// PoolBalancerConfig defines the pools and the routes to them.
+	PoolBalancerConfig struct {
+		// Pools by name.
+		// Required.
+		Pools map[string]ProxyBalancer
+		// Default is the pool of requests that don't match a route.
+		// Required.
+		Default string
+		// Routes are matched in order.
+		// Optional.
+		Routes []PoolRoute
+		// Operation gets the operation of a request.
+		// Optional. When nil only "Operation" from context and path prefixes are used.
+		Operation OperationFunc
+		// Canaries split the traffic of a pool with a canary pool.
+		// Optional.
+		Canaries []*Canary
+	}
+
+	// PoolRoute sends matching requests to Pool.
+	// A route matches when all of its non-empty matchers match.
+	PoolRoute struct {
+		// PathPrefix matches the request path and its sub paths.
+		PathPrefix string
+		// Tag matches operations with this OpenAPI tag.
+		Tag string
+		// OperationID matches the operation with this operationId.
+		OperationID string
+		// Pool is the name of the pool.
+		Pool string
+	}
+
+	// PoolBalancer selects a pool for a request and returns a target of the pool's balancer.
+	poolBalancer struct {
+		config PoolBalancerConfig
+		// canaries by pool.
+		canaries map[string]*Canary
+	}
+)
+
+// Metrics
+var (
+	poolRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "apigw",
+			Subsystem: "proxy",
+			Name:      "pool_requests_total",
+			Help:      "Counter of proxied requests by target pool and status.",
+		}, []string{"pool", "status"})
+
+	poolRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "apigw",
+			Subsystem: "proxy",
+			Name:      "pool_request_duration_seconds",
+			Help:      "Histogram of upstream handling time of proxied requests by target pool.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 13),
+		}, []string{"pool"})
+)
+
+func init() {
+	prometheus.MustRegister(poolRequests)
+	prometheus.MustRegister(poolRequestDuration)
+}
+
+// NewPoolBalancer returns a balancer that routes requests to target pools.
+// The pool of a request is added to context as "Pool".
+func NewPoolBalancer(config PoolBalancerConfig) ProxyBalancer {
+	if config.Pools[config.Default] == nil {
+		panic("echo: pool balancer requires default pool")
+	}
+	for _, r := range config.Routes {
+		if config.Pools[r.Pool] == nil {
+			panic("echo: pool balancer route requires existing pool " + r.Pool)
+		}
+	}
+	b := &poolBalancer{config: config, canaries: map[string]*Canary{}}
+	for _, cn := range config.Canaries {
+		if config.Pools[cn.config.Pool] == nil || config.Pools[cn.config.Canary] == nil {
+			panic("echo: pool balancer canary requires existing pools " + cn.config.Pool + " and " + cn.config.Canary)
+		}
+		if b.canaries[cn.config.Pool] != nil {
+			panic("echo: pool balancer allows one canary per pool " + cn.config.Pool)
+		}
+		b.canaries[cn.config.Pool] = cn
+	}
+	return b
+}
+
+// Next returns a target of the pool of the request.
+func (b *poolBalancer) Next(c echo.Context) *ProxyTarget {
+	name := b.pool(c)
+	c.Set("Pool", name)
+	return b.config.Pools[name].Next(c)
+}
+
+// AddTarget adds an upstream target to the default pool.
+func (b *poolBalancer) AddTarget(target *ProxyTarget) bool {
+	return b.config.Pools[b.config.Default].AddTarget(target)
+}
+
+// RemoveTarget removes an upstream target from the default pool.
+func (b *poolBalancer) RemoveTarget(name string) bool {
+	return b.config.Pools[b.config.Default].RemoveTarget(name)
+}
+
+// Pool returns the name of the pool of the request.
+func (b *poolBalancer) pool(c echo.Context) string {
+	// a pool that was selected before, for example by a retry.
+	if name, ok := c.Get("Pool").(string); ok && b.config.Pools[name] != nil {
+		return name
+	}
+	name := b.route(c)
+	if cn := b.canaries[name]; cn != nil && cn.selects(c) {
+		return cn.config.Canary
+	}
+	return name
+}
+
+// Route returns the name of the pool the request is routed to.
+func (b *poolBalancer) route(c echo.Context) string {
+	var id, upstream string
+	var tags []string
+	if b.config.Operation != nil || c.Get("Operation") != nil {
+		op, err := operation(c, b.config.Operation)
+		if err == nil && op != nil {
+			id, tags, upstream = op.ID, op.Tags, op.Upstream
+		}
+	}
+	if upstream != "" {
+		if b.config.Pools[upstream] != nil {
+			return upstream
+		}
+		glog.Warningf("proxy: operation %s %s: x-apigw-upstream pool %q doesn't exist", c.Request().Method, c.Request().URL.Path, upstream)
+	}
+
+	for _, r := range b.config.Routes {
+		if r.match(c.Request().URL.Path, id, tags) {
+			return r.Pool
+		}
+	}
+	return b.config.Default
+}
+
+// Match returns true when all non-empty matchers of the route match.
+func (r *PoolRoute) match(p, id string, tags []string) bool {
+	if r.PathPrefix != "" && !hasPathPrefix(p, r.PathPrefix) {
+		return false
+	}
+	if r.OperationID != "" && r.OperationID != id {
+		return false
+	}
+	if r.Tag != "" {
+		found := false
+		for _, t := range tags {
+			if t == r.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.PathPrefix != "" || r.OperationID != "" || r.Tag != ""
+}
+
+// ObservePool updates the pool metrics of a proxied request.
+func observePool(pool string, status int, d time.Duration) {
+	poolRequests.WithLabelValues(pool, strconv.Itoa(status)).Inc()
+	poolRequestDuration.WithLabelValues(pool).Observe(d.Seconds())
+}
+
+// HasPathPrefix returns true when p is prefix or a sub path of prefix.
+func hasPathPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
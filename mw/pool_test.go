@@ -0,0 +1,82 @@
+package mw
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// TestPoolBalancer shows that requests are routed to a pool by the x-apigw-upstream extension, by routes or to the
+// default pool.
+func TestPoolBalancer(t *testing.T) {
+	pools := map[string]ProxyBalancer{}
+	for _, name := range []string{"monolith", "accounts", "payments"} {
+		pools[name] = NewRoundRobinBalancer([]*ProxyTarget{{Pool: name, URL: &url.URL{Scheme: "http", Host: name}}})
+	}
+	ops := map[string]*path.Operation{
+		"/accounts/1":  {ID: "getAccount", Tags: []string{"accounts"}},
+		"/accountsx":   {ID: "getAccountsX"},
+		"/transfers":   {ID: "transfer", Tags: []string{"payments", "accounts"}},
+		"/legacy/pay":  {ID: "legacyPay", Upstream: "payments"},
+		"/statements":  {ID: "getStatements"},
+		"/unknown":     {ID: "unknown", Upstream: "nonexistent"},
+		"/accounts/me": {ID: "getMe", Upstream: "monolith"},
+	}
+	b := NewPoolBalancer(PoolBalancerConfig{
+		Pools:   pools,
+		Default: "monolith",
+		Routes: []PoolRoute{
+			{PathPrefix: "/accounts/", Pool: "accounts"},
+			{Tag: "payments", Pool: "payments"},
+			{OperationID: "getStatements", Pool: "accounts"},
+		},
+		Operation: func(method string, url *url.URL) (*path.Operation, error) {
+			return ops[url.Path], nil
+		},
+	})
+
+	var tests = []struct {
+		path string
+		want string
+		info string
+	}{
+		{path: "/accounts/1", want: "accounts", info: "path prefix"},
+		{path: "/accountsx", want: "monolith", info: "path prefix matches segments"},
+		{path: "/transfers", want: "payments", info: "tag"},
+		{path: "/statements", want: "accounts", info: "operationId"},
+		{path: "/legacy/pay", want: "payments", info: "extension"},
+		{path: "/accounts/me", want: "monolith", info: "extension takes precedence"},
+		{path: "/unknown", want: "monolith", info: "extension with unknown pool"},
+		{path: "/other", want: "monolith", info: "no operation"},
+	}
+	e := echo.New()
+	for _, tst := range tests {
+		c := e.NewContext(httptest.NewRequest(echo.GET, tst.path, nil), nil)
+		assert.Equal(t, tst.want, b.Next(c).Pool, tst.info)
+		assert.Equal(t, tst.want, c.Get("Pool"), tst.info)
+	}
+}
+
+func TestPoolRouteMatch(t *testing.T) {
+	var tests = []struct {
+		route PoolRoute
+		path  string
+		want  bool
+	}{
+		{route: PoolRoute{PathPrefix: "/accounts"}, path: "/accounts", want: true},
+		{route: PoolRoute{PathPrefix: "/accounts"}, path: "/accounts/1", want: true},
+		{route: PoolRoute{PathPrefix: "/accounts/"}, path: "/accounts", want: true},
+		{route: PoolRoute{PathPrefix: "/accounts"}, path: "/accountsx", want: false},
+		{route: PoolRoute{PathPrefix: "/"}, path: "/any", want: true},
+		{route: PoolRoute{PathPrefix: "/accounts", OperationID: "getAccount"}, path: "/accounts/1", want: true},
+		{route: PoolRoute{PathPrefix: "/accounts", OperationID: "other"}, path: "/accounts/1", want: false},
+		{route: PoolRoute{Tag: "accounts"}, path: "/x", want: true},
+		{route: PoolRoute{}, path: "/x", want: false},
+	}
+	for _, tst := range tests {
+		assert.Equal(t, tst.want, tst.route.match(tst.path, "getAccount", []string{"accounts"}), "%+v %s", tst.route, tst.path)
+	}
+}
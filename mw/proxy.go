@@ -1,6 +1,7 @@
 package mw
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -18,8 +19,6 @@ import (
 
 // This is a copy of echo/middleware/proxy.go with modifications to provide our proxyHTTP().
 
-// TODO: Handle TLS proxy
-
 type (
 	// ProxyConfig defines the config for Proxy middleware.
 	ProxyConfig struct {
@@ -47,6 +46,18 @@ type (
 		// Examples: If custom TLS certificates are required.
 		Transport http.RoundTripper
 
+		// OutlierDetector ejects targets that fail live traffic.
+		// Optional. See NewOutlierDetector.
+		OutlierDetector *OutlierDetector
+
+		// Retry retries idempotent requests on another target.
+		// Optional. See NewRetryPolicy.
+		Retry *RetryPolicy
+
+		// SSEIdleTimeout closes a Server-Sent Events stream that receives no data from upstream.
+		// Optional. Default value 5m.
+		SSEIdleTimeout time.Duration
+
 		rewriteRegex map[*regexp.Regexp]string
 	}
 
@@ -55,6 +66,28 @@ type (
 		Name string
 		URL  *url.URL
 		Meta echo.Map
+		// TLS is the client TLS config for https and wss targets.
+		// Optional. When nil the system roots verify the target.
+		TLS *tls.Config
+		// Transport forwards HTTP requests to the target, it takes precedence over ProxyConfig.Transport.
+		// Optional. See NewProxyTransport.
+		Transport http.RoundTripper
+		// HealthCheck enables active health checking, see RunHealthCheck.
+		// Optional. When nil the target is always healthy.
+		HealthCheck *HealthCheckConfig
+		// Pool is the name of the target pool the target belongs to, see NewPoolBalancer.
+		// Optional.
+		Pool string
+		// Weight is the relative share of requests the target gets from weighted balancers.
+		// Optional. Default value 1.
+		Weight int
+
+		// unhealthy is 1 when the target fails active health checks (accessed atomically).
+		unhealthy int32
+		// outstanding is the number of in-flight requests (accessed atomically).
+		outstanding int32
+		health    targetHealth
+		outlier   targetOutlier
 	}
 
 	// ProxyBalancer defines an interface to implement a load balancing technique.
@@ -72,7 +105,6 @@ type (
 	// RandomBalancer implements a random load balancing technique.
 	randomBalancer struct {
 		*commonBalancer
-		random *rand.Rand
 	}
 
 	// RoundRobinBalancer implements a round-robin load balancing technique.
@@ -85,27 +117,45 @@ type (
 var (
 	// DefaultProxyConfig is the default Proxy middleware config.
 	DefaultProxyConfig = ProxyConfig{
-		Skipper:    middleware.DefaultSkipper,
-		ContextKey: "target",
+		Skipper:        middleware.DefaultSkipper,
+		ContextKey:     "target",
+		SSEIdleTimeout: 5 * time.Minute,
 	}
+
+	// ProxyDialTimeout is the max time to connect to a target.
+	proxyDialTimeout = 30 * time.Second
 )
 
-func proxyRaw(t *ProxyTarget, c echo.Context) http.Handler {
+func proxyRaw(t *ProxyTarget, c echo.Context, config ProxyConfig) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		in, _, err := c.Response().Hijack()
-		if err != nil {
-			c.Error(fmt.Errorf("proxy raw, hijack error=%v, url=%s", t.URL, err))
-			return
+		// Dial before hijacking so a failure can be reported to the client.
+		var out net.Conn
+		var err error
+		dialer := &net.Dialer{Timeout: proxyDialTimeout}
+		if secureScheme(t.URL.Scheme) {
+			out, err = tls.DialWithDialer(dialer, "tcp", targetAddr(t.URL), targetTLSConfig(t))
+		} else {
+			out, err = dialer.DialContext(r.Context(), "tcp", targetAddr(t.URL))
 		}
-		defer in.Close()
-
-		out, err := net.Dial("tcp", t.URL.Host)
 		if err != nil {
+			if d := config.OutlierDetector; d != nil {
+				d.Failure(t)
+			}
 			he := echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("proxy raw, dial error=%v, url=%s", t.URL, err))
 			c.Error(he)
 			return
 		}
 		defer out.Close()
+		if d := config.OutlierDetector; d != nil {
+			d.Success(t)
+		}
+
+		in, _, err := c.Response().Hijack()
+		if err != nil {
+			c.Error(fmt.Errorf("proxy raw, hijack error=%v, url=%s", t.URL, err))
+			return
+		}
+		defer in.Close()
 
 		// Write header
 		err = r.Write(out)
@@ -130,6 +180,51 @@ func proxyRaw(t *ProxyTarget, c echo.Context) http.Handler {
 	})
 }
 
+// NewProxyTransport returns a transport with the settings of http.DefaultTransport and tlsConfig.
+func NewProxyTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   proxyDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+// SecureScheme returns true for schemes that use TLS.
+func secureScheme(scheme string) bool {
+	return scheme == "https" || scheme == "wss"
+}
+
+// TargetAddr returns the host:port of an url, the port defaults to the scheme default.
+func targetAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if secureScheme(u.Scheme) {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// TargetTLSConfig returns the TLS config to dial target t with.
+func targetTLSConfig(t *ProxyTarget) *tls.Config {
+	c := &tls.Config{}
+	if t.TLS != nil {
+		c = t.TLS.Clone()
+	}
+	if c.ServerName == "" {
+		c.ServerName = t.URL.Hostname()
+	}
+	return c
+}
+
 // NewRandomBalancer returns a random proxy balancer.
 func NewRandomBalancer(targets []*ProxyTarget) ProxyBalancer {
 	b := &randomBalancer{commonBalancer: new(commonBalancer)}
@@ -146,14 +241,16 @@ func NewRoundRobinBalancer(targets []*ProxyTarget) ProxyBalancer {
 
 // AddTarget adds an upstream target to the list.
 func (b *commonBalancer) AddTarget(target *ProxyTarget) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	for _, t := range b.targets {
 		if t.Name == target.Name {
 			return false
 		}
 	}
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	b.targets = append(b.targets, target)
+	// copy on write; the slice that is passed to the constructor may be shared.
+	targets := make([]*ProxyTarget, 0, len(b.targets)+1)
+	b.targets = append(append(targets, b.targets...), target)
 	return true
 }
 
@@ -163,7 +260,8 @@ func (b *commonBalancer) RemoveTarget(name string) bool {
 	defer b.mutex.Unlock()
 	for i, t := range b.targets {
 		if t.Name == name {
-			b.targets = append(b.targets[:i], b.targets[i+1:]...)
+			targets := make([]*ProxyTarget, 0, len(b.targets)-1)
+			b.targets = append(append(targets, b.targets[:i]...), b.targets[i+1:]...)
 			return true
 		}
 	}
@@ -172,20 +270,57 @@ func (b *commonBalancer) RemoveTarget(name string) bool {
 
 // Next randomly returns an upstream target.
 func (b *randomBalancer) Next(c echo.Context) *ProxyTarget {
-	if b.random == nil {
-		b.random = rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
-	}
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
-	return b.targets[b.random.Intn(len(b.targets))]
+	available := availableTargets(b.targets)
+	if len(available) == 0 {
+		return nil
+	}
+	// the top-level rand functions are safe for concurrent use.
+	return available[rand.Intn(len(available))]
 }
 
 // Next returns an upstream target using round-robin technique.
+// Unhealthy and ejected targets are skipped, nil is returned when no target is available.
 func (b *roundRobinBalancer) Next(c echo.Context) *ProxyTarget {
-	b.i = b.i % uint32(len(b.targets))
-	t := b.targets[b.i]
-	atomic.AddUint32(&b.i, 1)
-	return t
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	now := timeNow()
+	n := uint32(len(b.targets))
+	for j := uint32(0); j < n; j++ {
+		t := b.targets[(atomic.AddUint32(&b.i, 1)-1)%n]
+		if t.available(now) {
+			return t
+		}
+	}
+	return nil
+}
+
+// AvailableTargets returns the targets that are in balancer rotation.
+func availableTargets(targets []*ProxyTarget) []*ProxyTarget {
+	now := timeNow()
+	r := make([]*ProxyTarget, 0, len(targets))
+	for _, t := range targets {
+		if t.available(now) {
+			r = append(r, t)
+		}
+	}
+	return r
+}
+
+// Available returns true when the target is in balancer rotation at time now.
+func (t *ProxyTarget) available(now time.Time) bool {
+	return t.Healthy() && !t.Ejected(now)
+}
+
+// Down returns 1 when the target is out of balancer rotation.
+func (t *ProxyTarget) down() int32 {
+	return atomic.LoadInt32(&t.unhealthy)
+}
+
+// SetDown takes the target out of (1) or puts it in (0) balancer rotation.
+func (t *ProxyTarget) setDown(v int32) {
+	atomic.StoreInt32(&t.unhealthy, v)
 }
 
 // Proxy returns a Proxy middleware.
@@ -207,6 +342,9 @@ func ProxyWithConfig(config ProxyConfig) echo.MiddlewareFunc {
 	if config.Balancer == nil {
 		panic("echo: proxy middleware requires balancer")
 	}
+	if config.SSEIdleTimeout <= 0 {
+		config.SSEIdleTimeout = DefaultProxyConfig.SSEIdleTimeout
+	}
 	config.rewriteRegex = map[*regexp.Regexp]string{}
 
 	// Initialize
@@ -224,7 +362,18 @@ func ProxyWithConfig(config ProxyConfig) echo.MiddlewareFunc {
 			req := c.Request()
 			res := c.Response()
 			tgt := config.Balancer.Next(c)
+			if tgt == nil {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "No healthy upstream target")
+			}
 			c.Set(config.ContextKey, tgt)
+			atomic.AddInt32(&tgt.outstanding, 1)
+			start := time.Now()
+			// a retry can replace the target in context.
+			defer func() {
+				t := c.Get(config.ContextKey).(*ProxyTarget)
+				atomic.AddInt32(&t.outstanding, -1)
+				observePool(t.Pool, res.Status, time.Since(start))
+			}()
 
 			// Rewrite
 			for k, v := range config.rewriteRegex {
@@ -249,8 +398,11 @@ func ProxyWithConfig(config ProxyConfig) echo.MiddlewareFunc {
 			// Proxy
 			switch {
 			case c.IsWebSocket():
-				proxyRaw(tgt, c).ServeHTTP(res, req)
-			case req.Header.Get(echo.HeaderAccept) == "text/event-stream":
+				proxyRaw(tgt, c, config).ServeHTTP(res, req)
+			case isEventStream(req):
+				proxySSE(tgt, c, config).ServeHTTP(res, req)
+			case config.Retry != nil:
+				proxyRetry(tgt, c, config).ServeHTTP(res, req)
 			default:
 				proxyHTTP(tgt, c, config).ServeHTTP(res, req)
 			}
@@ -16,10 +16,22 @@ import (
 // ProxyHTTP returns a ReverseProxy that adds a Host header (https://tools.ietf.org/html/rfc7230#page-44)
 // Based on net.http.httputil.reverseproxy.go NewSingleHostReverseProxy()
 func proxyHTTP(tgt *ProxyTarget, c echo.Context, config ProxyConfig) http.Handler {
+	return newReverseProxy(tgt, c, config)
+}
+
+// NewReverseProxy returns the ReverseProxy of proxyHTTP.
+func newReverseProxy(tgt *ProxyTarget, c echo.Context, config ProxyConfig) *httputil.ReverseProxy {
 	target := tgt.URL
 	targetQuery := target.RawQuery
+	scheme := target.Scheme
+	switch scheme {
+	case "ws":
+		scheme = "http"
+	case "wss":
+		scheme = "https"
+	}
 	director := func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
+		req.URL.Scheme = scheme
 		req.URL.Host = target.Host
 		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
 		req.Host = target.Host // https://github.com/golang/go/issues/5692
@@ -39,13 +51,33 @@ func proxyHTTP(tgt *ProxyTarget, c echo.Context, config ProxyConfig) http.Handle
 			desc = fmt.Sprintf("%s(%s)", tgt.Name, tgt.URL.String())
 		}
 		c.Logger().Errorf("remote %s unreachable, could not forward: %v", desc, err)
+		// a request that is canceled by the client doesn't tell anything about the target.
+		if d := config.OutlierDetector; d != nil && req.Context().Err() == nil {
+			d.Failure(tgt)
+		}
 		c.Error(echo.NewHTTPError(http.StatusServiceUnavailable))
 	}
+	modifyResponse := func(resp *http.Response) error {
+		if d := config.OutlierDetector; d != nil {
+			if resp.StatusCode >= 500 {
+				d.Failure(tgt)
+			} else {
+				d.Success(tgt)
+			}
+		}
+		return nil
+	}
+
+	transport := config.Transport
+	if tgt.Transport != nil {
+		transport = tgt.Transport
+	}
 
 	proxy := &httputil.ReverseProxy{
-		Director: director,
-		ErrorHandler: errorHandler,
-		Transport: config.Transport,
+		Director:       director,
+		ErrorHandler:   errorHandler,
+		ModifyResponse: modifyResponse,
+		Transport:      transport,
 	}
 
 	return proxy
@@ -0,0 +1,111 @@
+package mw
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProxyRawTLS shows that websocket connections are proxied to wss targets with the target's TLS config.
+func TestProxyRawTLS(t *testing.T) {
+	// upstream accepts the upgrade and echoes the data.
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer upstream.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	u, _ := url.Parse(strings.Replace(upstream.URL, "https://", "wss://", 1))
+
+	var tests = []struct {
+		tls  *tls.Config
+		want string
+		info string
+	}{
+		{tls: &tls.Config{RootCAs: roots, ServerName: "example.com"}, want: "HTTP/1.1 101 Switching Protocols", info: "verified"},
+		{tls: &tls.Config{InsecureSkipVerify: true}, want: "HTTP/1.1 101 Switching Protocols", info: "insecure"},
+		{tls: nil, want: "HTTP/1.1 502 Bad Gateway", info: "unknown authority"},
+	}
+	for _, tst := range tests {
+		e := echo.New()
+		e.Use(Proxy(NewRoundRobinBalancer([]*ProxyTarget{{URL: u, TLS: tst.tls}})))
+		srv := httptest.NewServer(e)
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if !assert.NoError(t, err, tst.info) {
+			srv.Close()
+			continue
+		}
+		fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		r := bufio.NewReader(conn)
+		status, _ := r.ReadString('\n')
+		assert.Equal(t, tst.want, strings.TrimSpace(status), tst.info)
+		if strings.Contains(status, "101") {
+			// skip headers
+			for line, _ := r.ReadString('\n'); line != "\r\n" && line != ""; line, _ = r.ReadString('\n') {
+			}
+			fmt.Fprint(conn, "ping\n")
+			got, _ := r.ReadString('\n')
+			assert.Equal(t, "ping\n", got, tst.info)
+		}
+		conn.Close()
+		srv.Close()
+	}
+}
+
+// TestProxyRawDialTimeout shows that a websocket connection fails when a wss target doesn't complete the TLS handshake
+// within proxyDialTimeout.
+func TestProxyRawDialTimeout(t *testing.T) {
+	defer func(d time.Duration) { proxyDialTimeout = d }(proxyDialTimeout)
+	proxyDialTimeout = 100 * time.Millisecond
+
+	// upstream accepts connections but never responds.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	u, _ := url.Parse("wss://" + l.Addr().String())
+
+	e := echo.New()
+	e.Use(Proxy(NewRoundRobinBalancer([]*ProxyTarget{{URL: u}})))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	status, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway", strings.TrimSpace(status))
+}
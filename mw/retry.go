@@ -0,0 +1,298 @@
+package mw
+
+/*
+	Retrying idempotent requests on another target.
+
+	GET, HEAD and OPTIONS requests and operations that are marked idempotent in the API definition are retried on a
+	different target after a connect error or a response with one of the configured status codes.
+	A retry budget limits the retries to a ratio of the requests (plus a minimum) so retries can't amplify an outage.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// RetryConfig defines when requests are retried.
+	RetryConfig struct {
+		// Attempts is the max number of attempts of a request, including the first one.
+		// Optional. Default value 2.
+		Attempts int
+		// StatusCodes are the upstream response status codes that are retried (connect errors are always retried).
+		// Optional.
+		StatusCodes []int
+		// Header is the upstream request header that gets the attempt number (starting at 1).
+		// Optional. Default value X-Apigw-Attempt.
+		Header string
+		// BudgetRatio is the max ratio of retries to requests.
+		// Optional. Default value 0.2.
+		BudgetRatio float64
+		// MinRetriesPerSecond are allowed on top of the BudgetRatio so low traffic can be retried.
+		// Optional. Default value 10.
+		MinRetriesPerSecond int
+	}
+
+	// RetryPolicy retries idempotent requests on another target within a retry budget.
+	RetryPolicy struct {
+		config RetryConfig
+		budget retryBudget
+	}
+
+	// RetryBudget counts requests and retries per second over a sliding window.
+	retryBudget struct {
+		mutex   sync.Mutex
+		buckets [retryBudgetWindow]budgetBucket
+	}
+
+	// BudgetBucket counts the requests and retries of a second.
+	budgetBucket struct {
+		second   int64
+		requests int
+		retries  int
+	}
+)
+
+const (
+	// RetryBudgetWindow is the number of seconds the retry budget looks back.
+	retryBudgetWindow = 10
+	// RetryMaxBody is the max size of a request body that is buffered for retries.
+	retryMaxBody = 1 << 20
+)
+
+var (
+	// DefaultRetryConfig is the default retry config.
+	DefaultRetryConfig = RetryConfig{
+		Attempts:            2,
+		Header:              "X-Apigw-Attempt",
+		BudgetRatio:         0.2,
+		MinRetriesPerSecond: 10,
+	}
+
+	// ErrRetryStatus aborts proxying a response that is retried.
+	errRetryStatus = errors.New("retry status")
+)
+
+// Metrics
+var (
+	proxyRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "apigw",
+			Subsystem: "proxy",
+			Name:      "retries_total",
+			Help:      "Number of upstream requests that are retried or not retried because the retry budget is exhausted.",
+		}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(proxyRetries)
+}
+
+// NewRetryPolicy returns a retry policy.
+func NewRetryPolicy(config RetryConfig) *RetryPolicy {
+	// Defaults
+	if config.Attempts <= 0 {
+		config.Attempts = DefaultRetryConfig.Attempts
+	}
+	if config.Header == "" {
+		config.Header = DefaultRetryConfig.Header
+	}
+	if config.BudgetRatio <= 0 {
+		config.BudgetRatio = DefaultRetryConfig.BudgetRatio
+	}
+	if config.MinRetriesPerSecond <= 0 {
+		config.MinRetriesPerSecond = DefaultRetryConfig.MinRetriesPerSecond
+	}
+
+	return &RetryPolicy{config: config}
+}
+
+// Retryable returns true when the request may be sent more than once.
+func (p *RetryPolicy) retryable(c echo.Context) bool {
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	op, ok := c.Get("Operation").(*path.Operation)
+	return ok && op.Idempotent
+}
+
+// RetryStatus returns true when a response with status is retried.
+func (p *RetryPolicy) retryStatus(status int) bool {
+	for _, s := range p.config.StatusCodes {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Other returns a target that hasn't been tried or nil when there is none.
+func (p *RetryPolicy) other(b ProxyBalancer, c echo.Context, tried map[*ProxyTarget]bool) *ProxyTarget {
+	// a balancer may return the same target a few times (for example a consistent hash balancer).
+	for i := 0; i < 2*p.config.Attempts; i++ {
+		t := b.Next(c)
+		if t == nil {
+			return nil
+		}
+		if !tried[t] {
+			return t
+		}
+	}
+	return nil
+}
+
+// ProxyRetry returns a handler that proxies a request and retries it on other targets.
+func proxyRetry(tgt *ProxyTarget, c echo.Context, config ProxyConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := config.Retry
+		p.budget.request(timeNow())
+		if !p.retryable(c) {
+			proxyHTTP(tgt, c, config).ServeHTTP(w, r)
+			return
+		}
+
+		// Buffer the body so it can be sent again.
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			b, err := ioutil.ReadAll(io.LimitReader(r.Body, retryMaxBody+1))
+			if err != nil {
+				c.Error(echo.NewHTTPError(http.StatusBadRequest, "Error reading request body"))
+				return
+			}
+			if len(b) > retryMaxBody {
+				r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+				proxyHTTP(tgt, c, config).ServeHTTP(w, r)
+				return
+			}
+			body = b
+		}
+
+		tried := map[*ProxyTarget]bool{}
+		for attempt := 1; ; attempt++ {
+			tried[tgt] = true
+			if body != nil {
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			r.Header.Set(p.config.Header, strconv.Itoa(attempt))
+
+			var next *ProxyTarget
+			// retry returns true when the request is sent to next.
+			retry := func() bool {
+				if attempt >= p.config.Attempts || r.Context().Err() != nil {
+					return false
+				}
+				next = p.other(config.Balancer, c, tried)
+				if next == nil {
+					return false
+				}
+				if !p.budget.allow(timeNow(), p.config.BudgetRatio, p.config.MinRetriesPerSecond) {
+					proxyRetries.WithLabelValues("budget_exhausted").Inc()
+					return false
+				}
+				proxyRetries.WithLabelValues("retried").Inc()
+				return true
+			}
+
+			retried := false
+			proxy := newReverseProxy(tgt, c, config)
+			modifyResponse, errorHandler := proxy.ModifyResponse, proxy.ErrorHandler
+			proxy.ModifyResponse = func(resp *http.Response) error {
+				if err := modifyResponse(resp); err != nil {
+					return err
+				}
+				if p.retryStatus(resp.StatusCode) && retry() {
+					c.Logger().Warnf("remote %s responded %d, retrying on %s", tgt.URL, resp.StatusCode, next.URL)
+					retried = true
+					return errRetryStatus
+				}
+				return nil
+			}
+			proxy.ErrorHandler = func(resp http.ResponseWriter, req *http.Request, err error) {
+				if err == errRetryStatus {
+					return
+				}
+				if connectError(err) && retry() {
+					c.Logger().Warnf("remote %s unreachable, retrying on %s: %v", tgt.URL, next.URL, err)
+					if d := config.OutlierDetector; d != nil {
+						d.Failure(tgt)
+					}
+					retried = true
+					return
+				}
+				errorHandler(resp, req, err)
+			}
+			proxy.ServeHTTP(w, r)
+			if !retried {
+				return
+			}
+
+			// The target in context is the one that is counted as outstanding.
+			atomic.AddInt32(&tgt.outstanding, -1)
+			tgt = next
+			atomic.AddInt32(&tgt.outstanding, 1)
+			c.Set(config.ContextKey, tgt)
+		}
+	})
+}
+
+// ConnectError returns true when err is a failure to connect, the request hasn't reached the target.
+func connectError(err error) bool {
+	for err != nil {
+		if op, ok := err.(*net.OpError); ok && op.Op == "dial" {
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+// Request counts a request.
+func (b *retryBudget) request(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.bucket(now).requests++
+}
+
+// Allow returns true and counts a retry when the budget allows a retry.
+func (b *retryBudget) allow(now time.Time, ratio float64, min int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	requests, retries := 0, 0
+	for _, bk := range b.buckets {
+		if bk.second > now.Unix()-retryBudgetWindow {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	if float64(retries) >= float64(min*retryBudgetWindow)+ratio*float64(requests) {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// Bucket returns the bucket of the second of now.
+func (b *retryBudget) bucket(now time.Time) *budgetBucket {
+	s := now.Unix()
+	bk := &b.buckets[s%retryBudgetWindow]
+	if bk.second != s {
+		*bk = budgetBucket{second: s}
+	}
+	return bk
+}
@@ -0,0 +1,107 @@
+package mw
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProxyRetry shows that idempotent requests are retried on another target.
+func TestProxyRetry(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Header.Get("X-Apigw-Attempt") + " " + string(body)))
+	}))
+	defer good.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	refused := httptest.NewServer(nil)
+	refused.Close()
+	refused2 := httptest.NewServer(nil)
+	refused2.Close()
+
+	var tests = []struct {
+		method      string
+		idempotent  bool
+		upstreams   []*httptest.Server
+		statusCodes []int
+		wantStatus  int
+		want        string
+		info        string
+	}{
+		{method: echo.GET, upstreams: []*httptest.Server{refused, good}, wantStatus: http.StatusOK, want: "2 ", info: "connect error"},
+		{method: echo.GET, upstreams: []*httptest.Server{good, refused}, wantStatus: http.StatusOK, want: "1 ", info: "no error"},
+		{method: echo.POST, upstreams: []*httptest.Server{refused, good}, wantStatus: http.StatusServiceUnavailable, info: "not idempotent"},
+		{method: echo.PUT, idempotent: true, upstreams: []*httptest.Server{refused, good}, wantStatus: http.StatusOK, want: "2 body", info: "idempotent operation"},
+		{method: echo.GET, upstreams: []*httptest.Server{unavailable, good}, statusCodes: []int{503}, wantStatus: http.StatusOK, want: "2 ", info: "status code"},
+		{method: echo.GET, upstreams: []*httptest.Server{unavailable, good}, wantStatus: http.StatusServiceUnavailable, info: "status code not selected"},
+		{method: echo.GET, upstreams: []*httptest.Server{refused, refused2, good}, wantStatus: http.StatusServiceUnavailable, info: "max attempts"},
+		{method: echo.GET, upstreams: []*httptest.Server{refused}, wantStatus: http.StatusServiceUnavailable, info: "no other target"},
+	}
+	for _, tst := range tests {
+		var targets []*ProxyTarget
+		for _, s := range tst.upstreams {
+			u, _ := url.Parse(s.URL)
+			targets = append(targets, &ProxyTarget{URL: u})
+		}
+		config := DefaultProxyConfig
+		config.Balancer = NewRoundRobinBalancer(targets)
+		config.Retry = NewRetryPolicy(RetryConfig{StatusCodes: tst.statusCodes})
+		e := echo.New()
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set("Operation", &path.Operation{Idempotent: tst.idempotent})
+				return next(c)
+			}
+		})
+		e.Use(ProxyWithConfig(config))
+
+		var body string
+		if tst.method == echo.PUT || tst.method == echo.POST {
+			body = "body"
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(tst.method, "/", strings.NewReader(body)))
+		assert.Equal(t, tst.wantStatus, rec.Code, tst.info)
+		if tst.want != "" {
+			assert.Equal(t, tst.want, rec.Body.String(), tst.info)
+		}
+		for _, x := range targets {
+			assert.Equal(t, int32(0), x.outstanding, "%s outstanding", tst.info)
+		}
+	}
+}
+
+// TestRetryBudget shows that retries are limited to a ratio of the requests plus a minimum per second.
+func TestRetryBudget(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var b retryBudget
+
+	// the minimum of 1 per second allows 10 retries in the window.
+	n := 0
+	for b.allow(now, 0.5, 1) {
+		n++
+	}
+	assert.Equal(t, 10, n, "minimum")
+
+	// each 2 requests allow 1 retry.
+	for i := 0; i < 4; i++ {
+		b.request(now)
+	}
+	assert.True(t, b.allow(now, 0.5, 1), "ratio")
+	assert.True(t, b.allow(now, 0.5, 1), "ratio")
+	assert.False(t, b.allow(now, 0.5, 1), "ratio exhausted")
+
+	// the window moves.
+	now = now.Add(retryBudgetWindow * time.Second)
+	assert.True(t, b.allow(now, 0.5, 1), "next window")
+}
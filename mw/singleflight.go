@@ -0,0 +1,52 @@
+package mw
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrFlightPanic is returned to the callers that wait for a call that panics.
+var errFlightPanic = errors.New("tokeninfo lookup panicked")
+
+// FlightGroup coalesces concurrent tokeninfo lookups for the same key into one call.
+// It's a minimal version of golang.org/x/sync/singleflight.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// Flight is an in-progress or completed lookup.
+type flight struct {
+	wg  sync.WaitGroup
+	ti  *TokeninfoResponse
+	err error
+}
+
+// Do calls fn and returns its results, concurrent callers with the same key wait for the first call and receive
+// its results.
+func (g *flightGroup) do(key string, fn func() (*TokeninfoResponse, error)) (*TokeninfoResponse, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flight)
+	}
+	if f, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.ti, f.err
+	}
+	// the error is returned to waiters when fn panics.
+	f := &flight{err: errFlightPanic}
+	f.wg.Add(1)
+	g.m[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		f.wg.Done()
+	}()
+	f.ti, f.err = fn()
+
+	return f.ti, f.err
+}
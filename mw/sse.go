@@ -0,0 +1,61 @@
+package mw
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+	Server-Sent Events (text/event-stream) proxying.
+
+	The middleware chain, and thus authorization, runs once when the stream is opened. Events are flushed to the
+	client as soon as they are received from upstream. A stream that doesn't receive data from upstream for
+	SSEIdleTimeout is closed.
+*/
+
+type (
+	// IdleTimeoutReader resets timer with timeout on every read.
+	idleTimeoutReader struct {
+		io.ReadCloser
+		timer   *time.Timer
+		timeout time.Duration
+	}
+)
+
+// IsEventStream returns true when the request accepts a Server-Sent Events stream.
+func isEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get(echo.HeaderAccept), "text/event-stream")
+}
+
+// ProxySSE returns a handler that streams Server-Sent Events from upstream without buffering.
+func proxySSE(tgt *ProxyTarget, c echo.Context, config ProxyConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		timer := time.AfterFunc(config.SSEIdleTimeout, cancel)
+		defer timer.Stop()
+
+		proxy := newReverseProxy(tgt, c, config)
+		// flush immediately after each write.
+		proxy.FlushInterval = -1
+		modifyResponse := proxy.ModifyResponse
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			resp.Body = &idleTimeoutReader{ReadCloser: resp.Body, timer: timer, timeout: config.SSEIdleTimeout}
+			return modifyResponse(resp)
+		}
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Read reads from the underlying reader and resets the idle timer when data is received.
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
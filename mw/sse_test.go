@@ -0,0 +1,69 @@
+package mw
+
+import (
+	"bufio"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestProxySSE shows that events are flushed to the client as soon as upstream sends them and that an idle stream
+// is closed.
+func TestProxySSE(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		// wait until the client has read the first event, then go idle.
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("data: two\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	config := DefaultProxyConfig
+	config.Balancer = NewRoundRobinBalancer([]*ProxyTarget{{URL: u}})
+	config.SSEIdleTimeout = 100 * time.Millisecond
+	e := echo.New()
+	e.Use(ProxyWithConfig(config))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(echo.GET, srv.URL+"/events", nil)
+	req.Header.Set(echo.HeaderAccept, "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get(echo.HeaderContentType))
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: one\n", line, "first event before upstream is done")
+	close(release)
+	r.ReadString('\n')
+	line, err = r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: two\n", line, "second event")
+
+	start := time.Now()
+	for err == nil {
+		_, err = r.ReadString('\n')
+	}
+	assert.True(t, time.Since(start) < 2*time.Second, "idle stream is closed")
+}
@@ -3,11 +3,13 @@ package openapi
 import (
 	"context"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/mmlt/apigw/backoff"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 	"github.com/mmlt/apigw/path"
 	"github.com/go-openapi/spec"
@@ -98,7 +100,40 @@ func httpGetReadAll(url string) ([]byte, error) {
 }
 
 // Parse translates an OpenAPI spec into an Index.
-func parse(json []byte) (*path.Index, error) {
+// Swagger 2.0 and OpenAPI 3.x specs are supported.
+func parse(b []byte) (*path.Index, error) {
+	version, err := specVersion(b)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case version == "2.0":
+		return parse2(b)
+	case strings.HasPrefix(version, "3."):
+		return parse3(b)
+	default:
+		return nil, fmt.Errorf("unsupported openapi version %q", version)
+	}
+}
+
+// SpecVersion returns the version of a Swagger 2.0 or OpenAPI 3.x spec.
+func specVersion(b []byte) (string, error) {
+	var v struct {
+		Swagger string `json:"swagger"`
+		OpenAPI string `json:"openapi"`
+	}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return "", err
+	}
+	if v.OpenAPI != "" {
+		return v.OpenAPI, nil
+	}
+	return v.Swagger, nil
+}
+
+// Parse2 translates a Swagger 2.0 spec into an Index.
+func parse2(json []byte) (*path.Index, error) {
 	// Parse openapiClient.
 	spec, err := SpecFromRaw(json)
 	if err != nil {
@@ -124,23 +159,56 @@ func parse(json []byte) (*path.Index, error) {
 	return idx, err
 }
 
-// NewIndexFromSpec returns a path.Index instance for lookup of scopes by method/path.
-// The required scopes for a method/path are read from swagger 'security' 'oauth2' sections.
+// Parse3 translates an OpenAPI 3.x spec into an Index.
+func parse3(json []byte) (*path.Index, error) {
+	spec, err := Spec3FromRaw(json)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check number of paths in openapi definition.
+	i := len(spec.Paths)
+	if i == 0 {
+		return nil, ErrNoPathInSpec
+	}
+
+	glog.Infof("openapi %s definition fetch successful (contains %d paths)", spec.OpenAPI, i)
+
+	// Build index for quick lookups.
+	idx, err := newIndexFromSpec3(spec)
+
+	return idx, err
+}
+
+// NewIndexFromSpec returns a path.Index instance for lookup of operations by method/path.
+// The security requirements for a method/path are read from swagger 'security' sections.
 func newIndexFromSpec(spec *spec.Swagger) (*path.Index, error) {
 	idx := path.NewIndex()
-	SpecOAuth2ScopeIter(spec, func(path string, method string, scopes []string) {
-		// Swagger spec scopes can contain empty strings, remove them.
-		var s []string
-		for _, str := range scopes {
-			if str != "" {
-				s = append(s, str)
-			}
-		}
-		idx.AddMethodPathScopes(method, path, s)
-	})
+	err := SpecOperationIter(spec, addOperationFunc(idx))
+	if err != nil {
+		return nil, err
+	}
 	return idx, nil
 }
 
+// NewIndexFromSpec3 returns a path.Index instance for lookup of operations by method/path.
+// The security requirements for a method/path are read from the 'security' sections.
+func newIndexFromSpec3(spec *Spec3) (*path.Index, error) {
+	idx := path.NewIndex()
+	err := Spec3OperationIter(spec, addOperationFunc(idx))
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// AddOperationFunc returns an OperationIterFunc that adds operations to idx.
+func addOperationFunc(idx *path.Index) OperationIterFunc {
+	return func(op *path.Operation) {
+		idx.AddOperation(op.Method, op.Path, op)
+	}
+}
+
 // Sleep with cancel.
 func (c *Client) sleep(d time.Duration) {
 	select {
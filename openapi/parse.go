@@ -1,13 +1,30 @@
-// Package openapi is used to access Swagger specs.
+// Package openapi is used to access Swagger 2.0 and OpenAPI 3.x specs.
 package openapi
 
 import (
+	"fmt"
 	"github.com/go-openapi/loads"
 	"github.com/go-openapi/spec"
+	"github.com/golang/glog"
+	"github.com/mmlt/apigw/path"
+	"sort"
 )
 
-// OAuth2ScopeIterFunc functions are used to collect path, action and oauth2 scopes from a swagger spec.
-type OAuth2ScopeIterFunc func(path string, action string, scopes []string)
+// SecurityIterFunc functions are used to collect path, action and security requirements from a swagger spec.
+type SecurityIterFunc func(path string, action string, security path.Requirements)
+
+// OperationIterFunc functions are used to collect operations from a swagger spec.
+type OperationIterFunc func(op *path.Operation)
+
+// Extensions of the API definition that are specific to apigw.
+const (
+	// ExtClientCert set to true on an operation requires a verified TLS client certificate.
+	ExtClientCert = "x-apigw-client-cert"
+	// ExtIdempotent set to true on an operation allows the proxy to retry it.
+	ExtIdempotent = "x-apigw-idempotent"
+	// ExtUpstream names the target pool an operation is proxied to.
+	ExtUpstream = "x-apigw-upstream"
+)
 
 // SpecFromRaw returns a swagger spec from a json blob.
 func SpecFromRaw(json []byte) (*spec.Swagger, error) {
@@ -19,38 +36,147 @@ func SpecFromRaw(json []byte) (*spec.Swagger, error) {
 	return doc.Spec(), nil
 }
 
-// SpecOAuth2ScopeIter iterates a Swagger spec and calls a function with url path, http action and oauth2 scopes.
+// SpecSecurityIter iterates a Swagger spec and calls a function with url path, http action and security requirements.
+// Prerequisite: specification.Path != nil
+func SpecSecurityIter(specification *spec.Swagger, fn SecurityIterFunc) error {
+	return SpecOperationIter(specification, func(op *path.Operation) {
+		fn(op.Path, op.Method, op.Security)
+	})
+}
+
+// SpecOperationIter iterates a Swagger spec and calls a function for each operation.
+// Security schemes are resolved via securityDefinitions, an error is returned when a scheme isn't defined.
+// The top-level security applies to operations without security, an empty operation security opts-out.
 // Prerequisite: specification.Path != nil
-func SpecOAuth2ScopeIter(specification *spec.Swagger, fn OAuth2ScopeIterFunc) {
-	op := func(path string, method string, prop *spec.Operation, fn OAuth2ScopeIterFunc) {
+func SpecOperationIter(specification *spec.Swagger, fn OperationIterFunc) error {
+	schemes := make(map[string]path.Scheme, len(specification.SecurityDefinitions))
+	for name, s := range specification.SecurityDefinitions {
+		schemes[name] = path.Scheme{Name: name, Type: s.Type, In: s.In, Param: s.Name}
+	}
+	r := newRequirementsResolver(schemes)
+
+	op := func(p string, method string, prop *spec.Operation) error {
 		if prop == nil {
 			// no properties so ignore path
-			return
+			return nil
 		}
 
-		if len(prop.Security) == 0 {
-			// no Security properties so no scopes
-			fn(path, method, nil)
-			return
+		reqs, err := r.resolve(operationSecurity(prop.Security, specification.Security))
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", method, p, err)
 		}
 
-		scopes, ok := prop.Security[0]["oauth2"]
-		if !ok {
-			// no oauth2 property so no scopes
-			fn(path, method, nil)
-			return
+		clientCert, _ := prop.Extensions.GetBool(ExtClientCert)
+		idempotent, _ := prop.Extensions.GetBool(ExtIdempotent)
+		upstream, _ := prop.Extensions.GetString(ExtUpstream)
+		fn(&path.Operation{
+			Method:     method,
+			Path:       p,
+			ID:         prop.ID,
+			Tags:       prop.Tags,
+			Security:   reqs,
+			ClientCert: clientCert,
+			Idempotent: idempotent,
+			Upstream:   upstream,
+		})
+		return nil
+	}
+
+	for p, prop := range specification.Paths.Paths {
+		for _, err := range []error{
+			op(p, "GET", prop.Get),
+			op(p, "PUT", prop.Put),
+			op(p, "POST", prop.Post),
+			op(p, "DELETE", prop.Delete),
+			op(p, "OPTIONS", prop.Options),
+			op(p, "HEAD", prop.Head),
+			op(p, "PATCH", prop.Patch),
+		} {
+			if err != nil {
+				return err
+			}
 		}
+	}
+
+	return nil
+}
+
+// OperationSecurity returns the security that applies to an operation.
+// An operation without security (nil) inherits the global security, an empty operation security ([]) means no security.
+func operationSecurity(operation, global []map[string][]string) []map[string][]string {
+	if operation == nil {
+		return global
+	}
+	return operation
+}
+
+// RequirementsResolver translates the security section of a spec into path.Requirements.
+type requirementsResolver struct {
+	// schemes maps security scheme names to scheme definitions.
+	schemes map[string]path.Scheme
+	// ignored contains the names of undefined schemes that are assumed to be oauth2 (logged once).
+	ignored map[string]bool
+}
 
-		fn(path, method, scopes)
+func newRequirementsResolver(schemes map[string]path.Scheme) *requirementsResolver {
+	return &requirementsResolver{
+		schemes: schemes,
+		ignored: map[string]bool{},
 	}
+}
 
-	for path, prop := range specification.Paths.Paths {
-		op(path, "GET", prop.Get, fn)
-		op(path, "PUT", prop.Put, fn)
-		op(path, "POST", prop.Post, fn)
-		op(path, "DELETE", prop.Delete, fn)
-		op(path, "OPTIONS", prop.Options, fn)
-		op(path, "HEAD", prop.Head, fn)
-		op(path, "PATCH", prop.Patch, fn)
+// Resolve returns the requirements for a spec security section.
+// Each element of security is an alternative, each alternative maps scheme names to scopes.
+// Scopes of schemes of type oauth2 (and openIdConnect) are combined into one set because they are checked against
+// the same access token, such an alternative requires a token even when it has no scopes.
+// An error is returned for schemes of other types so they can't make an operation public. Schemes of type apiKey and basic are added to the requirement's Schemes.
+func (r *requirementsResolver) resolve(security []map[string][]string) (path.Requirements, error) {
+	var reqs path.Requirements
+	for _, alt := range security {
+		var req path.Requirement
+		for name, scopes := range alt {
+			scheme, ok := r.schemes[name]
+			if !ok && name == "oauth2" {
+				// Specs written for earlier versions of apigw refer to "oauth2" without defining it.
+				if !r.ignored[name] {
+					glog.Warningf("security scheme %q is not defined, assuming type oauth2", name)
+					r.ignored[name] = true
+				}
+				scheme, ok = path.Scheme{Name: name, Type: "oauth2"}, true
+			}
+			if !ok {
+				return nil, fmt.Errorf("security scheme %q is not defined", name)
+			}
+			switch scheme.Type {
+			case "oauth2", "openIdConnect":
+				// a token is required, also when the alternative has no scopes.
+				req.Token = true
+				for _, s := range scopes {
+					// Swagger spec scopes can contain empty strings, remove them.
+					if s != "" {
+						req.Scopes = append(req.Scopes, s)
+					}
+				}
+			case path.SchemeTypeAPIKey:
+				switch scheme.In {
+				case "header", "query", "cookie":
+				default:
+					return nil, fmt.Errorf("security scheme %q: apiKey location %q is not supported", name, scheme.In)
+				}
+				if scheme.Param == "" {
+					return nil, fmt.Errorf("security scheme %q: apiKey name is missing", name)
+				}
+				req.Schemes = append(req.Schemes, scheme)
+			case path.SchemeTypeBasic:
+				req.Schemes = append(req.Schemes, scheme)
+			default:
+				// ignoring the scheme would make its alternative (and the operation) public.
+				return nil, fmt.Errorf("security scheme %q of type %s is not supported", name, scheme.Type)
+			}
+		}
+		sort.Strings(req.Scopes)
+		sort.Slice(req.Schemes, func(i, j int) bool { return req.Schemes[i].Name < req.Schemes[j].Name })
+		reqs = append(reqs, req)
 	}
+	return reqs, nil
 }
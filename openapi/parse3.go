@@ -0,0 +1,159 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mmlt/apigw/path"
+	"strings"
+)
+
+// OpenAPI 3.x documents are not supported by go-openapi/spec so the subset that is needed to build an index is
+// defined here.
+
+type (
+	// Spec3 is an OpenAPI 3.x specification.
+	// See https://github.com/OAI/OpenAPI-Specification/blob/master/versions/3.0.3.md#openapi-object
+	Spec3 struct {
+		// OpenAPI is the semantic version number of the specification, for example 3.0.2
+		OpenAPI string `json:"openapi"`
+		// Paths to the endpoints.
+		Paths map[string]*PathItem3 `json:"paths"`
+		// Components hold reusable objects.
+		Components Components3 `json:"components"`
+		// Security is the default for operations that don't specify security.
+		Security []map[string][]string `json:"security"`
+	}
+
+	// Components3 holds reusable objects.
+	Components3 struct {
+		// SecuritySchemes by name.
+		SecuritySchemes map[string]*SecurityScheme3 `json:"securitySchemes"`
+	}
+
+	// SecurityScheme3 defines a security scheme that can be used by operations.
+	SecurityScheme3 struct {
+		// Type is one of apiKey, http, mutualTLS, oauth2 or openIdConnect.
+		Type string `json:"type"`
+		// Scheme is the name of the HTTP Authorization scheme (type http only).
+		Scheme string `json:"scheme"`
+		// Name of the header or query parameter (type apiKey only).
+		Name string `json:"name"`
+		// In is the location of the API key; query, header or cookie (type apiKey only).
+		In string `json:"in"`
+	}
+
+	// PathItem3 describes the operations available on a single path.
+	PathItem3 struct {
+		Get     *Operation3 `json:"get"`
+		Put     *Operation3 `json:"put"`
+		Post    *Operation3 `json:"post"`
+		Delete  *Operation3 `json:"delete"`
+		Options *Operation3 `json:"options"`
+		Head    *Operation3 `json:"head"`
+		Patch   *Operation3 `json:"patch"`
+		Trace   *Operation3 `json:"trace"`
+	}
+
+	// Operation3 describes a single API operation on a path.
+	Operation3 struct {
+		OperationID string   `json:"operationId"`
+		Tags        []string `json:"tags"`
+		// Security alternatives for this operation.
+		// Nil means the top-level security applies, empty means no security.
+		Security []map[string][]string `json:"security"`
+		// ClientCert requires a verified TLS client certificate.
+		ClientCert bool `json:"x-apigw-client-cert"`
+		// Idempotent allows the proxy to retry the operation.
+		Idempotent bool `json:"x-apigw-idempotent"`
+		// Upstream names the target pool the operation is proxied to.
+		Upstream string `json:"x-apigw-upstream"`
+	}
+)
+
+// Spec3FromRaw returns an OpenAPI 3.x spec from a json blob.
+func Spec3FromRaw(b []byte) (*Spec3, error) {
+	var s Spec3
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(s.OpenAPI, "3.") {
+		return nil, fmt.Errorf("openapi version %q is not 3.x", s.OpenAPI)
+	}
+
+	return &s, nil
+}
+
+// Spec3SecurityIter iterates an OpenAPI 3.x spec and calls a function with url path, http action and security
+// requirements.
+func Spec3SecurityIter(specification *Spec3, fn SecurityIterFunc) error {
+	return Spec3OperationIter(specification, func(op *path.Operation) {
+		fn(op.Path, op.Method, op.Security)
+	})
+}
+
+// Spec3OperationIter iterates an OpenAPI 3.x spec and calls a function for each operation.
+// Security schemes are resolved via components.securitySchemes, an error is returned when a scheme isn't defined.
+// The top-level security applies to operations without security, an empty operation security opts-out.
+func Spec3OperationIter(specification *Spec3, fn OperationIterFunc) error {
+	schemes := make(map[string]path.Scheme, len(specification.Components.SecuritySchemes))
+	for name, s := range specification.Components.SecuritySchemes {
+		typ := s.Type
+		switch {
+		case typ == "http" && strings.EqualFold(s.Scheme, "basic"):
+			// same as Swagger 2.0 type basic
+			typ = path.SchemeTypeBasic
+		case typ == "http" && strings.EqualFold(s.Scheme, "bearer"):
+			// a bearer token is checked like an oauth2 access token
+			typ = "oauth2"
+		}
+		schemes[name] = path.Scheme{Name: name, Type: typ, In: s.In, Param: s.Name}
+	}
+	r := newRequirementsResolver(schemes)
+
+	op := func(p string, method string, prop *Operation3) error {
+		if prop == nil {
+			// no properties so ignore path
+			return nil
+		}
+
+		reqs, err := r.resolve(operationSecurity(prop.Security, specification.Security))
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", method, p, err)
+		}
+
+		fn(&path.Operation{
+			Method:     method,
+			Path:       p,
+			ID:         prop.OperationID,
+			Tags:       prop.Tags,
+			Security:   reqs,
+			ClientCert: prop.ClientCert,
+			Idempotent: prop.Idempotent,
+			Upstream:   prop.Upstream,
+		})
+		return nil
+	}
+
+	for p, prop := range specification.Paths {
+		if prop == nil {
+			continue
+		}
+		for _, err := range []error{
+			op(p, "GET", prop.Get),
+			op(p, "PUT", prop.Put),
+			op(p, "POST", prop.Post),
+			op(p, "DELETE", prop.Delete),
+			op(p, "OPTIONS", prop.Options),
+			op(p, "HEAD", prop.Head),
+			op(p, "PATCH", prop.Patch),
+			op(p, "TRACE", prop.Trace),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
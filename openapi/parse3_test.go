@@ -0,0 +1,180 @@
+package openapi
+
+import (
+	"fmt"
+	"github.com/mmlt/apigw/path"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// TestSpec3FromRaw shows we can read an OpenAPI 3 json and access elements.
+func TestSpec3FromRaw(t *testing.T) {
+	spec, err := Spec3FromRaw([]byte(openapi3))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "3.0.2", spec.OpenAPI)
+		assert.Len(t, spec.Paths, 4)
+		assert.Equal(t, "oauth2", spec.Components.SecuritySchemes["petstore_auth"].Type)
+	}
+
+	_, err = Spec3FromRaw([]byte(`{"swagger": "2.0"}`))
+	assert.Error(t, err, "not an OpenAPI 3 spec")
+}
+
+// TestSpec3SecurityIter show that we can collect path, operation and security requirements from an OpenAPI 3 spec.
+func TestSpec3SecurityIter(t *testing.T) {
+	spec, err := Spec3FromRaw([]byte(openapi3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	err = Spec3SecurityIter(spec, func(path string, action string, security path.Requirements) {
+		got[action+" "+path] = fmt.Sprint(security)
+	})
+	assert.NoError(t, err)
+
+	expect := map[string]string{
+		"GET /version":         "[]",
+		"GET /pets":            "[{[read:pets]}]",
+		"POST /pets":           "[{[write:pets]}]",
+		"GET /pets/{petId}":    "[{[read:pets]}]",
+		"DELETE /pets/{petId}": "[{token}]",
+		"GET /oidc":            "[{[openid]}]",
+	}
+	assert.Equal(t, expect, got)
+}
+
+// TestSpec3OperationIter shows that operationId and tags are collected.
+func TestSpec3OperationIter(t *testing.T) {
+	spec, err := Spec3FromRaw([]byte(openapi3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]*path.Operation{}
+	err = Spec3OperationIter(spec, func(op *path.Operation) {
+		got[op.Method+" "+op.Path] = op
+	})
+	assert.NoError(t, err)
+
+	op := got["GET /pets/{petId}"]
+	if assert.NotNil(t, op) {
+		assert.Equal(t, "showPet", op.ID)
+		assert.Equal(t, []string{"pets"}, op.Tags)
+		assert.Equal(t, "showPet", op.Name())
+	}
+}
+
+// TestParse shows that Swagger 2.0 and OpenAPI 3 specs are detected and indexed.
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec   string
+		method string
+		path   string
+		scopes []string
+		public bool
+	}{
+		{swagger, "GET", "/version", []string{"read", "write"}, false},
+		{swagger, "GET", "/accounts/123", []string{"read"}, false},
+		{openapi3, "GET", "/version", []string{}, true},
+		{openapi3, "GET", "/pets/123", []string{"read:pets"}, false},
+		{openapi3, "POST", "/pets", []string{"write:pets"}, false},
+		{openapi3, "DELETE", "/pets/123", nil, false},
+	}
+	for i, tst := range tests {
+		idx, err := parse([]byte(tst.spec))
+		if !assert.NoError(t, err, "%d)", i) {
+			continue
+		}
+		// FindScopes can't express a bearer token without scopes so the scopes are read from the requirements.
+		op, err := idx.FindOperation(tst.method, tst.path)
+		if assert.NoError(t, err, "%d)", i) {
+			var got []string
+			for _, req := range op.Security {
+				got = append(got, req.Scopes...)
+			}
+			assert.ElementsMatch(t, tst.scopes, got, "%d) %s %s", i, tst.method, tst.path)
+			assert.Equal(t, tst.public, op.Security.Public(), "%d) %s %s public", i, tst.method, tst.path)
+		}
+	}
+
+	_, err := parse([]byte(`{"openapi": "4.0.0", "paths": {"/version": {}}}`))
+	assert.Error(t, err, "unsupported version")
+
+	_, err = parse([]byte(`{"openapi": "3.1.0", "paths": {}}`))
+	assert.Equal(t, ErrNoPathInSpec, err)
+
+	_, err = parse([]byte(`{"openapi": "3.1.0",
+		"paths": {"/version": {"get": {"security": [{"mtls": []}]}}},
+		"components": {"securitySchemes": {"mtls": {"type": "mutualTLS"}}}}`))
+	assert.Error(t, err, "unsupported scheme type")
+}
+
+// Openapi3 is a string with an OpenAPI 3 json API specification.
+var openapi3 = `
+{
+  "openapi": "3.0.2",
+  "info": { "version": "v1", "title": "Petstore" },
+  "servers": [{ "url": "https://petstore.example.com/v1" }],
+  "paths": {
+    "/version": {
+      "get": {
+        "operationId": "getVersion",
+        "responses": { "200": { "description": "version" } }
+      }
+    },
+    "/pets": {
+      "get": {
+        "operationId": "listPets",
+        "tags": ["pets"],
+        "security": [{ "petstore_auth": ["read:pets"] }],
+        "responses": { "200": { "description": "pets" } }
+      },
+      "post": {
+        "operationId": "createPet",
+        "tags": ["pets"],
+        "security": [{ "petstore_auth": ["write:pets"] }],
+        "responses": { "201": { "description": "created" } }
+      }
+    },
+    "/pets/{petId}": {
+      "parameters": [{ "name": "petId", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "get": {
+        "operationId": "showPet",
+        "tags": ["pets"],
+        "security": [{ "petstore_auth": ["read:pets"] }],
+        "responses": { "200": { "description": "pet" } }
+      },
+      "delete": {
+        "operationId": "deletePet",
+        "tags": ["pets"],
+        "security": [{ "bearer": [] }],
+        "responses": { "204": { "description": "deleted" } }
+      }
+    },
+    "/oidc": {
+      "get": {
+        "operationId": "oidc",
+        "security": [{ "oidc": ["openid"] }],
+        "responses": { "200": { "description": "ok" } }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "petstore_auth": {
+        "type": "oauth2",
+        "flows": {
+          "authorizationCode": {
+            "authorizationUrl": "https://petstore.example.com/oauth/authorize",
+            "tokenUrl": "https://petstore.example.com/oauth/token",
+            "scopes": { "read:pets": "read your pets", "write:pets": "modify pets in your account" }
+          }
+        }
+      },
+      "bearer": { "type": "http", "scheme": "bearer" },
+      "oidc": { "type": "openIdConnect", "openIdConnectUrl": "https://petstore.example.com/.well-known/openid-configuration" }
+    }
+  }
+}
+`
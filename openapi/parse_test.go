@@ -2,6 +2,7 @@ package openapi
 
 import (
 	"fmt"
+	"github.com/mmlt/apigw/path"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -27,39 +28,40 @@ func TestSpecFromRaw(t *testing.T) {
 	}
 }
 
-// TestSpecOAuth2ScopeIter show that we can collect path, operation and oauth2 scopes from a swagger spec.
-func TestSpecOAuth2ScopeIter(t *testing.T) {
+// TestSpecSecurityIter show that we can collect path, operation and security requirements from a swagger spec.
+func TestSpecSecurityIter(t *testing.T) {
 	spec, err := SpecFromRaw([]byte(swagger))
 	if err != nil {
 		t.Error(err)
 	}
 
 	got := make(map[string]string, 20)
-	SpecOAuth2ScopeIter(spec, func(path string, action string, scopes []string) {
-		//fmt.Printf("expect[\"%s\"] = \"%s%v\"\n", path, action, scopes)
-		got[path] = fmt.Sprint(action, scopes)
+	err = SpecSecurityIter(spec, func(path string, action string, security path.Requirements) {
+		//fmt.Printf("expect[\"%s\"] = \"%s%v\"\n", path, action, security)
+		got[path] = fmt.Sprint(action, security)
 	})
+	assert.NoError(t, err)
 
 	expect := make(map[string]string, 20)
-	expect["/session"] = "DELETE[read]"
-	expect["/accounts/{accountNumber}"] = "GET[read]"
-	expect["/version"] = "GET[]"
-	expect["/accounts/{accountNumber}/balances"] = "GET[read]"
-	expect["/accounts/{accountNumber}/positions"] = "GET[read]"
-	expect["/instruments"] = "GET[read]"
-	expect["/instruments/{id}"] = "GET[read]"
-	expect["/accounts/{accountNumber}/transactions"] = "GET[read]"
-	expect["/instruments/lists/{id}"] = "GET[read]"
-	expect["/accounts/{accountNumber}/positions/{id}"] = "GET[read]"
-	expect["/accounts/{accountNumber}/orders"] = "GET[read]"
-	expect["/accounts/{accountNumber}/orders"] = "POST[write]"
-	expect["/accounts/{accountNumber}/performances"] = "GET[read]"
-	expect["/instruments/lists"] = "GET[read]"
-	expect["/accounts/{accountNumber}/orders/{number}"] = "GET[read]"
-	expect["/accounts/{accountNumber}/orders/{number}"] = "DELETE[write]"
-	expect["/accounts"] = "GET[read]"
-	expect["/accounts/{accountNumber}/orders/preview"] = "POST[write]"
-	expect["/instruments/derivatives"] = "GET[read]"
+	expect["/session"] = "DELETE[{[read]}]"
+	expect["/accounts/{accountNumber}"] = "GET[{[read]}]"
+	expect["/version"] = "GET[{[read write]}]" // inherits top-level security
+	expect["/accounts/{accountNumber}/balances"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/positions"] = "GET[{[read]}]"
+	expect["/instruments"] = "GET[{[read]}]"
+	expect["/instruments/{id}"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/transactions"] = "GET[{[read]}]"
+	expect["/instruments/lists/{id}"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/positions/{id}"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/orders"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/orders"] = "POST[{[write]}]"
+	expect["/accounts/{accountNumber}/performances"] = "GET[{[read]}]"
+	expect["/instruments/lists"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/orders/{number}"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/orders/{number}"] = "DELETE[{[write]}]"
+	expect["/accounts"] = "GET[{[read]}]"
+	expect["/accounts/{accountNumber}/orders/preview"] = "POST[{[write]}]"
+	expect["/instruments/derivatives"] = "GET[{[read]}]"
 
 	if len(expect) != len(got) {
 		t.Errorf("expected %d paths, got %d", len(expect), len(got))
@@ -94,7 +96,7 @@ func TestNewIndexFromSpec(t *testing.T) {
 		method string
 		scopes []string
 	}{
-		{"/version", "GET", []string{}},
+		{"/version", "GET", []string{"read", "write"}},
 		{"/session", "DELETE", []string{"read"}},
 		{"/accounts/123", "GET", []string{"read"}},
 		{"/accounts/123/balances", "GET", []string{"read"}},
@@ -108,6 +110,305 @@ func TestNewIndexFromSpec(t *testing.T) {
 	}
 }
 
+// TestSecurityAlternatives shows that security schemes are resolved by type (not by name) and that all alternatives
+// are stored in the index.
+func TestSecurityAlternatives(t *testing.T) {
+	spec, err := SpecFromRaw([]byte(swaggerAlternatives))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := newIndexFromSpec(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   path.Requirements
+	}{
+		{"GET", "/pets", path.Requirements{{Token: true, Scopes: path.Scopes{"read"}}, {Token: true, Scopes: path.Scopes{"admin"}}}},
+		{"POST", "/pets", path.Requirements{{Token: true, Scopes: path.Scopes{"read", "write"}}}},
+		{"GET", "/version", nil},
+	}
+	for _, tst := range tests {
+		op, err := idx.FindOperation(tst.method, tst.path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tst.want, op.Security, "%s %s", tst.method, tst.path)
+		}
+	}
+
+	// A reference to an undefined scheme is an error.
+	spec.SecurityDefinitions = nil
+	_, err = newIndexFromSpec(spec)
+	assert.Error(t, err)
+}
+
+// TestGlobalSecurity shows that top-level security is the default for operations, that operation security overrides
+// it and that an empty operation security opts-out.
+func TestGlobalSecurity(t *testing.T) {
+	read := path.Requirements{{Token: true, Scopes: path.Scopes{"read"}}}
+	admin := path.Requirements{{Token: true, Scopes: path.Scopes{"admin"}}}
+	tests := []struct {
+		spec    string
+		method  string
+		path    string
+		want    path.Requirements
+		comment string
+	}{
+		{swaggerGlobalSecurity, "GET", "/inherit", read, "2.0 inherit"},
+		{swaggerGlobalSecurity, "GET", "/override", admin, "2.0 override"},
+		{swaggerGlobalSecurity, "GET", "/optout", nil, "2.0 opt-out"},
+		{openapi3GlobalSecurity, "GET", "/inherit", read, "3.x inherit"},
+		{openapi3GlobalSecurity, "GET", "/override", admin, "3.x override"},
+		{openapi3GlobalSecurity, "GET", "/optout", nil, "3.x opt-out"},
+	}
+	for _, tst := range tests {
+		idx, err := parse([]byte(tst.spec))
+		if !assert.NoError(t, err, tst.comment) {
+			continue
+		}
+		op, err := idx.FindOperation(tst.method, tst.path)
+		if assert.NoError(t, err, tst.comment) {
+			assert.Equal(t, tst.want, op.Security, tst.comment)
+			assert.Equal(t, tst.want == nil, op.Security.Public(), tst.comment)
+		}
+	}
+}
+
+// TestAPIKeySecurity shows that apiKey schemes are stored with the requirement they're part of.
+func TestAPIKeySecurity(t *testing.T) {
+	key := path.Scheme{Name: "api_key", Type: path.SchemeTypeAPIKey, In: "header", Param: "X-Api-Key"}
+	tests := []struct {
+		spec    string
+		method  string
+		path    string
+		want    path.Requirements
+		comment string
+	}{
+		{swaggerAPIKey, "GET", "/pets", path.Requirements{{Schemes: []path.Scheme{key}}}, "2.0 apiKey"},
+		{swaggerAPIKey, "POST", "/pets", path.Requirements{{Token: true, Scopes: path.Scopes{"write"}, Schemes: []path.Scheme{key}}}, "2.0 apiKey and oauth2"},
+		{swaggerAPIKey, "DELETE", "/pets", path.Requirements{{Token: true, Scopes: path.Scopes{"admin"}}, {Schemes: []path.Scheme{key}}}, "2.0 apiKey or oauth2"},
+		{openapi3APIKey, "GET", "/pets", path.Requirements{{Schemes: []path.Scheme{{Name: "api_key", Type: path.SchemeTypeAPIKey, In: "query", Param: "key"}}}}, "3.x apiKey"},
+	}
+	for _, tst := range tests {
+		idx, err := parse([]byte(tst.spec))
+		if !assert.NoError(t, err, tst.comment) {
+			continue
+		}
+		op, err := idx.FindOperation(tst.method, tst.path)
+		if assert.NoError(t, err, tst.comment) {
+			assert.Equal(t, tst.want, op.Security, tst.comment)
+			assert.False(t, op.Security.Public(), tst.comment)
+		}
+	}
+}
+
+// TestBasicSecurity shows that basic schemes (Swagger 2.0 type basic, OpenAPI 3 type http with scheme basic) are
+// stored with the requirement they're part of.
+func TestBasicSecurity(t *testing.T) {
+	basic := path.Scheme{Name: "tooling", Type: path.SchemeTypeBasic}
+	tests := []struct {
+		spec    string
+		want    path.Requirements
+		comment string
+	}{
+		{swaggerBasic, path.Requirements{{Token: true, Scopes: path.Scopes{"admin"}}, {Schemes: []path.Scheme{basic}}}, "2.0 basic or oauth2"},
+		{openapi3Basic, path.Requirements{{Token: true, Scopes: path.Scopes{"admin"}}, {Schemes: []path.Scheme{basic}}}, "3.x basic or oauth2"},
+	}
+	for _, tst := range tests {
+		idx, err := parse([]byte(tst.spec))
+		if !assert.NoError(t, err, tst.comment) {
+			continue
+		}
+		op, err := idx.FindOperation("POST", "/jobs")
+		if assert.NoError(t, err, tst.comment) {
+			assert.Equal(t, tst.want, op.Security, tst.comment)
+		}
+	}
+}
+
+// TestExtensions shows that operations can require a client certificate with the x-apigw-client-cert extension, can
+// be marked retryable with the x-apigw-idempotent extension and routed with the x-apigw-upstream extension.
+func TestExtensions(t *testing.T) {
+	tests := []struct {
+		spec    string
+		comment string
+	}{
+		{`{
+  "swagger": "2.0",
+  "info": { "version": "v1", "title": "ClientCert" },
+  "paths": {
+    "/jobs": {
+      "get": { "responses": { "200": { "description": "ok" } } },
+      "post": { "x-apigw-client-cert": true, "responses": { "201": { "description": "ok" } } },
+      "put": { "x-apigw-idempotent": true, "x-apigw-upstream": "jobs", "responses": { "200": { "description": "ok" } } }
+    }
+  }
+}`, "2.0"},
+		{`{
+  "openapi": "3.0.2",
+  "info": { "version": "v1", "title": "ClientCert" },
+  "paths": {
+    "/jobs": {
+      "get": { "responses": { "200": { "description": "ok" } } },
+      "post": { "x-apigw-client-cert": true, "responses": { "201": { "description": "ok" } } },
+      "put": { "x-apigw-idempotent": true, "x-apigw-upstream": "jobs", "responses": { "200": { "description": "ok" } } }
+    }
+  }
+}`, "3.x"},
+	}
+	for _, tst := range tests {
+		idx, err := parse([]byte(tst.spec))
+		if !assert.NoError(t, err, tst.comment) {
+			continue
+		}
+		for method, want := range map[string][2]bool{"GET": {false, false}, "POST": {true, false}, "PUT": {false, true}} {
+			op, err := idx.FindOperation(method, "/jobs")
+			if assert.NoError(t, err, tst.comment) {
+				assert.Equal(t, want[0], op.ClientCert, "%s %s client cert", tst.comment, method)
+				assert.Equal(t, want[1], op.Idempotent, "%s %s idempotent", tst.comment, method)
+				assert.Equal(t, want[1], op.Upstream == "jobs", "%s %s upstream", tst.comment, method)
+			}
+		}
+	}
+}
+
+// SwaggerBasic is a swagger spec with basic security.
+var swaggerBasic = `
+{
+  "swagger": "2.0",
+  "info": { "version": "v1", "title": "Basic" },
+  "paths": {
+    "/jobs": { "post": { "security": [{ "auth": ["admin"] }, { "tooling": [] }], "responses": { "201": { "description": "ok" } } } }
+  },
+  "securityDefinitions": {
+    "tooling": { "type": "basic" },
+    "auth": { "type": "oauth2", "flow": "implicit", "authorizationUrl": "https://example.com/authorize", "scopes": {} }
+  }
+}
+`
+
+// Openapi3Basic is an OpenAPI 3 spec with basic security.
+var openapi3Basic = `
+{
+  "openapi": "3.0.2",
+  "info": { "version": "v1", "title": "Basic" },
+  "paths": {
+    "/jobs": { "post": { "security": [{ "auth": ["admin"] }, { "tooling": [] }], "responses": { "201": { "description": "ok" } } } }
+  },
+  "components": {
+    "securitySchemes": {
+      "tooling": { "type": "http", "scheme": "basic" },
+      "auth": { "type": "oauth2", "flows": {} }
+    }
+  }
+}
+`
+
+// SwaggerAPIKey is a swagger spec with apiKey security.
+var swaggerAPIKey = `
+{
+  "swagger": "2.0",
+  "info": { "version": "v1", "title": "APIKey" },
+  "paths": {
+    "/pets": {
+      "get": { "security": [{ "api_key": [] }], "responses": { "200": { "description": "ok" } } },
+      "post": { "security": [{ "api_key": [], "auth": ["write"] }], "responses": { "201": { "description": "ok" } } },
+      "delete": { "security": [{ "auth": ["admin"] }, { "api_key": [] }], "responses": { "204": { "description": "ok" } } }
+    }
+  },
+  "securityDefinitions": {
+    "api_key": { "type": "apiKey", "name": "X-Api-Key", "in": "header" },
+    "auth": { "type": "oauth2", "flow": "implicit", "authorizationUrl": "https://example.com/authorize", "scopes": {} }
+  }
+}
+`
+
+// Openapi3APIKey is an OpenAPI 3 spec with apiKey security.
+var openapi3APIKey = `
+{
+  "openapi": "3.0.2",
+  "info": { "version": "v1", "title": "APIKey" },
+  "paths": {
+    "/pets": { "get": { "security": [{ "api_key": [] }], "responses": { "200": { "description": "ok" } } } }
+  },
+  "components": {
+    "securitySchemes": {
+      "api_key": { "type": "apiKey", "name": "key", "in": "query" }
+    }
+  }
+}
+`
+
+// SwaggerGlobalSecurity is a swagger spec with top-level security.
+var swaggerGlobalSecurity = `
+{
+  "swagger": "2.0",
+  "info": { "version": "v1", "title": "Global" },
+  "paths": {
+    "/inherit": { "get": { "responses": { "200": { "description": "ok" } } } },
+    "/override": { "get": { "security": [{ "auth": ["admin"] }], "responses": { "200": { "description": "ok" } } } },
+    "/optout": { "get": { "security": [], "responses": { "200": { "description": "ok" } } } }
+  },
+  "securityDefinitions": {
+    "auth": { "type": "oauth2", "flow": "implicit", "authorizationUrl": "https://example.com/authorize", "scopes": {} }
+  },
+  "security": [{ "auth": ["read"] }]
+}
+`
+
+// Openapi3GlobalSecurity is an OpenAPI 3 spec with top-level security.
+var openapi3GlobalSecurity = `
+{
+  "openapi": "3.0.2",
+  "info": { "version": "v1", "title": "Global" },
+  "paths": {
+    "/inherit": { "get": { "responses": { "200": { "description": "ok" } } } },
+    "/override": { "get": { "security": [{ "auth": ["admin"] }], "responses": { "200": { "description": "ok" } } } },
+    "/optout": { "get": { "security": [], "responses": { "200": { "description": "ok" } } } }
+  },
+  "components": {
+    "securitySchemes": { "auth": { "type": "oauth2" } }
+  },
+  "security": [{ "auth": ["read"] }]
+}
+`
+
+// SwaggerAlternatives is a swagger spec with an oauth2 scheme that isn't named 'oauth2' and security alternatives.
+var swaggerAlternatives = `
+{
+  "swagger": "2.0",
+  "info": { "version": "v1", "title": "Petstore" },
+  "paths": {
+    "/pets": {
+      "get": {
+        "security": [{ "petstore_auth": ["read"] }, { "petstore_auth": ["admin"] }],
+        "responses": { "200": { "description": "pets" } }
+      },
+      "post": {
+        "security": [{ "petstore_auth": ["write", "read"] }],
+        "responses": { "201": { "description": "created" } }
+      }
+    },
+    "/version": {
+      "get": {
+        "responses": { "200": { "description": "version" } }
+      }
+    }
+  },
+  "securityDefinitions": {
+    "petstore_auth": {
+      "type": "oauth2",
+      "flow": "accessCode",
+      "authorizationUrl": "https://petstore.example.com/oauth/authorize",
+      "tokenUrl": "https://petstore.example.com/oauth/token",
+      "scopes": { "read": "read pets", "write": "write pets", "admin": "administer pets" }
+    }
+  }
+}
+`
+
 // Swagger is a string with a swagger json API specification.
 var swagger = `
 {
@@ -1,4 +1,4 @@
-// Package path provides and index that stores http method/path and associated values like scopes.
+// Package path provides and index that stores http method/path and associated values like security requirements.
 package path
 
 import (
@@ -20,28 +20,136 @@ type node struct {
 	param bool
 	// Children nodes.
 	children nodes
-	// Methods are the http methods available for a path with their associated scopes.
-	Methods map[string]Scopes
+	// Methods are the http methods available for a path with their associated operation.
+	Methods map[string]*Operation
 }
 
 type nodes []*node
 
+// Operation holds the values associated with a http method/path.
+type Operation struct {
+	// Method is the http method.
+	Method string
+	// Path is the path as defined in the API definition, for example /pets/{petId}
+	Path string
+	// ID is the operationId (optional).
+	ID string
+	// Tags are used to group operations (optional).
+	Tags []string
+	// Security are the requirements to access the operation.
+	Security Requirements
+	// ClientCert is true when the operation requires a verified TLS client certificate.
+	ClientCert bool
+	// Idempotent is true when the operation may be retried by the proxy.
+	Idempotent bool
+	// Upstream is the name of the target pool the operation is proxied to (empty for the routing rules).
+	Upstream string
+}
+
+// Name returns the operationId or, when there is none, "METHOD path".
+func (op *Operation) Name() string {
+	if op.ID != "" {
+		return op.ID
+	}
+	return op.Method + " " + op.Path
+}
+
+// Requirements are alternatives of which at least one must be satisfied (OR).
+// No requirements or an empty Requirement (no token, scopes or schemes) means public access.
+type Requirements []Requirement
+
+// Requirement is a set of security schemes that must all be satisfied (AND).
+type Requirement struct {
+	// Token is true when a valid OAuth2 access token is required, also when no Scopes are required.
+	Token bool
+	// Scopes an OAuth2 access token must have.
+	Scopes Scopes
+	// Schemes are the other (non OAuth2) security schemes.
+	Schemes []Scheme
+}
+
+// Scheme is a security scheme other than OAuth2.
+type Scheme struct {
+	// Name of the scheme in the API definition.
+	Name string
+	// Type of the scheme, for example apiKey
+	Type string
+	// In is the location of the credentials; header, query or cookie (apiKey only).
+	In string
+	// Param is the name of the header, query parameter or cookie (apiKey only).
+	Param string
+}
+
+// Scheme types.
+const (
+	SchemeTypeAPIKey = "apiKey"
+	SchemeTypeBasic  = "basic"
+)
+
 // Scopes are a collection of OAuth2 scope names.
 type Scopes []string
 
+// Public returns true if no security is required.
+func (rs Requirements) Public() bool {
+	if len(rs) == 0 {
+		return true
+	}
+	for _, r := range rs {
+		if r.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the scopes and the names of the other schemes, for example {[read] [api_key]}
+// A token without scopes is shown as token, for example {token}
+func (r Requirement) String() string {
+	var scopes interface{} = r.Scopes
+	if r.Token && len(r.Scopes) == 0 {
+		scopes = "token"
+	}
+	if len(r.Schemes) == 0 {
+		return fmt.Sprintf("{%v}", scopes)
+	}
+	names := make([]string, 0, len(r.Schemes))
+	for _, s := range r.Schemes {
+		names = append(names, s.Name)
+	}
+	return fmt.Sprintf("{%v %v}", scopes, names)
+}
+
+// NeedsToken returns true if the requirement can only be satisfied with an OAuth2 access token.
+func (r Requirement) NeedsToken() bool {
+	return r.Token || len(r.Scopes) > 0
+}
+
+// Empty returns true if the requirement is satisfied without any credentials.
+func (r Requirement) empty() bool {
+	return !r.NeedsToken() && len(r.Schemes) == 0
+}
 
 // NewIndex returns an empty index.
 func NewIndex() *Index {
 	return &Index{root: &node{}}
 }
 
-// AddMethodPathScopes adds http method/path with scopes to the receiver.
+// AddMethodPathScopes adds http method/path with a single requirement of scopes to the receiver.
 func (idx *Index) AddMethodPathScopes(method, path string, scopes []string) (*node, error) {
+	op := &Operation{}
+	if len(scopes) > 0 {
+		op.Security = Requirements{{Token: true, Scopes: scopes}}
+	}
+	return idx.AddOperation(method, path, op)
+}
+
+// AddOperation adds http method/path with operation to the receiver.
+func (idx *Index) AddOperation(method, path string, op *Operation) (*node, error) {
 	n, err := idx.AddPath(path)
 	if err != nil {
 		return nil, err
 	}
-	n.Methods[method] = scopes
+	n.Methods[method] = op
 
 	return n, nil
 }
@@ -60,7 +168,7 @@ func (idx *Index) AddPath(path string) (*node, error) {
 			nn = &node{
 				name: e,
 				param: isParam,
-				Methods: make(map[string]Scopes),
+				Methods: make(map[string]*Operation),
 			}
 			n.children = append(n.children, nn)
 		}
@@ -71,17 +179,42 @@ func (idx *Index) AddPath(path string) (*node, error) {
 }
 
 // FindScopes returns scopes for a http method/path.
-// Return error if method/path isn't found.
+// Return error if method/path isn't found or if it has requirements that can't be expressed as scopes; alternative
+// requirements, a token without scopes or non OAuth2 schemes (use FindOperation instead).
 func (idx *Index) FindScopes(method, path string) (Scopes, error) {
+	op, err := idx.FindOperation(method, path)
+	if err != nil {
+		return nil, err
+	}
+	switch len(op.Security) {
+	case 0:
+		return nil, nil
+	case 1:
+		req := op.Security[0]
+		if len(req.Schemes) > 0 {
+			return nil, fmt.Errorf("%s %s requires security schemes other than OAuth2", method, path)
+		}
+		if req.NeedsToken() && len(req.Scopes) == 0 {
+			return nil, fmt.Errorf("%s %s requires a token without scopes", method, path)
+		}
+		return req.Scopes, nil
+	default:
+		return nil, fmt.Errorf("%s %s has alternative security requirements", method, path)
+	}
+}
+
+// FindOperation returns the operation for a http method/path.
+// Return error if method/path isn't found.
+func (idx *Index) FindOperation(method, path string) (*Operation, error) {
 	n, err := idx.Find(path)
 	if err != nil {
 		return nil, err
 	}
-	s, ok := n.Methods[method]
+	op, ok := n.Methods[method]
 	if !ok {
-		err = fmt.Errorf("no %s %s in index", method, path)
+		return nil, fmt.Errorf("no %s %s in index", method, path)
 	}
-	return s, err
+	return op, nil
 }
 
 // FindMethods returns http methods for a path.
@@ -61,13 +61,13 @@ func TestMatchAndUpdate(t *testing.T) {
 	for _, path := range testPaths {
 		n, err := idx.Find(path)
 		assert.NoError(t, err)
-		n.Methods["GET"] = []string{path} // use path as data
+		n.Methods["GET"] = &Operation{Security: Requirements{{Scopes: Scopes{path}}}} // use path as data
 	}
 	// ...and check
 	for _, path := range testPaths {
 		n, err := idx.Find(path)
 		assert.NoError(t, err)
-		assert.ElementsMatch(t, n.Methods["GET"], []string{path})
+		assert.ElementsMatch(t, n.Methods["GET"].Security[0].Scopes, []string{path})
 	}
 }
 
@@ -184,3 +184,71 @@ func TestNoMethods(t *testing.T) {
 		assert.Error(t, err, "%s)", tst.path)
 	}
 }
+
+// TestFindOperation shows that alternative security requirements are stored and can be found again.
+func TestFindOperation(t *testing.T) {
+	idx := NewIndex()
+	readOrAdmin := Requirements{{Scopes: Scopes{"read"}}, {Scopes: Scopes{"admin"}}}
+	_, err := idx.AddOperation("GET", "/accounts/{id}", &Operation{Security: readOrAdmin})
+	assert.NoError(t, err)
+
+	op, err := idx.FindOperation("GET", "/accounts/123")
+	if assert.NoError(t, err) {
+		assert.Equal(t, readOrAdmin, op.Security)
+		assert.False(t, op.Security.Public())
+	}
+
+	_, err = idx.FindOperation("PUT", "/accounts/123")
+	assert.Error(t, err, "method not in index")
+
+	_, err = idx.FindScopes("GET", "/accounts/123")
+	assert.Error(t, err, "FindScopes can't return alternatives")
+}
+
+// TestFindScopesUnexpressible shows that FindScopes fails on a requirement that can't be expressed as scopes.
+func TestFindScopesUnexpressible(t *testing.T) {
+	var tests = []struct {
+		reqs    Requirements
+		wantErr bool
+		info    string
+	}{
+		{reqs: nil, info: "public"},
+		{reqs: Requirements{{Token: true, Scopes: Scopes{"read"}}}, info: "scopes"},
+		{reqs: Requirements{{Token: true}}, wantErr: true, info: "token without scopes"},
+		{reqs: Requirements{{Schemes: []Scheme{{Name: "key", Type: "apiKey", In: "header", Param: "X-API-Key"}}}}, wantErr: true, info: "apiKey"},
+		{reqs: Requirements{{Token: true, Scopes: Scopes{"read"}, Schemes: []Scheme{{Name: "basic", Type: "basic"}}}}, wantErr: true, info: "scopes and basic"},
+	}
+	for _, tst := range tests {
+		idx := NewIndex()
+		_, err := idx.AddOperation("GET", "/accounts", &Operation{Security: tst.reqs})
+		assert.NoError(t, err, tst.info)
+
+		_, err = idx.FindScopes("GET", "/accounts")
+		if tst.wantErr {
+			assert.Error(t, err, tst.info)
+		} else {
+			assert.NoError(t, err, tst.info)
+		}
+	}
+}
+
+// TestPublic shows when requirements grant public access.
+func TestPublic(t *testing.T) {
+	var tests = []struct {
+		reqs Requirements
+		want bool
+	}{
+		{nil, true},
+		{Requirements{}, true},
+		{Requirements{{}}, true},
+		{Requirements{{Scopes: Scopes{"read"}}}, false},
+		{Requirements{{Token: true}}, false},
+		{Requirements{{Scopes: Scopes{"read"}}, {}}, true},
+		{Requirements{{Scopes: Scopes{"read"}}, {Scopes: Scopes{"admin"}}}, false},
+		{Requirements{{Schemes: []Scheme{{Name: "api_key", Type: SchemeTypeAPIKey}}}}, false},
+		{Requirements{{Schemes: []Scheme{{Name: "api_key", Type: SchemeTypeAPIKey}}}, {}}, true},
+	}
+	for i, tst := range tests {
+		assert.Equal(t, tst.want, tst.reqs.Public(), "%d) %v", i, tst.reqs)
+	}
+}
@@ -2,6 +2,8 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/mmlt/apigw/gateway"
@@ -11,6 +13,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -211,7 +214,7 @@ func TestGwHttpGet(t *testing.T) {
 		{"http://" + ingressPort + "/doesnotexist", http.StatusNotFound, "404 by gateway"},
 		{"http://" + ingressPort + "/api/v1/doesnotexist", http.StatusNotFound, "404 by upstream server"},
 		{"http://" + ingressPort + "/read", http.StatusNotFound, "404 by gateway for /read"},
-		{"http://" + ingressPort + "/api/v1/read", http.StatusBadRequest, "requires Authorization header"},
+		{"http://" + ingressPort + "/api/v1/read", http.StatusUnauthorized, "requires Authorization header"},
 	}
 
 	serverNames := []string{"upstream1", "upstream2"}
@@ -244,7 +247,7 @@ func TestErrorResponse(t *testing.T) {
 		want string
 	}{
 		{"http://" + ingressPort + "/doesnotexist", `{ "developerMessage":"Not found", "endUserMessage":"", "errorCode":"Not found", "errorId":404 }`},
-		{"http://" + ingressPort + "/api/v1/read", `{ "developerMessage":"Missing or malformed token", "endUserMessage":"", "errorCode":"Missing or malformed token", "errorId":400 }`},
+		{"http://" + ingressPort + "/api/v1/read", `{ "developerMessage":"Missing or malformed token", "endUserMessage":"", "errorCode":"Missing or malformed token", "errorId":401 }`},
 	}
 
 	for _, tst := range tests {
@@ -285,10 +288,11 @@ func TestReadScope(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	want := http.StatusBadRequest
+	want := http.StatusUnauthorized
 	if resp.StatusCode != want {
 		t.Errorf(" without bearer token; expected %d, got %d", want, resp.StatusCode)
 	}
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"), "without bearer token")
 	resp.Body.Close()
 
 	// call with invalid bearer token should return Unauthorized
@@ -302,6 +306,7 @@ func TestReadScope(t *testing.T) {
 	if resp.StatusCode != want {
 		t.Errorf(" with invalid bearer token; expected %d, got %d", want, resp.StatusCode)
 	}
+	assert.Equal(t, `Bearer error="invalid_token"`, resp.Header.Get("WWW-Authenticate"), "with invalid bearer token")
 	resp.Body.Close()
 
 	// call with valid bearer token returns OK
@@ -331,6 +336,19 @@ func TestReadScope(t *testing.T) {
 	resp.Body.Close()
 }
 
+// TestWriteScope shows that a token with insufficient scope is Forbidden and the required scope is returned.
+func TestWriteScope(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://"+ingressPort+"/api/v1/write", nil)
+	req.Header.Add("Authorization", "Bearer readabcdef") // defined in testoauth2idp
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="write"`, resp.Header.Get("WWW-Authenticate"))
+}
+
 func TestHeaders(t *testing.T) {
 	tests := []struct {
 		id			 string // some random string to match test data with test error messages.
@@ -538,4 +556,65 @@ func TestHeaders(t *testing.T) {
 
 		resp.Body.Close()
 	}
-}
\ No newline at end of file
+}
+// TestHealth shows that the gateway reports alive and, once the OpenAPI definition is read, ready.
+func TestHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	gw.Healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "healthz")
+
+	var rd gateway.Readiness
+	for i := 0; i < 20; i++ {
+		w = httptest.NewRecorder()
+		gw.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code == http.StatusOK {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, http.StatusOK, w.Code, "readyz")
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rd)) {
+		for _, name := range []string{"openapi", "idp", "targets"} {
+			assert.Equal(t, gateway.StatusOK, rd.Checks[name].Status, "check %s", name)
+		}
+	}
+}
+
+// TestSSE shows that a Server-Sent Events stream is authorized when it's opened and that events are streamed.
+func TestSSE(t *testing.T) {
+	url := "http://" + ingressPort + "/api/v1/events"
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "without bearer token")
+	resp.Body.Close()
+
+	req, _ = http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Add("Authorization", "Bearer readabcdef") // defined in testoauth2idp
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "with valid bearer token")
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// read 3 events
+	r := bufio.NewReader(resp.Body)
+	var events []string
+	for len(events) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			events = append(events, line)
+		}
+	}
+	assert.Regexp(t, `^data: Hello from upstream server upstream[12]!\n$`, events[2])
+}
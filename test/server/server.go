@@ -75,6 +75,7 @@ func IDP(name, port string) *Testsvr {
 //	/public, /read, /write - echo path and server name
 //	/v1/doc/swagger.json - api definition for /read and /write paths
 //	/ws - websocket server that sends 1 msg/sec
+//	/events - Server-Sent Events stream that sends 10 events/sec
 func Multipurpose(name, port string) *Testsvr {
 	e := echo.New()
 	e.HideBanner = true
@@ -113,6 +114,26 @@ func Multipurpose(name, port string) *Testsvr {
 		return nil
 	})
 
+	// Server-Sent Events handler
+	e.GET("/events", func(c echo.Context) error {
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.WriteHeader(http.StatusOK)
+		for i := 0; ; i++ {
+			_, err := fmt.Fprintf(res, "id: %d\ndata: Hello from upstream server %s!\n\n", i, name)
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	})
+
 	return &Testsvr{Name: name, Port: port, Echo: e}
 }
 
@@ -212,6 +233,18 @@ var swagger = `
         "security": [{"oauth2": ["write"]}]
       }
     },
+    "/events": {
+      "get": {
+        "tags": ["read"],
+        "summary": "get a Server-Sent Events stream that requires 'read' scope.",
+        "description": "",
+        "operationId": "EV",
+        "consumes": [],
+        "produces": ["text/event-stream"],
+        "deprecated": false,
+        "security": [{"oauth2": ["read"]}]
+      }
+    },
     "/public": {
       "get": {
         "tags": ["public"],
@@ -221,7 +254,7 @@ var swagger = `
         "consumes": [],
         "produces": ["application/json", "text/json"],
         "deprecated": false,
-        "security": [{"oauth2": [""]}],
+        "security": [],
         "x-scope": ""
       }
     }